@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ACL actions
+const (
+	ACLAllow  = "allow"
+	ACLRefuse = "refuse"
+	ACLDrop   = "drop"
+)
+
+// ACL names, every kind of request is checked by its own acl
+const (
+	ACLQuery    = "query"
+	ACLTransfer = "transfer"
+	ACLNotify   = "notify"
+	ACLAdmin    = "admin"
+)
+
+// ACLRule matches clients by prefix, and optionally by transport and query
+// type, empty transports or qtypes match all of them
+type ACLRule struct {
+	Prefixes   []string `json:"prefixes"`
+	Transports []string `json:"transports,omitempty"`
+	QTypes     []string `json:"qtypes,omitempty"`
+	Action     string   `json:"action"`
+	Matches    uint64   `json:"matches"`
+
+	transports map[string]bool
+	qTypes     map[uint16]bool
+}
+
+// ACLList is an ordered rule list, the first matching rule decides the
+// action and Default is used when no rule matches
+type ACLList struct {
+	Rules          []*ACLRule `json:"rules"`
+	Default        string     `json:"default"`
+	DefaultMatches uint64     `json:"default_matches"`
+
+	// ipv4 and ipv6 prefixes are kept apart so an ipv6 prefix like ::/0
+	// never matches ipv4 clients
+	ipv4 *prefixTrie
+	ipv6 *prefixTrie
+}
+
+// prefixTrie is a binary trie of ip prefixes of one address family
+type prefixTrie struct {
+	children [2]*prefixTrie
+	rules    []int
+}
+
+func (trie *prefixTrie) insert(ip net.IP, ones int, rule int) {
+	node := trie
+	for i := 0; i < ones; i++ {
+		bit := (ip[i/8] >> uint(7-i%8)) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &prefixTrie{}
+		}
+		node = node.children[bit]
+	}
+	node.rules = append(node.rules, rule)
+}
+
+// lookup returns the smallest index of rules whose prefix contains ip and
+// which accepts the request, ip has the length of the trie family
+func (trie *prefixTrie) lookup(ip net.IP, accept func(rule int) bool) int {
+	best := -1
+	node := trie
+	for i := 0; node != nil; i++ {
+		for _, rule := range node.rules {
+			if (best < 0 || rule < best) && accept(rule) {
+				best = rule
+			}
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[(ip[i/8]>>uint(7-i%8))&1]
+	}
+	return best
+}
+
+func (list *ACLList) compile() error {
+	if list.Default == "" {
+		list.Default = ACLAllow
+	}
+	if validACLAction(list.Default) == false {
+		return fmt.Errorf("invalid acl default action %s", list.Default)
+	}
+	list.ipv4, list.ipv6 = &prefixTrie{}, &prefixTrie{}
+	for index, rule := range list.Rules {
+		if validACLAction(rule.Action) == false {
+			return fmt.Errorf("invalid acl action %s", rule.Action)
+		}
+		if len(rule.Prefixes) == 0 {
+			return fmt.Errorf("acl rule %d has no prefix", index)
+		}
+		for _, prefix := range rule.Prefixes {
+			if strings.Contains(prefix, "/") == false {
+				if strings.Contains(prefix, ":") {
+					prefix += "/128"
+				} else {
+					prefix += "/32"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(prefix)
+			if err != nil {
+				return err
+			}
+			ones, bits := ipNet.Mask.Size()
+			if bits == 32 {
+				list.ipv4.insert(ipNet.IP.To4(), ones, index)
+				continue
+			}
+			if ones >= 96 && ipNet.IP.To4() != nil {
+				// ipv4 clients are only matched by ipv4 prefixes
+				return fmt.Errorf("acl prefix %s is ipv4 mapped, write it as ipv4 prefix", prefix)
+			}
+			list.ipv6.insert(ipNet.IP.To16(), ones, index)
+		}
+		rule.transports = make(map[string]bool)
+		for _, transport := range rule.Transports {
+			rule.transports[strings.ToLower(transport)] = true
+		}
+		rule.qTypes = make(map[uint16]bool)
+		for _, name := range rule.QTypes {
+			qType, ok := parseQueryType(name)
+			if ok == false {
+				return fmt.Errorf("invalid acl query type %s", name)
+			}
+			rule.qTypes[qType] = true
+		}
+	}
+	return nil
+}
+
+func validACLAction(action string) bool {
+	return action == ACLAllow || action == ACLRefuse || action == ACLDrop
+}
+
+// Check returns the action for the client and counts the matched rule
+func (list *ACLList) Check(ip net.IP, transport string, qType uint16) string {
+	trie := list.ipv6
+	if ipv4 := ip.To4(); ipv4 != nil {
+		trie, ip = list.ipv4, ipv4
+	} else if ip = ip.To16(); ip == nil {
+		atomic.AddUint64(&list.DefaultMatches, 1)
+		return list.Default
+	}
+	index := trie.lookup(ip, func(index int) bool {
+		rule := list.Rules[index]
+		if len(rule.transports) > 0 && rule.transports[transport] == false {
+			return false
+		}
+		if len(rule.qTypes) > 0 && rule.qTypes[qType] == false {
+			return false
+		}
+		return true
+	})
+	if index < 0 {
+		atomic.AddUint64(&list.DefaultMatches, 1)
+		return list.Default
+	}
+	rule := list.Rules[index]
+	atomic.AddUint64(&rule.Matches, 1)
+	return rule.Action
+}
+
+// ACL holds the acl lists loaded from a json file like
+//
+//	{"query": {"rules": [{"prefixes": ["127.0.0.0/8", "::1"], "action": "allow"}], "default": "refuse"}}
+//
+// the lists are replaced as a whole when the file is reloaded
+type ACL struct {
+	sync.RWMutex
+	filename string
+	lists    map[string]*ACLList
+}
+
+func NewACLFromFile(filename string) (*ACL, error) {
+	acl := &ACL{filename: filename}
+	if err := acl.Reload(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Reload loads the acl file again, the current lists are kept on error
+func (acl *ACL) Reload() error {
+	data, err := ioutil.ReadFile(acl.filename)
+	if err != nil {
+		return err
+	}
+	lists := make(map[string]*ACLList)
+	if err := json.Unmarshal(data, &lists); err != nil {
+		return fmt.Errorf("parse acl file %s fail: %s", acl.filename, err)
+	}
+	for name, list := range lists {
+		switch name {
+		case ACLQuery, ACLTransfer, ACLNotify, ACLAdmin:
+		default:
+			return fmt.Errorf("unknown acl %s", name)
+		}
+		if err := list.compile(); err != nil {
+			return fmt.Errorf("acl %s: %s", name, err)
+		}
+	}
+	acl.Lock()
+	acl.lists = lists
+	acl.Unlock()
+	return nil
+}
+
+// Check returns the action of acl name for the client, clients are
+// allowed when the acl is not configured
+func (acl *ACL) Check(name string, addr net.Addr, transport string, qType uint16) string {
+	acl.RLock()
+	list, ok := acl.lists[name]
+	acl.RUnlock()
+	if ok == false {
+		return ACLAllow
+	}
+	return list.Check(addrIP(addr), transport, qType)
+}
+
+// Snapshot returns the current lists with their match counters
+func (acl *ACL) Snapshot() map[string]*ACLList {
+	acl.RLock()
+	defer acl.RUnlock()
+	result := make(map[string]*ACLList, len(acl.lists))
+	for name, list := range acl.lists {
+		copied := &ACLList{Default: list.Default, DefaultMatches: atomic.LoadUint64(&list.DefaultMatches)}
+		for _, rule := range list.Rules {
+			copied.Rules = append(copied.Rules, &ACLRule{
+				Prefixes:   rule.Prefixes,
+				Transports: rule.Transports,
+				QTypes:     rule.QTypes,
+				Action:     rule.Action,
+				Matches:    atomic.LoadUint64(&rule.Matches),
+			})
+		}
+		result[name] = copied
+	}
+	return result
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch casted := addr.(type) {
+	case *net.UDPAddr:
+		return casted.IP
+	case *net.TCPAddr:
+		return casted.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// aclName returns which acl checks the request
+func aclName(r *dns.Msg) (string, uint16) {
+	var qType uint16
+	if len(r.Question) > 0 {
+		qType = r.Question[0].Qtype
+	}
+	if r.Opcode == dns.OpcodeNotify {
+		return ACLNotify, qType
+	}
+	if qType == dns.TypeAXFR || qType == dns.TypeIXFR {
+		return ACLTransfer, qType
+	}
+	return ACLQuery, qType
+}
+
+// checkACL applies acl to a dns request, it returns false when the request
+// has been refused or dropped
+func (manager *Manager) checkACL(w dns.ResponseWriter, r *dns.Msg, transport string) bool {
+	if manager.acl == nil {
+		return true
+	}
+	name, qType := aclName(r)
+	switch manager.acl.Check(name, w.RemoteAddr(), transport, qType) {
+	case ACLRefuse:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		manager.writeResponse(w, r, m, manager.edeOption(EDEProhibited, "refused by "+name+" acl"))
+		return false
+	case ACLDrop:
+		return false
+	}
+	return true
+}
+
+// adminACL protects the http api with the admin acl
+func (manager *Manager) adminACL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if manager.acl == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		addr := &net.TCPAddr{IP: net.ParseIP(host)}
+		switch manager.acl.Check(ACLAdmin, addr, "http", 0) {
+		case ACLRefuse:
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		case ACLDrop:
+			if hijacker, ok := w.(http.Hijacker); ok == true {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// ReloadACL reloads acl file, it is called on SIGHUP
+func (manager *Manager) ReloadACL() {
+	if manager.acl == nil {
+		return
+	}
+	if err := manager.acl.Reload(); err != nil {
+		log.Errorf("reload acl fail, keep using the old one: %s", err)
+		return
+	}
+	log.Infof("reload acl file %s success", manager.acl.filename)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testWriter is a dns.ResponseWriter keeping the written response
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+func (w *testWriter) Write(data []byte) (int, error) {
+	w.msg = new(dns.Msg)
+	return len(data), w.msg.Unpack(data)
+}
+func (w *testWriter) Close() error        { return nil }
+func (w *testWriter) TsigStatus() error   { return nil }
+func (w *testWriter) TsigTimersOnly(bool) {}
+func (w *testWriter) Hijack()             {}
+
+const testACL = `{
+  "query": {
+    "rules": [
+      {"prefixes": ["10.1.0.0/16"], "qtypes": ["ANY"], "action": "refuse"},
+      {"prefixes": ["10.0.0.0/8", "2001:db8::/32"], "transports": ["udp"], "action": "allow"},
+      {"prefixes": ["10.1.2.3"], "action": "drop"}
+    ],
+    "default": "refuse"
+  },
+  "transfer": {"rules": [{"prefixes": ["192.0.2.0/24"], "action": "allow"}], "default": "drop"}
+}`
+
+func writeTestACL(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "acl.json")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename, func() { os.RemoveAll(dir) }
+}
+
+func TestACLCheck(t *testing.T) {
+	filename, cleanup := writeTestACL(t, testACL)
+	defer cleanup()
+	acl, err := NewACLFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name      string
+		ip        string
+		transport string
+		qType     uint16
+		action    string
+	}{
+		{ACLQuery, "10.1.2.3", "udp", dns.TypeANY, ACLRefuse},
+		{ACLQuery, "10.1.2.3", "udp", dns.TypeA, ACLAllow},
+		{ACLQuery, "10.1.2.3", "tcp", dns.TypeA, ACLDrop},
+		{ACLQuery, "10.2.0.1", "tcp", dns.TypeA, ACLRefuse},
+		{ACLQuery, "2001:db8::1", "udp", dns.TypeA, ACLAllow},
+		{ACLQuery, "2001:db9::1", "udp", dns.TypeA, ACLRefuse},
+		{ACLTransfer, "192.0.2.7", "xot", dns.TypeAXFR, ACLAllow},
+		{ACLTransfer, "10.1.2.3", "xot", dns.TypeAXFR, ACLDrop},
+		{ACLNotify, "10.1.2.3", "udp", dns.TypeSOA, ACLAllow},
+	} {
+		addr := &net.UDPAddr{IP: net.ParseIP(c.ip)}
+		if action := acl.Check(c.name, addr, c.transport, c.qType); action != c.action {
+			t.Errorf("%s acl for %s over %s type %d: expect %s, got %s", c.name, c.ip, c.transport, c.qType, c.action, action)
+		}
+	}
+	query := acl.Snapshot()[ACLQuery]
+	if query.Rules[0].Matches != 1 || query.Rules[1].Matches != 2 || query.Rules[2].Matches != 1 || query.DefaultMatches != 2 {
+		t.Errorf("unexpected acl match counters %+v %d", query.Rules, query.DefaultMatches)
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"query": {"rules": [{"prefixes": ["bad"], "action": "allow"}]}}`), 0644)
+	if err := acl.Reload(); err == nil {
+		t.Error("expect reload invalid acl fail")
+	}
+	if action := acl.Check(ACLQuery, &net.UDPAddr{IP: net.ParseIP("10.2.0.1")}, "udp", dns.TypeA); action != ACLAllow {
+		t.Errorf("expect old acl kept after failed reload, got %s", action)
+	}
+	ioutil.WriteFile(filename, []byte(`{"query": {"default": "drop"}}`), 0644)
+	if err := acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if action := acl.Check(ACLQuery, &net.UDPAddr{IP: net.ParseIP("10.2.0.1")}, "udp", dns.TypeA); action != ACLDrop {
+		t.Errorf("expect reloaded acl used, got %s", action)
+	}
+}
+
+func TestACLAddressFamily(t *testing.T) {
+	filename, cleanup := writeTestACL(t, `{"query": {"rules": [
+  {"prefixes": ["::/0"], "action": "drop"},
+  {"prefixes": ["0.0.0.0/0"], "action": "refuse"}
+]}}`)
+	defer cleanup()
+	acl, err := NewACLFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip     string
+		action string
+	}{
+		{"2001:db8::1", ACLDrop},
+		{"::1", ACLDrop},
+		{"192.0.2.1", ACLRefuse},
+		// clients of dual stack sockets are ipv4
+		{"::ffff:192.0.2.1", ACLRefuse},
+	} {
+		if action := acl.Check(ACLQuery, &net.UDPAddr{IP: net.ParseIP(c.ip)}, "udp", dns.TypeA); action != c.action {
+			t.Errorf("acl for %s: expect %s, got %s", c.ip, c.action, action)
+		}
+	}
+	ioutil.WriteFile(filename, []byte(`{"query": {"rules": [{"prefixes": ["::ffff:0:0/96"], "action": "allow"}]}}`), 0644)
+	if err := acl.Reload(); err == nil {
+		t.Error("expect ipv4 mapped prefix refused")
+	}
+}
+
+func TestACLHandler(t *testing.T) {
+	filename, cleanup := writeTestACL(t, testACL)
+	defer cleanup()
+	manager := newTestManager(t)
+	if err := manager.EnableACL(filename); err != nil {
+		t.Fatal(err)
+	}
+	serve := manager.handler("udp", manager.handleRequest)
+	for _, c := range []struct {
+		ip    string
+		rcode int
+	}{
+		{"10.0.0.1", dns.RcodeSuccess},
+		{"192.0.2.1", dns.RcodeRefused},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion("com.", dns.TypeNS)
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP(c.ip), Port: 5353}}
+		serve(w, m)
+		if w.msg == nil || w.msg.Rcode != c.rcode {
+			t.Errorf("query from %s: expect rcode %d, got %v", c.ip, c.rcode, w.msg)
+		}
+	}
+}
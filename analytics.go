@@ -0,0 +1,337 @@
+package main
+
+import (
+	"container/heap"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// heavyHitter is one counter of the space saving sketch, Error is the
+// most the count may be overestimated
+type heavyHitter struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+	index int
+}
+
+// SpaceSaving is the space saving heavy hitters sketch (Metwally et al.),
+// it tracks the top keys of a stream with a fixed number of counters. The
+// counters are kept in a min heap so the smallest one is replaced in
+// O(log n) when a new key arrives.
+type SpaceSaving struct {
+	capacity int
+	counters map[string]*heavyHitter
+	heap     heavyHitterHeap
+}
+
+func NewSpaceSaving(capacity int) *SpaceSaving {
+	return &SpaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*heavyHitter, capacity),
+		heap:     make(heavyHitterHeap, 0, capacity),
+	}
+}
+
+// Add counts one occurrence of key
+func (sketch *SpaceSaving) Add(key string) {
+	if counter, ok := sketch.counters[key]; ok {
+		counter.Count++
+		heap.Fix(&sketch.heap, counter.index)
+		return
+	}
+	if len(sketch.heap) < sketch.capacity {
+		counter := &heavyHitter{Key: key, Count: 1}
+		sketch.counters[key] = counter
+		heap.Push(&sketch.heap, counter)
+		return
+	}
+	// replace the smallest counter, the new key inherits its count as error
+	counter := sketch.heap[0]
+	delete(sketch.counters, counter.Key)
+	counter.Key = key
+	counter.Error = counter.Count
+	counter.Count++
+	sketch.counters[key] = counter
+	heap.Fix(&sketch.heap, 0)
+}
+
+// Top returns the n largest counters in descending order
+func (sketch *SpaceSaving) Top(n int) []heavyHitter {
+	result := make([]heavyHitter, 0, len(sketch.heap))
+	for _, counter := range sketch.heap {
+		result = append(result, *counter)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+type heavyHitterHeap []*heavyHitter
+
+func (h heavyHitterHeap) Len() int           { return len(h) }
+func (h heavyHitterHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h heavyHitterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *heavyHitterHeap) Push(x interface{}) {
+	counter := x.(*heavyHitter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+func (h *heavyHitterHeap) Pop() interface{} {
+	old := *h
+	counter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return counter
+}
+
+// analytics table names
+const (
+	tableTLDs            = "tlds"
+	tableNXDomainTLDs    = "nxdomain_tlds"
+	tableQTypes          = "qtypes"
+	tableClients         = "clients"
+	tableNXDomainClients = "nxdomain_clients"
+	tableChromiumClients = "chromium_probe_clients"
+)
+
+var analyticsTables = []string{
+	tableTLDs, tableNXDomainTLDs, tableQTypes, tableClients, tableNXDomainClients, tableChromiumClients,
+}
+
+// analyticsWindow holds the tables of one time window
+type analyticsWindow struct {
+	Start          time.Time `json:"start"`
+	Queries        uint64    `json:"queries"`
+	NXDomains      uint64    `json:"nxdomains"`
+	ChromiumProbes uint64    `json:"chromium_probes"`
+	Dropped        uint64    `json:"dropped"`
+	tables         map[string]*SpaceSaving
+}
+
+func newAnalyticsWindow(capacity int) *analyticsWindow {
+	window := &analyticsWindow{Start: time.Now(), tables: make(map[string]*SpaceSaving)}
+	for _, name := range analyticsTables {
+		window.tables[name] = NewSpaceSaving(capacity)
+	}
+	return window
+}
+
+// analyticsQueueSize is the number of recorded queries waiting to be counted
+const analyticsQueueSize = 10000
+
+// analyticsEvent is the part of a served query counted by the tables
+type analyticsEvent struct {
+	tld      string
+	qType    string
+	client   string
+	nxdomain bool
+	probe    bool
+}
+
+// Analytics keeps rolling top-N tables of queried tlds, nxdomain tlds,
+// query types and clients, and detects chromium style random probes. The
+// current window is rolled over into the previous one every interval.
+// Queries are queued and counted by a background goroutine so the query
+// path never waits on the tables, when the queue is full they are dropped.
+type Analytics struct {
+	sync.Mutex
+	capacity int
+	interval time.Duration
+	queue    chan analyticsEvent
+	dropped  uint64
+	current  *analyticsWindow
+	previous *analyticsWindow
+}
+
+func NewAnalytics(capacity int, interval time.Duration) *Analytics {
+	return &Analytics{
+		capacity: capacity,
+		interval: interval,
+		queue:    make(chan analyticsEvent, analyticsQueueSize),
+		current:  newAnalyticsWindow(capacity),
+	}
+}
+
+// isChromiumProbe detects the random single label names chromium sends to
+// find out nxdomain hijacking, they are 7 to 15 lowercase letters
+func isChromiumProbe(qName string) bool {
+	label := strings.TrimSuffix(qName, ".")
+	if len(label) < 7 || len(label) > 15 {
+		return false
+	}
+	for _, c := range label {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Record queues a served query to be counted
+func (analytics *Analytics) Record(event *queryEvent) {
+	if event.Rcode < 0 {
+		return
+	}
+	qName := strings.ToLower(dns.Fqdn(event.Question.Name))
+	tld := getTLDFromDomain(qName)
+	nxdomain := event.Rcode == dns.RcodeNameError
+	select {
+	case analytics.queue <- analyticsEvent{
+		tld:      tld,
+		qType:    dns.Type(event.Question.Qtype).String(),
+		client:   addrIP(event.Client).String(),
+		nxdomain: nxdomain,
+		probe:    nxdomain && tld == qName && isChromiumProbe(qName),
+	}:
+	default:
+		atomic.AddUint64(&analytics.dropped, 1)
+	}
+}
+
+// add counts event into the current window, the lock must be held
+func (analytics *Analytics) add(event analyticsEvent) {
+	window := analytics.current
+	window.Queries++
+	window.tables[tableTLDs].Add(event.tld)
+	window.tables[tableQTypes].Add(event.qType)
+	window.tables[tableClients].Add(event.client)
+	if event.nxdomain {
+		window.NXDomains++
+		window.tables[tableNXDomainTLDs].Add(event.tld)
+		window.tables[tableNXDomainClients].Add(event.client)
+	}
+	if event.probe {
+		window.ChromiumProbes++
+		window.tables[tableChromiumClients].Add(event.client)
+	}
+}
+
+// drain counts the queries already queued, the lock must be held. It stops
+// at the queue length so a busy server does not keep the lock forever.
+func (analytics *Analytics) drain() {
+	for i := len(analytics.queue); i > 0; i-- {
+		select {
+		case event := <-analytics.queue:
+			analytics.add(event)
+		default:
+			return
+		}
+	}
+}
+
+// Rotate starts a new window and logs the summary of the finished one
+func (analytics *Analytics) Rotate() {
+	analytics.Lock()
+	analytics.drain()
+	finished := analytics.current
+	finished.Dropped = atomic.SwapUint64(&analytics.dropped, 0)
+	analytics.previous = finished
+	analytics.current = newAnalyticsWindow(analytics.capacity)
+	analytics.Unlock()
+
+	log.Infof("analytics since %s: queries=%d nxdomains=%d chromium_probes=%d dropped=%d",
+		finished.Start.Format("2006-01-02 15:04:05"), finished.Queries, finished.NXDomains, finished.ChromiumProbes,
+		finished.Dropped)
+	for _, name := range analyticsTables {
+		top := finished.tables[name].Top(analyticsLogTop)
+		items := make([]string, 0, len(top))
+		for _, item := range top {
+			items = append(items, item.Key+"="+strconv.FormatUint(item.Count, 10))
+		}
+		log.Infof("analytics top %s: %s", name, strings.Join(items, " "))
+	}
+}
+
+// analyticsLogTop is the number of items logged for each table
+const analyticsLogTop = 10
+
+func (analytics *Analytics) run() {
+	ticker := time.NewTicker(analytics.interval)
+	for {
+		select {
+		case event := <-analytics.queue:
+			analytics.Lock()
+			analytics.add(event)
+			analytics.drain()
+			analytics.Unlock()
+		case <-ticker.C:
+			analytics.Rotate()
+		}
+	}
+}
+
+// AnalyticsReport is the result of the analytics api
+type AnalyticsReport struct {
+	Start          time.Time                `json:"start"`
+	Queries        uint64                   `json:"queries"`
+	NXDomains      uint64                   `json:"nxdomains"`
+	ChromiumProbes uint64                   `json:"chromium_probes"`
+	Dropped        uint64                   `json:"dropped"`
+	Tables         map[string][]heavyHitter `json:"tables"`
+}
+
+func (window *analyticsWindow) report(n int) *AnalyticsReport {
+	report := &AnalyticsReport{
+		Start:          window.Start,
+		Queries:        window.Queries,
+		NXDomains:      window.NXDomains,
+		ChromiumProbes: window.ChromiumProbes,
+		Dropped:        window.Dropped,
+		Tables:         make(map[string][]heavyHitter),
+	}
+	for name, table := range window.tables {
+		report.Tables[name] = table.Top(n)
+	}
+	return report
+}
+
+// Report returns the top n items of the current and previous window, the
+// queued queries are counted first
+func (analytics *Analytics) Report(n int) map[string]*AnalyticsReport {
+	analytics.Lock()
+	defer analytics.Unlock()
+	analytics.drain()
+	current := analytics.current.report(n)
+	current.Dropped = atomic.LoadUint64(&analytics.dropped)
+	result := map[string]*AnalyticsReport{"current": current}
+	if analytics.previous != nil {
+		result["previous"] = analytics.previous.report(n)
+	}
+	return result
+}
+
+// handleAnalytics serves /analytics?n=
+func (manager *Manager) handleAnalytics(w http.ResponseWriter, req *http.Request) {
+	if manager.analytics == nil {
+		writeJSON(w, http.StatusNotFound, jsonError{Error: "analytics is not enabled"})
+		return
+	}
+	n := 20
+	if value := req.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeJSON(w, http.StatusBadRequest, jsonError{Error: "invalid n"})
+			return
+		}
+		n = parsed
+	}
+	writeJSON(w, http.StatusOK, manager.analytics.Report(n))
+}
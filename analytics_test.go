@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	sketch := NewSpaceSaving(10)
+	for i := 0; i < 1000; i++ {
+		sketch.Add("heavy")
+		if i%2 == 0 {
+			sketch.Add("medium")
+		}
+		sketch.Add(fmt.Sprintf("noise-%d", i))
+	}
+	if len(sketch.counters) != 10 {
+		t.Errorf("expect sketch bounded to 10 counters, got %d", len(sketch.counters))
+	}
+	top := sketch.Top(2)
+	if len(top) != 2 || top[0].Key != "heavy" || top[0].Count-top[0].Error > 1000 || top[1].Key != "medium" {
+		t.Errorf("expect heavy and medium on top, got %+v", top)
+	}
+}
+
+func TestIsChromiumProbe(t *testing.T) {
+	for name, expect := range map[string]bool{
+		"qwertyuio.":        true,
+		"abcdefg.":          true,
+		"abcdef.":           false,
+		"local.":            false,
+		"abc1defgh.":        false,
+		"abcdefghijklmnop.": false,
+	} {
+		if got := isChromiumProbe(name); got != expect {
+			t.Errorf("isChromiumProbe(%s) = %v, expected %v", name, got, expect)
+		}
+	}
+}
+
+func TestAnalyticsRecord(t *testing.T) {
+	manager := newTestManager(t)
+	manager.EnableAnalytics(100, time.Hour)
+	serve := manager.handler("udp", manager.handleRequest)
+	for _, q := range []struct {
+		client string
+		name   string
+		qType  uint16
+	}{
+		{"192.0.2.1", "www.example.com.", dns.TypeA},
+		{"192.0.2.1", "printer.local.", dns.TypeA},
+		{"192.0.2.2", "nas.home.", dns.TypeAAAA},
+		{"192.0.2.2", "qwertyuiop.", dns.TypeA},
+		{"192.0.2.2", "router.home.", dns.TypeA},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(q.name, q.qType)
+		serve(&testWriter{remote: &net.UDPAddr{IP: net.ParseIP(q.client)}}, m)
+	}
+	report := manager.analytics.Report(1)["current"]
+	if report.Queries != 5 || report.NXDomains != 4 || report.ChromiumProbes != 1 {
+		t.Errorf("unexpected analytics counters %+v", report)
+	}
+	for table, expect := range map[string]string{
+		tableTLDs:            "home.",
+		tableNXDomainTLDs:    "home.",
+		tableQTypes:          "A",
+		tableNXDomainClients: "192.0.2.2",
+		tableChromiumClients: "192.0.2.2",
+	} {
+		if top := report.Tables[table]; len(top) != 1 || top[0].Key != expect {
+			t.Errorf("expect top of %s is %s, got %+v", table, expect, top)
+		}
+	}
+	manager.analytics.Rotate()
+	result := manager.analytics.Report(1)
+	if result["current"].Queries != 0 || result["previous"].Queries != 5 {
+		t.Errorf("expect rotated window, got %+v %+v", result["current"], result["previous"])
+	}
+}
+
+func TestAnalyticsDropped(t *testing.T) {
+	analytics := NewAnalytics(10, time.Hour)
+	analytics.queue = make(chan analyticsEvent, 1)
+	for i := 0; i < 3; i++ {
+		analytics.Record(&queryEvent{
+			Client:   &net.UDPAddr{IP: net.ParseIP("192.0.2.1")},
+			Question: dns.Question{Name: "com.", Qtype: dns.TypeNS},
+			Rcode:    dns.RcodeSuccess,
+		})
+	}
+	report := analytics.Report(1)["current"]
+	if report.Queries != 1 || report.Dropped != 2 {
+		t.Errorf("expect one query counted and two dropped, got %+v", report)
+	}
+	analytics.Rotate()
+	result := analytics.Report(1)
+	if result["current"].Dropped != 0 || result["previous"].Dropped != 2 {
+		t.Errorf("expect dropped counter rotated, got %+v %+v", result["current"], result["previous"])
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONQuestion and JSONRecord follow the json dns schema used by the
+// public google and cloudflare resolvers
+type JSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type JSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// JSONResponse is the result of the resolve api, AA, Serial, Generation and
+// Path are extensions describing how the local root answers the query
+type JSONResponse struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []JSONQuestion `json:"Question"`
+	Answer     []JSONRecord   `json:"Answer,omitempty"`
+	Authority  []JSONRecord   `json:"Authority,omitempty"`
+	Additional []JSONRecord   `json:"Additional,omitempty"`
+	AA         bool           `json:"AA"`
+	Serial     uint32         `json:"Serial"`
+	Generation uint64         `json:"Generation"`
+	Path       string         `json:"Path"`
+}
+
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+func toJSONRecords(rrs []dns.RR) []JSONRecord {
+	records := make([]JSONRecord, 0, len(rrs))
+	for _, rr := range rrs {
+		header := rr.Header()
+		records = append(records, JSONRecord{
+			Name: header.Name,
+			Type: header.Rrtype,
+			TTL:  header.Ttl,
+			Data: strings.TrimPrefix(rr.String(), header.String()),
+		})
+	}
+	return records
+}
+
+// parseQueryType accepts a type mnemonic like AAAA or a type number
+func parseQueryType(value string) (uint16, bool) {
+	if value == "" {
+		return dns.TypeA, true
+	}
+	if qType, ok := dns.StringToType[strings.ToUpper(value)]; ok {
+		return qType, true
+	}
+	number, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(number), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// ServeAPI enables the http api at listenAt
+func (manager *Manager) ServeAPI(listenAt string) {
+	manager.apiListen = listenAt
+}
+
+func (manager *Manager) runAPI() error {
+	server := &http.Server{
+		Addr:         manager.apiListen,
+		Handler:      manager.apiHandler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	log.Infof("start http api server at : %s", manager.apiListen)
+	return server.ListenAndServe()
+}
+
+func (manager *Manager) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resolve", manager.handleResolve)
+	mux.HandleFunc("/stats", manager.handleStats)
+	mux.HandleFunc("/acl", manager.handleACL)
+	mux.HandleFunc("/analytics", manager.handleAnalytics)
+	mux.HandleFunc("/trust-anchors", manager.handleTrustAnchors)
+	mux.HandleFunc("/archive", manager.handleArchive)
+	mux.HandleFunc("/archive/diff", manager.handleArchiveDiff)
+	mux.HandleFunc("/archive/pin", manager.handleArchivePin)
+	mux.HandleFunc("/archive/release", manager.handleArchiveRelease)
+	return manager.adminACL(mux)
+}
+
+// handleResolve answers /resolve?name=&type=&do= from the zone store
+func (manager *Manager) handleResolve(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	name := params.Get("name")
+	if name == "" {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "name is required"})
+		return
+	}
+	if _, ok := dns.IsDomainName(name); ok == false {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "invalid name"})
+		return
+	}
+	qType, ok := parseQueryType(params.Get("type"))
+	if ok == false {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "invalid type"})
+		return
+	}
+	do := false
+	switch strings.ToLower(params.Get("do")) {
+	case "1", "true":
+		do = true
+	}
+	name = dns.Fqdn(name)
+
+	snapshot := manager.snapshot()
+	response := JSONResponse{Question: []JSONQuestion{{Name: name, Type: qType}}}
+	if snapshot == nil || snapshot.expired(time.Now()) {
+		response.Status = dns.RcodeServerFailure
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+	result := snapshot.store.Lookup(name, qType, do)
+	response.Status = result.Rcode
+	response.Answer = toJSONRecords(result.Answer)
+	response.Authority = toJSONRecords(result.Ns)
+	response.Additional = toJSONRecords(result.Additional)
+	response.AA = result.AA
+	response.Serial = snapshot.store.Serial()
+	response.Generation = snapshot.generation
+	response.Path = result.Path
+	writeJSON(w, http.StatusOK, response)
+}
+
+// StatsResponse is the result of the stats api
+type StatsResponse struct {
+	Transports map[string]TransportStats `json:"transports"`
+	RRL        *RRLStats                 `json:"rrl,omitempty"`
+	Dnstap     *DnstapStats              `json:"dnstap,omitempty"`
+	// TrustAnchors counts clients by the trust anchor key tags they signal
+	TrustAnchors map[string]int `json:"trust_anchors"`
+	Zone         *ZoneStats     `json:"zone,omitempty"`
+	Sockets      []SocketStats  `json:"sockets"`
+}
+
+func (manager *Manager) handleStats(w http.ResponseWriter, req *http.Request) {
+	response := StatsResponse{
+		Transports:   manager.stats.Snapshot(),
+		Sockets:      manager.stats.Sockets(),
+		TrustAnchors: manager.trustAnchors.Report(false).KeyTagSets,
+	}
+	if manager.rrl != nil {
+		rrlStats := manager.rrl.Stats()
+		response.RRL = &rrlStats
+	}
+	if manager.tap != nil {
+		tapStats := manager.tap.Stats()
+		response.Dnstap = &tapStats
+	}
+	if snapshot := manager.snapshot(); snapshot != nil {
+		response.Zone = snapshot.stats()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (manager *Manager) handleACL(w http.ResponseWriter, req *http.Request) {
+	if manager.acl == nil {
+		writeJSON(w, http.StatusNotFound, jsonError{Error: "acl is not enabled"})
+		return
+	}
+	writeJSON(w, http.StatusOK, manager.acl.Snapshot())
+}
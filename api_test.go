@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveAPI(t *testing.T) {
+	manager := newTestManager(t)
+	server := httptest.NewServer(manager.apiHandler())
+	defer server.Close()
+
+	for _, c := range []struct {
+		query  string
+		status int
+		rcode  int
+		path   string
+	}{
+		{"name=.&type=SOA", http.StatusOK, dns.RcodeSuccess, LookupApex},
+		{"name=www.example.com&type=28", http.StatusOK, dns.RcodeSuccess, LookupReferral},
+		{"name=xyz.&do=1", http.StatusOK, dns.RcodeNameError, LookupNXDomain},
+		{"type=A", http.StatusBadRequest, 0, ""},
+		{"name=com.&type=NOTATYPE", http.StatusBadRequest, 0, ""},
+	} {
+		resp, err := http.Get(server.URL + "/resolve?" + c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result JSONResponse
+		json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: expect http status %d, got %d", c.query, c.status, resp.StatusCode)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		if result.Status != c.rcode || result.Path != c.path || result.Serial != 2020081000 {
+			t.Errorf("%s: expect rcode %d path %s serial 2020081000, got %+v", c.query, c.rcode, c.path, result)
+		}
+	}
+}
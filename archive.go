@@ -0,0 +1,578 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// archive file names, the pinned file holds the serial served instead of
+// the latest zone so a pin survives a restart
+const (
+	archivePrefix  = "root.zone."
+	archiveSuffix  = ".gz"
+	archivePinFile = "pinned"
+)
+
+// ZoneArchive keeps the last accepted zones in a directory, each gzip
+// compressed in a file named by its serial
+type ZoneArchive struct {
+	dir  string
+	keep int
+	lock sync.Mutex
+}
+
+// ArchivedZone describes a zone of the archive, accepted is the time it
+// was archived
+type ArchivedZone struct {
+	Serial   uint32    `json:"serial"`
+	Accepted time.Time `json:"accepted"`
+	Size     int64     `json:"size"`
+	Pinned   bool      `json:"pinned,omitempty"`
+}
+
+// NewZoneArchive opens the archive in dir keeping the last keep zones
+func NewZoneArchive(dir string, keep int) (*ZoneArchive, error) {
+	if keep <= 0 {
+		return nil, errors.New("zone archive should keep at least one zone")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &ZoneArchive{dir: dir, keep: keep}, nil
+}
+
+func (archive *ZoneArchive) filename(serial uint32) string {
+	return filepath.Join(archive.dir, archivePrefix+strconv.FormatUint(uint64(serial), 10)+archiveSuffix)
+}
+
+// Add archives store unless its serial is archived already and removes the
+// oldest zones over the limit, the pinned zone is never removed
+func (archive *ZoneArchive) Add(store *ZoneStore) error {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	filename := archive.filename(store.Serial())
+	if fileExists(filename) {
+		return nil
+	}
+	temp := filename + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(file)
+	err = store.write(writer)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp, filename)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	zones, err := archive.list()
+	if err != nil {
+		return err
+	}
+	for i, zone := range zones {
+		if i >= archive.keep && zone.Pinned == false {
+			os.Remove(archive.filename(zone.Serial))
+		}
+	}
+	return nil
+}
+
+// List returns the archived zones, the latest accepted first
+func (archive *ZoneArchive) List() ([]ArchivedZone, error) {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	return archive.list()
+}
+
+func (archive *ZoneArchive) list() ([]ArchivedZone, error) {
+	entries, err := ioutil.ReadDir(archive.dir)
+	if err != nil {
+		return nil, err
+	}
+	pinned, ok, err := archive.pinned()
+	if err != nil {
+		return nil, err
+	}
+	zones := make([]ArchivedZone, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, archivePrefix) == false || strings.HasSuffix(name, archiveSuffix) == false {
+			continue
+		}
+		serial, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, archivePrefix), archiveSuffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		zones = append(zones, ArchivedZone{
+			Serial:   uint32(serial),
+			Accepted: entry.ModTime(),
+			Size:     entry.Size(),
+			Pinned:   ok && pinned == uint32(serial),
+		})
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		if zones[i].Accepted.Equal(zones[j].Accepted) {
+			return zones[i].Serial > zones[j].Serial
+		}
+		return zones[i].Accepted.After(zones[j].Accepted)
+	})
+	return zones, nil
+}
+
+// Load returns the zone store of the archived serial
+func (archive *ZoneArchive) Load(serial uint32) (*ZoneStore, error) {
+	file, err := os.Open(archive.filename(serial))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("zone serial %d is not archived", serial)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	return newZoneStoreFromReader(reader)
+}
+
+// pinned returns the pinned serial, ok is false when no serial is pinned
+func (archive *ZoneArchive) pinned() (serial uint32, ok bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(archive.dir, archivePinFile))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid pinned serial: %s", err)
+	}
+	return uint32(value), true, nil
+}
+
+// Pinned returns the pinned serial, ok is false when no serial is pinned
+func (archive *ZoneArchive) Pinned() (serial uint32, ok bool, err error) {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	return archive.pinned()
+}
+
+// Pin records serial as pinned, it must be archived
+func (archive *ZoneArchive) Pin(serial uint32) error {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	if fileExists(archive.filename(serial)) == false {
+		return fmt.Errorf("zone serial %d is not archived", serial)
+	}
+	return ioutil.WriteFile(filepath.Join(archive.dir, archivePinFile), []byte(strconv.FormatUint(uint64(serial), 10)+"\n"), 0644)
+}
+
+// Release removes the pin
+func (archive *ZoneArchive) Release() error {
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+	err := os.Remove(filepath.Join(archive.dir, archivePinFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ZoneDiff lists the tlds and records of zone To missing in zone From as
+// added and those of From missing in To as removed
+type ZoneDiff struct {
+	From           uint32   `json:"from"`
+	To             uint32   `json:"to"`
+	TLDsAdded      []string `json:"tlds_added"`
+	TLDsRemoved    []string `json:"tlds_removed"`
+	RecordsAdded   []string `json:"records_added"`
+	RecordsRemoved []string `json:"records_removed"`
+}
+
+// DiffZones compares two zones, records in canonical order
+func DiffZones(from *ZoneStore, to *ZoneStore) (*ZoneDiff, error) {
+	diff := &ZoneDiff{From: from.Serial(), To: to.Serial()}
+	diff.TLDsRemoved, diff.TLDsAdded = diffStrings(from.TLDs(), to.TLDs())
+	fromRecords, err := zoneRecords(from)
+	if err != nil {
+		return nil, err
+	}
+	toRecords, err := zoneRecords(to)
+	if err != nil {
+		return nil, err
+	}
+	diff.RecordsRemoved, diff.RecordsAdded = diffStrings(fromRecords, toRecords)
+	return diff, nil
+}
+
+// zoneRecords returns the records of store in presentation format
+func zoneRecords(store *ZoneStore) ([]string, error) {
+	records := make([]string, 0)
+	err := store.Walk(func(rrs []dns.RR) error {
+		for _, rr := range rrs {
+			records = append(records, rr.String())
+		}
+		return nil
+	})
+	return records, err
+}
+
+// diffStrings returns the strings only in a and those only in b in their
+// order
+func diffStrings(a []string, b []string) (onlyA []string, onlyB []string) {
+	inA := make(map[string]bool, len(a))
+	for _, value := range a {
+		inA[value] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, value := range b {
+		inB[value] = true
+	}
+	onlyA, onlyB = make([]string, 0), make([]string, 0)
+	for _, value := range a {
+		if inB[value] == false {
+			onlyA = append(onlyA, value)
+		}
+	}
+	for _, value := range b {
+		if inA[value] == false {
+			onlyB = append(onlyB, value)
+		}
+	}
+	return onlyA, onlyB
+}
+
+// EnableArchive keeps the last keep accepted zones in dir, a serial pinned
+// before a restart is served again right away
+func (manager *Manager) EnableArchive(dir string, keep int) error {
+	archive, err := NewZoneArchive(dir, keep)
+	if err != nil {
+		return err
+	}
+	manager.archive = archive
+	serial, ok, err := archive.Pinned()
+	if err != nil {
+		return err
+	}
+	if ok == true {
+		return manager.Pin(serial)
+	}
+	return nil
+}
+
+// archiveZone adds an accepted zone to the archive
+func (manager *Manager) archiveZone(data *ZoneStore) {
+	if manager.archive == nil {
+		return
+	}
+	if err := manager.archive.Add(data); err != nil {
+		log.Warnf("archive zone serial %d fail: %s", data.Serial(), err)
+	}
+}
+
+// setSyncedZone publishes a synced zone unless an archived serial is pinned,
+// the pinned zone is then published again with the sync time so it is not
+// reported stale while syncs succeed
+func (manager *Manager) setSyncedZone(data *ZoneStore, loaded time.Time) {
+	manager.pinLock.Lock()
+	defer manager.pinLock.Unlock()
+	manager.synced = loaded
+	if snapshot := manager.snapshot(); snapshot != nil && snapshot.pinned {
+		log.Warnf("zone is pinned to serial %d, synced serial %d is only archived", snapshot.store.Serial(), data.Serial())
+		refreshed := *snapshot
+		refreshed.loaded = loaded
+		manager.publish(&refreshed)
+		return
+	}
+	manager.setZone(data, loaded)
+}
+
+// Pin serves the archived zone serial instead of the synced zones until
+// the pin is released
+func (manager *Manager) Pin(serial uint32) error {
+	if manager.archive == nil {
+		return errors.New("zone archive is not enabled")
+	}
+	data, err := manager.archive.Load(serial)
+	if err != nil {
+		return err
+	}
+	manager.pinLock.Lock()
+	defer manager.pinLock.Unlock()
+	if err := manager.archive.Pin(serial); err != nil {
+		return err
+	}
+	snapshot := manager.newSnapshot(data, time.Now())
+	snapshot.pinned = true
+	manager.publish(snapshot)
+	log.Warnf("zone is pinned to archived serial %d", serial)
+	return nil
+}
+
+// Release removes the pin and serves the latest archived zone again
+func (manager *Manager) Release() error {
+	if manager.archive == nil {
+		return errors.New("zone archive is not enabled")
+	}
+	manager.pinLock.Lock()
+	defer manager.pinLock.Unlock()
+	if snapshot := manager.snapshot(); snapshot == nil || snapshot.pinned == false {
+		return errors.New("zone is not pinned")
+	}
+	zones, err := manager.archive.List()
+	if err != nil {
+		return err
+	}
+	if len(zones) == 0 {
+		return errors.New("zone archive is empty")
+	}
+	data, err := manager.archive.Load(zones[0].Serial)
+	if err != nil {
+		return err
+	}
+	if err := manager.archive.Release(); err != nil {
+		return err
+	}
+	// the released zone is as fresh as the last sync
+	loaded := manager.synced
+	if loaded.IsZero() {
+		loaded = zones[0].Accepted
+	}
+	manager.setZone(data, loaded)
+	log.Warnf("zone pin is released, serving latest archived serial %d", data.Serial())
+	return nil
+}
+
+// ArchiveResponse is the result of the archive api
+type ArchiveResponse struct {
+	Zones []ArchivedZone `json:"zones"`
+}
+
+// handleArchive serves /archive listing the archived zones
+func (manager *Manager) handleArchive(w http.ResponseWriter, req *http.Request) {
+	if manager.archive == nil {
+		writeJSON(w, http.StatusNotFound, jsonError{Error: "zone archive is not enabled"})
+		return
+	}
+	zones, err := manager.archive.List()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, jsonError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, ArchiveResponse{Zones: zones})
+}
+
+// handleArchiveDiff serves /archive/diff?from=&to= comparing two archived
+// serials
+func (manager *Manager) handleArchiveDiff(w http.ResponseWriter, req *http.Request) {
+	if manager.archive == nil {
+		writeJSON(w, http.StatusNotFound, jsonError{Error: "zone archive is not enabled"})
+		return
+	}
+	params := req.URL.Query()
+	from, err := strconv.ParseUint(params.Get("from"), 10, 32)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "invalid from serial"})
+		return
+	}
+	to, err := strconv.ParseUint(params.Get("to"), 10, 32)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "invalid to serial"})
+		return
+	}
+	diff, err := diffArchived(manager.archive, uint32(from), uint32(to))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, jsonError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// handleArchivePin serves POST /archive/pin?serial= pinning the server to
+// an archived serial
+func (manager *Manager) handleArchivePin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, jsonError{Error: "method not allowed"})
+		return
+	}
+	serial, err := strconv.ParseUint(req.URL.Query().Get("serial"), 10, 32)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, jsonError{Error: "invalid serial"})
+		return
+	}
+	if err := manager.Pin(uint32(serial)); err != nil {
+		writeJSON(w, http.StatusConflict, jsonError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, manager.snapshot().stats())
+}
+
+// handleArchiveRelease serves POST /archive/release
+func (manager *Manager) handleArchiveRelease(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, jsonError{Error: "method not allowed"})
+		return
+	}
+	if err := manager.Release(); err != nil {
+		writeJSON(w, http.StatusConflict, jsonError{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, manager.snapshot().stats())
+}
+
+// diffArchived compares the archived serials from and to
+func diffArchived(archive *ZoneArchive, from uint32, to uint32) (*ZoneDiff, error) {
+	fromZone, err := archive.Load(from)
+	if err != nil {
+		return nil, err
+	}
+	toZone, err := archive.Load(to)
+	if err != nil {
+		return nil, err
+	}
+	return DiffZones(fromZone, toZone)
+}
+
+// runArchive runs the archive subcommand. list and diff read the archive
+// directory, pin and release ask the running server through its http api.
+func runArchive(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dir := flags.String("dir", "archive", "zone archive directory")
+	api := flags.String("api", "127.0.0.1:8053", "http api address of the running server for pin and release")
+	flags.Usage = func() {
+		fmt.Fprintln(out, "usage: rootdns archive [flags] list | diff FROM TO | pin SERIAL | release")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	command := flags.Args()
+	if len(command) == 0 {
+		flags.Usage()
+		return 2
+	}
+	switch {
+	case command[0] == "list" && len(command) == 1:
+		archive := &ZoneArchive{dir: *dir}
+		zones, err := archive.List()
+		if err != nil {
+			fmt.Fprintf(out, "list zone archive fail: %s\n", err)
+			return 1
+		}
+		writer := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(writer, "serial\taccepted\tsize\t")
+		for _, zone := range zones {
+			pinned := ""
+			if zone.Pinned {
+				pinned = "pinned"
+			}
+			fmt.Fprintf(writer, "%d\t%s\t%d\t%s\n", zone.Serial, zone.Accepted.Format(time.RFC3339), zone.Size, pinned)
+		}
+		writer.Flush()
+		return 0
+	case command[0] == "diff" && len(command) == 3:
+		from, fromErr := strconv.ParseUint(command[1], 10, 32)
+		to, toErr := strconv.ParseUint(command[2], 10, 32)
+		if fromErr != nil || toErr != nil {
+			fmt.Fprintln(out, "diff needs two serials")
+			return 2
+		}
+		diff, err := diffArchived(&ZoneArchive{dir: *dir}, uint32(from), uint32(to))
+		if err != nil {
+			fmt.Fprintf(out, "diff zone archive fail: %s\n", err)
+			return 1
+		}
+		writeZoneDiff(out, diff)
+		return 0
+	case command[0] == "pin" && len(command) == 2:
+		if _, err := strconv.ParseUint(command[1], 10, 32); err != nil {
+			fmt.Fprintln(out, "pin needs a serial")
+			return 2
+		}
+		return postArchive(out, "http://"+*api+"/archive/pin?serial="+command[1])
+	case command[0] == "release" && len(command) == 1:
+		return postArchive(out, "http://"+*api+"/archive/release")
+	}
+	flags.Usage()
+	return 2
+}
+
+// writeZoneDiff prints the added tlds and records with + and the removed
+// ones with -
+func writeZoneDiff(out io.Writer, diff *ZoneDiff) {
+	fmt.Fprintf(out, "serial %d to %d\n", diff.From, diff.To)
+	for _, tld := range diff.TLDsAdded {
+		fmt.Fprintf(out, "+tld %s\n", tld)
+	}
+	for _, tld := range diff.TLDsRemoved {
+		fmt.Fprintf(out, "-tld %s\n", tld)
+	}
+	for _, record := range diff.RecordsAdded {
+		fmt.Fprintf(out, "+%s\n", record)
+	}
+	for _, record := range diff.RecordsRemoved {
+		fmt.Fprintf(out, "-%s\n", record)
+	}
+	fmt.Fprintf(out, "tlds: %d added, %d removed\n", len(diff.TLDsAdded), len(diff.TLDsRemoved))
+	fmt.Fprintf(out, "records: %d added, %d removed\n", len(diff.RecordsAdded), len(diff.RecordsRemoved))
+}
+
+// postArchive posts a pin or release to the server and prints the zone it
+// serves now
+func postArchive(out io.Writer, url string) int {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "", nil)
+	if err != nil {
+		fmt.Fprintf(out, "request server fail: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		result := jsonError{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		fmt.Fprintf(out, "server refused: %s\n", result.Error)
+		return 1
+	}
+	stats := ZoneStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		fmt.Fprintf(out, "decode server response fail: %s\n", err)
+		return 1
+	}
+	state := "serving latest"
+	if stats.Pinned {
+		state = "pinned to"
+	}
+	fmt.Fprintf(out, "server is %s serial %d\n", state, stats.Serial)
+	return 0
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testArchiveZone returns the test zone with serial, extra records are added
+func testArchiveZone(t *testing.T, serial uint32, records ...string) *ZoneStore {
+	rrs := testZoneRRs(t)
+	rrs[0].(*dns.SOA).Serial = serial
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return NewZoneStoreFromRRSet(rrs)
+}
+
+// addArchiveZones archives the zones, accepted a minute apart in the order
+// of their serials
+func addArchiveZones(t *testing.T, archive *ZoneArchive, zones ...*ZoneStore) {
+	base := time.Now().Add(-time.Hour)
+	for _, zone := range zones {
+		if err := archive.Add(zone); err != nil {
+			t.Fatal(err)
+		}
+		accepted := base.Add(time.Duration(zone.Serial()) * time.Minute)
+		os.Chtimes(archive.filename(zone.Serial()), accepted, accepted)
+	}
+}
+
+func TestZoneArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive, err := NewZoneArchive(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addArchiveZones(t, archive, testArchiveZone(t, 1), testArchiveZone(t, 2))
+	if err := archive.Pin(1); err != nil {
+		t.Fatal(err)
+	}
+	addArchiveZones(t, archive, testArchiveZone(t, 3, "org. 172800 IN NS a0.org.afilias-nst.info."), testArchiveZone(t, 4))
+	zones, err := archive.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serials := make([]uint32, 0)
+	for _, zone := range zones {
+		serials = append(serials, zone.Serial)
+	}
+	// serial 2 is pruned, the pinned serial 1 is kept
+	if len(zones) != 3 || serials[0] != 4 || serials[1] != 3 || serials[2] != 1 || zones[2].Pinned == false {
+		t.Errorf("expect archive keep serials 4, 3 and the pinned 1 but got %+v", zones)
+	}
+	if _, err := archive.Load(2); err == nil || err.Error() != "zone serial 2 is not archived" {
+		t.Errorf("expect pruned serial not archived but got %v", err)
+	}
+	loaded, err := archive.Load(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Serial() != 3 || len(loaded.Lookup("www.org.", dns.TypeA, false).Ns) != 1 {
+		t.Errorf("expect archived serial 3 delegates org. but got serial %d", loaded.Serial())
+	}
+
+	diff, err := diffArchived(archive, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(diff.TLDsAdded, ",") != "org." || len(diff.TLDsRemoved) != 0 ||
+		len(diff.RecordsAdded) != 2 || strings.Contains(diff.RecordsAdded[0], "2020081000") == true ||
+		strings.Contains(diff.RecordsAdded[1], "a0.org.afilias-nst.info.") == false ||
+		len(diff.RecordsRemoved) != 1 || strings.Contains(diff.RecordsRemoved[0], "SOA") == false {
+		t.Errorf("expect diff of serial 1 to 3 add org. and change the soa but got %+v", diff)
+	}
+	reverse, err := diffArchived(archive, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(reverse.TLDsRemoved, ",") != "org." || len(reverse.RecordsRemoved) != 2 {
+		t.Errorf("expect diff of serial 3 to 1 remove org. but got %+v", reverse)
+	}
+}
+
+func TestArchivePin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager(t)
+	if err := manager.Pin(1); err == nil {
+		t.Error("expect pin fail without archive")
+	}
+	if err := manager.EnableArchive(dir, 5); err != nil {
+		t.Fatal(err)
+	}
+	for _, serial := range []uint32{1, 2} {
+		zone := testArchiveZone(t, serial)
+		manager.archiveZone(zone)
+		manager.setSyncedZone(zone, time.Now())
+	}
+	if err := manager.Release(); err == nil || err.Error() != "zone is not pinned" {
+		t.Errorf("expect release fail when not pinned but got %v", err)
+	}
+	if err := manager.Pin(7); err == nil {
+		t.Error("expect pin of serial not archived fail")
+	}
+	if err := manager.Pin(1); err != nil {
+		t.Fatal(err)
+	}
+	synced := testArchiveZone(t, 3)
+	manager.archiveZone(synced)
+	manager.setSyncedZone(synced, time.Now())
+	if stats := manager.snapshot().stats(); stats.Serial != 1 || stats.Pinned == false {
+		t.Errorf("expect synced zone not replace the pinned serial 1 but got %+v", stats)
+	}
+
+	// the pin is restored after a restart
+	restarted := newTestManager(t)
+	if err := restarted.EnableArchive(dir, 5); err != nil {
+		t.Fatal(err)
+	}
+	restarted.setSyncedZone(testArchiveZone(t, 3), time.Now())
+	if stats := restarted.snapshot().stats(); stats.Serial != 1 || stats.Pinned == false {
+		t.Errorf("expect pin restored after restart but got %+v", stats)
+	}
+	if err := restarted.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := restarted.snapshot().stats(); stats.Serial != 3 || stats.Pinned == true {
+		t.Errorf("expect release serve the latest serial 3 but got %+v", stats)
+	}
+	if _, ok, _ := restarted.archive.Pinned(); ok == true {
+		t.Error("expect release remove the pin from the archive")
+	}
+}
+
+func TestArchivePinStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager(t)
+	manager.syncDuration = time.Minute
+	if err := manager.EnableArchive(dir, 5); err != nil {
+		t.Fatal(err)
+	}
+	addArchiveZones(t, manager.archive, testArchiveZone(t, 1))
+	if err := manager.Pin(1); err != nil {
+		t.Fatal(err)
+	}
+	// the test zone refresh is 1800 seconds
+	later := time.Now().Add(time.Hour)
+	if manager.zoneStale(manager.snapshot(), later) == false {
+		t.Error("expect pinned zone stale without sync")
+	}
+	generation := manager.snapshot().generation
+	manager.setSyncedZone(testArchiveZone(t, 1), later)
+	snapshot := manager.snapshot()
+	if snapshot.pinned == false || snapshot.generation == generation || manager.zoneStale(snapshot, later.Add(time.Minute)) == true {
+		t.Errorf("expect pinned zone not stale after a successful sync but got %+v", snapshot.stats())
+	}
+
+	// releasing serves the latest zone as fresh as the last sync
+	if err := manager.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := manager.snapshot().loaded; loaded.Equal(later) == false {
+		t.Errorf("expect released zone loaded at the last sync %s but got %s", later, loaded)
+	}
+}
+
+func TestArchivePinTrustAnchor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive, err := NewZoneArchive(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pinned zone is signed by a key not in the root trust anchor
+	signed := NewZoneStoreFromRRSet(signTestZone(t, time.Now().Add(-time.Hour)))
+	addArchiveZones(t, archive, signed)
+	if err := archive.Pin(signed.Serial()); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestManager(t)
+	if err := restarted.EnableTrustAnchor(""); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.EnableArchive(dir, 5); err != nil {
+		t.Fatal(err)
+	}
+	if stats := restarted.snapshot().stats(); stats.Pinned == false || stats.Bogus != "no dnskey matches the trust anchor" {
+		t.Errorf("expect restored pin validated against the trust anchor but got %+v", stats)
+	}
+}
+
+func TestArchiveAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager(t)
+	server := httptest.NewServer(manager.apiHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expect archive api not found when disabled but got %d", resp.StatusCode)
+	}
+
+	if err := manager.EnableArchive(filepath.Join(dir, "archive"), 5); err != nil {
+		t.Fatal(err)
+	}
+	addArchiveZones(t, manager.archive, testArchiveZone(t, 1), testArchiveZone(t, 2, "org. 172800 IN NS a0.org.afilias-nst.info."))
+	manager.setSyncedZone(testArchiveZone(t, 2), time.Now())
+
+	resp, err = http.Get(server.URL + "/archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := ArchiveResponse{}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Zones) != 2 || list.Zones[0].Serial != 2 {
+		t.Errorf("expect archive api list serials 2 and 1 but got %+v", list)
+	}
+	for _, c := range []struct {
+		query  string
+		status int
+	}{
+		{"from=1&to=2", http.StatusOK},
+		{"from=1", http.StatusBadRequest},
+		{"from=1&to=9", http.StatusNotFound},
+	} {
+		resp, err := http.Get(server.URL + "/archive/diff?" + c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff := ZoneDiff{}
+		json.NewDecoder(resp.Body).Decode(&diff)
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: expect status %d but got %d", c.query, c.status, resp.StatusCode)
+		}
+		if c.status == http.StatusOK && strings.Join(diff.TLDsAdded, ",") != "org." {
+			t.Errorf("%s: expect org. added but got %+v", c.query, diff)
+		}
+	}
+	resp, err = http.Get(server.URL + "/archive/pin?serial=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expect pin need post but got %d", resp.StatusCode)
+	}
+
+	// the cli talks to the same api
+	api := strings.TrimPrefix(server.URL, "http://")
+	out := new(bytes.Buffer)
+	if code := runArchive([]string{"-api", api, "pin", "1"}, out); code != 0 || out.String() != "server is pinned to serial 1\n" {
+		t.Errorf("expect cli pin serial 1 but got %d: %s", code, out)
+	}
+	if manager.snapshot().store.Serial() != 1 {
+		t.Errorf("expect server serve pinned serial 1 but got %d", manager.snapshot().store.Serial())
+	}
+	out.Reset()
+	if code := runArchive([]string{"-dir", filepath.Join(dir, "archive"), "list"}, out); code != 0 || strings.Contains(out.String(), "pinned") == false {
+		t.Errorf("expect cli list mark pinned serial but got %d: %s", code, out)
+	}
+	out.Reset()
+	if code := runArchive([]string{"-dir", filepath.Join(dir, "archive"), "diff", "1", "2"}, out); code != 0 ||
+		strings.Contains(out.String(), "+tld org.\n") == false || strings.Contains(out.String(), "tlds: 1 added, 0 removed\n") == false {
+		t.Errorf("expect cli diff add org. but got %d: %s", code, out)
+	}
+	out.Reset()
+	if code := runArchive([]string{"-api", api, "release"}, out); code != 0 || out.String() != "server is serving latest serial 2\n" {
+		t.Errorf("expect cli release serve serial 2 but got %d: %s", code, out)
+	}
+	out.Reset()
+	if code := runArchive([]string{"-api", api, "release"}, out); code != 1 || out.String() != "server refused: zone is not pinned\n" {
+		t.Errorf("expect second release refused but got %d: %s", code, out)
+	}
+	if code := runArchive([]string{"diff", "1"}, new(bytes.Buffer)); code != 2 {
+		t.Errorf("expect diff with one serial fail with 2 but got %d", code)
+	}
+}
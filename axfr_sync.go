@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/go-playground/validator/v10"
-	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
 )
 
 type ZoneSynchronizer interface {
-	Download() (*ZoneStore, error)
+	Download(ctx context.Context) (*ZoneStore, error)
+	SetLimits(limits SyncLimits)
 	SyncToFile(data *ZoneStore) error
 	SyncFromFile() (*ZoneStore, error)
 }
@@ -16,17 +18,29 @@ type ZoneSynchronizer interface {
 type AxfrSynchronizer struct {
 	filename    string   `validate:"required"`
 	axfrServers []string `validate:"required,hostname_port"`
+	xot         *XoTConfig
+	limits      SyncLimits
 }
 
-func NewAXFRSynchronizer(filename string, server string) (*AxfrSynchronizer, error) {
+// NewAXFRSynchronizer creates a axfr synchronizer, when xot is not nil the
+// transfer runs over tls and only the prefer server is used because the
+// public root servers do not offer XoT
+func NewAXFRSynchronizer(filename string, server string, xot *XoTConfig) (*AxfrSynchronizer, error) {
 	var validate = validator.New()
 	axfrServer := DefaultAXFRRootList
-	if server != "" {
+	if xot != nil {
+		if server == "" {
+			return nil, errors.New("zone transfer over tls need a prefer server")
+		}
+		axfrServer = []string{server}
+	} else if server != "" {
 		axfrServer = append([]string{server}, DefaultAXFRRootList...)
 	}
 	synchronizer := &AxfrSynchronizer{
 		filename:    filename,
 		axfrServers: axfrServer,
+		xot:         xot,
+		limits:      DefaultSyncLimits,
 	}
 	err := validate.Struct(synchronizer)
 	if err != nil {
@@ -35,34 +49,40 @@ func NewAXFRSynchronizer(filename string, server string) (*AxfrSynchronizer, err
 	return synchronizer, nil
 }
 
-func (synchronizer *AxfrSynchronizer) Download() (*ZoneStore, error) {
+// SetLimits bounds the records and bytes of a transfer
+func (synchronizer *AxfrSynchronizer) SetLimits(limits SyncLimits) {
+	synchronizer.limits = limits
+}
+
+func (synchronizer *AxfrSynchronizer) Download(ctx context.Context) (*ZoneStore, error) {
 	for _, server := range synchronizer.axfrServers {
 		log.Debugf("start axfr from server: %s", server)
-		data, err := queryAXFR(".", server)
+		var tlsConfig *tls.Config
+		if synchronizer.xot != nil {
+			config, err := synchronizer.xot.TLSConfig(server)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig = config
+		}
+		zoneStore, err := queryAXFR(ctx, ".", server, tlsConfig, synchronizer.limits)
 		if err != nil {
 			log.Errorf("send axfr to server : %s error : %s", server, err)
-			continue
-		}
-		rrs := make([]dns.RR, 0)
-		for _, envelope := range data {
-			for _, rr := range envelope.RR {
-				rrs = append(rrs, rr)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
 			}
+			continue
 		}
 		log.Debugf("axfr transfer from server: %s success", server)
-		zoneStore := NewZoneStoreFromRRSet(rrs)
-		if zoneStore == nil {
-			return nil, errors.New("zone store not create success")
-		}
 		return zoneStore, nil
 	}
 	return nil, errors.New("send axfr request to all servers failed")
 }
 
 func (synchronizer *AxfrSynchronizer) SyncToFile(store *ZoneStore) error {
-	return store.ToFile(synchronizer.filename)
+	return writeZoneFiles(store, synchronizer.filename)
 }
 
 func (synchronizer *AxfrSynchronizer) SyncFromFile() (*ZoneStore, error) {
-	return NewZoneStoreFromFile(synchronizer.filename)
+	return readZoneFiles(synchronizer.filename)
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// benchQTypes are the query types of generated queries, repeated by weight
+var benchQTypes = []uint16{
+	dns.TypeA, dns.TypeA, dns.TypeA, dns.TypeA, dns.TypeAAAA, dns.TypeAAAA, dns.TypeAAAA,
+	dns.TypeNS, dns.TypeDS, dns.TypeMX,
+}
+
+// BenchConfig holds the arguments of the bench subcommand, queries are
+// replayed from Pcap or QueryLog if set and generated from the tlds of
+// ZoneFile otherwise
+type BenchConfig struct {
+	Load          LoadConfig
+	ZoneFile      string
+	QueryLog      string
+	Pcap          string
+	Queries       int
+	NXDomainRatio float64
+	DORatio       float64
+	Seed          int64
+}
+
+// runBench runs the bench subcommand with its arguments and writes the
+// report to out, it returns the exit code
+func runBench(args []string, out io.Writer) int {
+	config := BenchConfig{}
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&config.Load.Address, "server", "127.0.0.1:53", "address of the dns server under test")
+	flags.StringVar(&config.Load.Transport, "transport", "udp", "send queries over udp or tcp")
+	flags.IntVar(&config.Load.Rate, "rate", 0, "target queries per second of all workers, 0 as fast as possible")
+	flags.DurationVar(&config.Load.Duration, "duration", 10*time.Second, "stop sending after this duration, 0 disable")
+	flags.IntVar(&config.Load.Count, "count", 0, "stop after sending this number of queries, 0 disable")
+	flags.IntVar(&config.Load.Workers, "workers", 4, "number of udp sockets or tcp connections")
+	flags.IntVar(&config.Load.Window, "window", 64, "queries in flight per worker")
+	flags.DurationVar(&config.Load.Timeout, "timeout", 2*time.Second, "count a query as timeout without response after this duration")
+	flags.StringVar(&config.ZoneFile, "file", "root.zone", "root zone file providing the tlds of generated queries")
+	flags.IntVar(&config.Queries, "queries", 10000, "number of distinct generated queries")
+	flags.Float64Var(&config.NXDomainRatio, "nxdomain-ratio", 0.1, "ratio of generated queries for non existent tlds")
+	flags.Float64Var(&config.DORatio, "do-ratio", 0.5, "ratio of generated queries with the dnssec ok bit")
+	flags.Int64Var(&config.Seed, "seed", 1, "random seed of generated queries")
+	flags.StringVar(&config.QueryLog, "querylog", "", "replay the queries of a json query log file, gzip if it ends with .gz")
+	flags.StringVar(&config.Pcap, "pcap", "", "replay the queries to port 53 of a pcap or pcapng file")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	queries, err := config.queries()
+	if err != nil {
+		fmt.Fprintf(out, "load bench queries fail: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "bench %s://%s with %d queries, %d workers, window %d, rate %s\n",
+		config.Load.Transport, config.Load.Address, len(queries), config.Load.Workers, config.Load.Window, benchRate(config.Load.Rate))
+	config.Load.Queries = queries
+	result, err := runLoad(&config.Load)
+	if err != nil {
+		fmt.Fprintf(out, "bench fail: %s\n", err)
+		return 1
+	}
+	writeBenchReport(out, result)
+	return 0
+}
+
+func benchRate(rate int) string {
+	if rate <= 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/s", rate)
+}
+
+// queries returns the query mix of the bench
+func (config *BenchConfig) queries() ([]*dns.Msg, error) {
+	if config.Pcap != "" {
+		return readCaptureQueries(config.Pcap)
+	}
+	if config.QueryLog != "" {
+		return readQueryLogQueries(config.QueryLog)
+	}
+	if config.NXDomainRatio < 0 || config.NXDomainRatio > 1 || config.DORatio < 0 || config.DORatio > 1 {
+		return nil, errors.New("ratios should in [0, 1]")
+	}
+	store, err := NewZoneStoreFromFile(config.ZoneFile)
+	if err != nil {
+		return nil, err
+	}
+	random := rand.New(rand.NewSource(config.Seed))
+	return generateQueries(store.TLDs(), config.Queries, config.NXDomainRatio, config.DORatio, random), nil
+}
+
+// generateQueries builds count queries for names under tlds like a root
+// server sees from resolvers, nxRatio of them ask for tlds which do not
+// exist and doRatio of them set the dnssec ok bit
+func generateQueries(tlds []string, count int, nxRatio float64, doRatio float64, random *rand.Rand) []*dns.Msg {
+	queries := make([]*dns.Msg, 0, count)
+	for i := 0; i < count; i++ {
+		var tld string
+		if len(tlds) == 0 || random.Float64() < nxRatio {
+			tld = fmt.Sprintf("nx%08x.", random.Uint32())
+		} else {
+			tld = tlds[random.Intn(len(tlds))]
+		}
+		name := tld
+		// most root queries ask for names below the tld
+		if random.Intn(4) != 0 {
+			name = fmt.Sprintf("host%d.%s", random.Intn(1000000), tld)
+		}
+		query := new(dns.Msg)
+		query.SetQuestion(name, benchQTypes[random.Intn(len(benchQTypes))])
+		query.RecursionDesired = false
+		query.SetEdns0(dns.DefaultMsgSize, random.Float64() < doRatio)
+		queries = append(queries, query)
+	}
+	return queries
+}
+
+// queryLogEntry holds the query fields of a json query log line
+type queryLogEntry struct {
+	QName  string `json:"qname"`
+	QType  string `json:"qtype"`
+	QClass string `json:"qclass"`
+	Flags  string `json:"flags"`
+}
+
+// readQueryLogQueries returns the queries of a json query log file in the
+// order they were logged
+func readQueryLogQueries(filename string) ([]*dns.Msg, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	queries := make([]*dns.Msg, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := queryLogEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.QName == "" {
+			continue
+		}
+		qType, ok := dns.StringToType[entry.QType]
+		if ok == false {
+			continue
+		}
+		qClass, ok := dns.StringToClass[entry.QClass]
+		if ok == false {
+			qClass = dns.ClassINET
+		}
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(entry.QName), qType)
+		query.Question[0].Qclass = qClass
+		query.RecursionDesired = false
+		for _, flag := range strings.Split(entry.Flags, ",") {
+			switch flag {
+			case "rd":
+				query.RecursionDesired = true
+			case "cd":
+				query.CheckingDisabled = true
+			case "edns":
+				if query.IsEdns0() == nil {
+					query.SetEdns0(dns.DefaultMsgSize, false)
+				}
+			case "do":
+				query.SetEdns0(dns.DefaultMsgSize, true)
+			}
+		}
+		queries = append(queries, query)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, errors.New("no query found in query log")
+	}
+	return queries, nil
+}
+
+// writeBenchReport writes the throughput, latency percentiles and rcodes
+// of a load run
+func writeBenchReport(out io.Writer, result *LoadResult) {
+	percent := func(count uint64) float64 {
+		if result.Sent == 0 {
+			return 0
+		}
+		return float64(count) * 100 / float64(result.Sent)
+	}
+	fmt.Fprintf(out, "elapsed:     %s\n", result.Elapsed.Truncate(time.Millisecond))
+	fmt.Fprintf(out, "sent:        %d\n", result.Sent)
+	fmt.Fprintf(out, "received:    %d (%.2f%%)\n", result.Received, percent(result.Received))
+	fmt.Fprintf(out, "timeouts:    %d (%.2f%%)\n", result.Timeouts, percent(result.Timeouts))
+	if result.SendErrors > 0 {
+		fmt.Fprintf(out, "send errors: %d\n", result.SendErrors)
+	}
+	fmt.Fprintf(out, "qps:         %.1f\n", result.QPS())
+	if len(result.Latencies) > 0 {
+		fmt.Fprintf(out, "latency:     min %s, p50 %s, p90 %s, p99 %s, p99.9 %s, max %s\n",
+			result.Latencies[0], result.Percentile(50), result.Percentile(90),
+			result.Percentile(99), result.Percentile(99.9), result.Latencies[len(result.Latencies)-1])
+	}
+	rcodes := make([]int, 0, len(result.Rcodes))
+	for rcode := range result.Rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Ints(rcodes)
+	for _, rcode := range rcodes {
+		name, ok := dns.RcodeToString[rcode]
+		if ok == false {
+			name = fmt.Sprintf("RCODE%d", rcode)
+		}
+		fmt.Fprintf(out, "rcode:       %s %d (%.2f%%)\n", name, result.Rcodes[rcode], percent(result.Rcodes[rcode]))
+	}
+}
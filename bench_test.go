@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateQueries(t *testing.T) {
+	tlds := []string{"com.", "net.", "org."}
+	queries := generateQueries(tlds, 10000, 0.2, 0.5, rand.New(rand.NewSource(1)))
+	if len(queries) != 10000 {
+		t.Fatalf("expect 10000 queries but got %d", len(queries))
+	}
+	nx, do := 0, 0
+	for _, query := range queries {
+		tld := getTLDFromDomain(query.Question[0].Name)
+		if tld != "com." && tld != "net." && tld != "org." {
+			nx++
+		}
+		if opt := query.IsEdns0(); opt != nil && opt.Do() {
+			do++
+		}
+	}
+	if nx < 1800 || nx > 2200 {
+		t.Errorf("expect about 2000 nxdomain queries but got %d", nx)
+	}
+	if do < 4700 || do > 5300 {
+		t.Errorf("expect about 5000 do queries but got %d", do)
+	}
+	again := generateQueries(tlds, 10, 0.2, 0.5, rand.New(rand.NewSource(1)))
+	for i := range again {
+		if again[i].Question[0] != queries[i].Question[0] {
+			t.Errorf("expect same seed generate same queries but got %v and %v", again[i].Question[0], queries[i].Question[0])
+		}
+	}
+}
+
+func TestReadQueryLogQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "query.log")
+	manager := newTestManager(t)
+	if err := manager.EnableQueryLog(QueryLogConfig{Filename: filename, SampleRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	logged := []*dns.Msg{new(dns.Msg), new(dns.Msg)}
+	logged[0].SetQuestion("com.", dns.TypeNS)
+	logged[0].RecursionDesired = false
+	logged[1].SetQuestion("xyz.", dns.TypeAAAA)
+	logged[1].SetEdns0(1232, true)
+	for _, m := range logged {
+		manager.handler("udp", manager.handleRequest)(&testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}}, m)
+	}
+
+	queries, err := readQueryLogQueries(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("expect 2 queries from query log but got %d", len(queries))
+	}
+	for i, query := range queries {
+		if query.Question[0] != logged[i].Question[0] || queryFlags(query) != queryFlags(logged[i]) {
+			t.Errorf("expect replayed query %v %s but got %v %s", logged[i].Question[0], queryFlags(logged[i]), query.Question[0], queryFlags(query))
+		}
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	address := freeListenAddress(t)
+	addr, err := ParseListenAddr(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go newTestManager(t).runListeners(&ListenConfig{Addresses: []*ListenAddr{addr}, Sockets: 1})
+	waitListener(t, "udp", address)
+	waitListener(t, "tcp", address)
+
+	dir, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zoneFile := filepath.Join(dir, "root.zone")
+	if err := NewZoneStoreFromRRSet(testZoneRRs(t)).ToFile(zoneFile); err != nil {
+		t.Fatal(err)
+	}
+	for _, transport := range []string{"udp", "tcp"} {
+		out := new(bytes.Buffer)
+		code := runBench([]string{
+			"-server", address, "-transport", transport, "-file", zoneFile,
+			"-count", "500", "-workers", "2", "-window", "8", "-nxdomain-ratio", "0.5",
+		}, out)
+		if code != 0 {
+			t.Fatalf("expect %s bench success but got %d: %s", transport, code, out)
+		}
+		report := out.String()
+		for _, expect := range []string{"sent:        500\n", "received:    500 (100.00%)", "timeouts:    0 ", "latency:", "rcode:       NOERROR", "rcode:       NXDOMAIN"} {
+			if strings.Contains(report, expect) == false {
+				t.Errorf("expect %s bench report contains %q but got\n%s", transport, expect, report)
+			}
+		}
+	}
+	if code := runBench([]string{"-file", filepath.Join(dir, "missing.zone")}, new(bytes.Buffer)); code == 0 {
+		t.Error("expect bench fail without zone file")
+	}
+}
+
+func TestLoadRate(t *testing.T) {
+	address := freeListenAddress(t)
+	addr, err := ParseListenAddr("udp://" + address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go newTestManager(t).runListeners(&ListenConfig{Addresses: []*ListenAddr{addr}, Sockets: 1})
+	waitListener(t, "udp", address)
+	query := new(dns.Msg)
+	query.SetQuestion("com.", dns.TypeNS)
+	result, err := runLoad(&LoadConfig{Address: address, Queries: []*dns.Msg{query}, Count: 100, Rate: 500, Workers: 2, Window: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Received != 100 || result.Elapsed.Seconds() < 0.18 {
+		t.Errorf("expect 100 queries paced over about 200ms but got %d in %s", result.Received, result.Elapsed)
+	}
+	if result.Percentile(50) <= 0 || result.Percentile(50) > result.Percentile(100) {
+		t.Errorf("expect ordered latency percentiles but got p50 %s max %s", result.Percentile(50), result.Percentile(100))
+	}
+}
+
+func TestLoadReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// the server accepts and closes every connection
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	query := new(dns.Msg)
+	query.SetQuestion("com.", dns.TypeNS)
+	_, err = runLoad(&LoadConfig{Address: listener.Addr().String(), Transport: "tcp", Queries: []*dns.Msg{query}, Count: 10})
+	if err == nil || strings.Contains(err.Error(), "closed 3 connections in a row without response") == false {
+		t.Errorf("expect load fail when the server closes every connection but got %v", err)
+	}
+}
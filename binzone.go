@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// The binary zone file is written next to the text zone file after each
+// sync so a restart loads the zone without parsing text. It holds the nodes
+// of the label tree in canonical order, each with the index of its parent,
+// its name and its rrsets packed in wire form, and ends with a crc32c of
+// everything before. Files of another version are ignored.
+const (
+	binaryZoneMagic   = "RDNSZONE"
+	binaryZoneVersion = 1
+	binaryZoneSuffix  = ".bin"
+	// magic, version, text file size and modification time, serial and
+	// node count
+	binaryZoneHeaderSize = 8 + 4 + 8 + 8 + 4 + 4
+)
+
+var binaryZoneTable = crc32.MakeTable(crc32.Castagnoli)
+
+// writeBinaryZone writes store to filename, text is the zone file it was
+// written with so a replaced text file is not shadowed by an old binary one
+func writeBinaryZone(store *ZoneStore, filename string, text string) error {
+	info, err := os.Stat(text)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, binaryZoneHeaderSize, 1<<20)
+	copy(data, binaryZoneMagic)
+	binary.BigEndian.PutUint32(data[8:], binaryZoneVersion)
+	binary.BigEndian.PutUint64(data[12:], uint64(info.Size()))
+	binary.BigEndian.PutUint64(data[20:], uint64(info.ModTime().UnixNano()))
+	binary.BigEndian.PutUint32(data[28:], store.Serial())
+	buf := make([]byte, dns.MaxMsgSize+256)
+	count := uint32(0)
+	var visit func(node *zoneNode, parent uint32) error
+	visit = func(node *zoneNode, parent uint32) error {
+		index := count
+		count++
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[0:], parent)
+		binary.BigEndian.PutUint16(header[4:], uint16(len(node.name)))
+		binary.BigEndian.PutUint16(header[6:], uint16(len(node.rrsets)))
+		data = append(data, header[:]...)
+		data = append(data, node.name...)
+		for i := range node.rrsets {
+			rrset := &node.rrsets[i]
+			wire := rrset.wire
+			if wire == nil {
+				wire = make([]byte, 0)
+				for _, rr := range rrset.rrs {
+					record, err := packRecord(rr, buf)
+					if err != nil {
+						return fmt.Errorf("pack %s fail: %s", rr.String(), err)
+					}
+					wire = append(wire, record...)
+				}
+			}
+			var rrsetHeader [6]byte
+			binary.BigEndian.PutUint16(rrsetHeader[0:], rrset.rrtype)
+			binary.BigEndian.PutUint32(rrsetHeader[2:], uint32(len(wire)))
+			data = append(data, rrsetHeader[:]...)
+			data = append(data, wire...)
+		}
+		for _, child := range node.children {
+			if err := visit(child, index); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(store.root, 0); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(data[32:], count)
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.Checksum(data, binaryZoneTable))
+	data = append(data, checksum[:]...)
+	// a restart never sees a partly written file
+	temp := filename + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, filename)
+}
+
+// readBinaryZone loads the zone store of a binary zone file written with
+// the text zone file, which must not have changed since
+func readBinaryZone(filename string, text string) (*ZoneStore, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < binaryZoneHeaderSize+4 || string(data[:8]) != binaryZoneMagic {
+		return nil, errors.New("not a binary zone file")
+	}
+	if version := binary.BigEndian.Uint32(data[8:]); version != binaryZoneVersion {
+		return nil, fmt.Errorf("binary zone version %d is not %d", version, binaryZoneVersion)
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, binaryZoneTable) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, errors.New("binary zone checksum mismatch")
+	}
+	info, err := os.Stat(text)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(info.Size()) != binary.BigEndian.Uint64(data[12:]) ||
+		uint64(info.ModTime().UnixNano()) != binary.BigEndian.Uint64(data[20:]) {
+		return nil, errors.New("text zone file changed after binary zone was written")
+	}
+	count := binary.BigEndian.Uint32(data[32:])
+	if count == 0 || int64(count) > int64(len(body)/8) {
+		return nil, fmt.Errorf("invalid binary zone node count %d", count)
+	}
+	nodes := make([]*zoneNode, 0, count)
+	offset := binaryZoneHeaderSize
+	for uint32(len(nodes)) < count {
+		if offset+8 > len(body) {
+			return nil, errors.New("binary zone truncated")
+		}
+		parent := binary.BigEndian.Uint32(body[offset:])
+		nameLength := int(binary.BigEndian.Uint16(body[offset+4:]))
+		rrsets := int(binary.BigEndian.Uint16(body[offset+6:]))
+		offset += 8
+		if offset+nameLength > len(body) {
+			return nil, errors.New("binary zone truncated")
+		}
+		node := &zoneNode{name: string(body[offset : offset+nameLength]), rrsets: make([]zoneRRSet, 0, rrsets)}
+		offset += nameLength
+		node.label = firstLabel(node.name)
+		for i := 0; i < rrsets; i++ {
+			if offset+6 > len(body) {
+				return nil, errors.New("binary zone truncated")
+			}
+			rrtype := binary.BigEndian.Uint16(body[offset:])
+			length := int(binary.BigEndian.Uint32(body[offset+2:]))
+			offset += 6
+			if length == 0 || offset+length > len(body) {
+				return nil, errors.New("binary zone truncated")
+			}
+			// copied so the file buffer is not kept alive
+			wire := make([]byte, length)
+			copy(wire, body[offset:offset+length])
+			offset += length
+			node.rrsets = append(node.rrsets, zoneRRSet{rrtype: rrtype, wire: wire})
+		}
+		if len(nodes) > 0 {
+			// canonical order puts parents before their children and
+			// children in order
+			if int(parent) >= len(nodes) {
+				return nil, fmt.Errorf("node %s has invalid parent %d", node.name, parent)
+			}
+			nodes[parent].children = append(nodes[parent].children, node)
+		} else if node.name != "." {
+			return nil, errors.New("binary zone does not start with the root")
+		}
+		nodes = append(nodes, node)
+	}
+	if offset != len(body) {
+		return nil, errors.New("binary zone has trailing data")
+	}
+	for _, node := range nodes {
+		node.children = node.children[:len(node.children):len(node.children)]
+	}
+	store := &ZoneStore{root: nodes[0]}
+	if err := store.link(); err != nil {
+		return nil, err
+	}
+	if store.Serial() != binary.BigEndian.Uint32(data[28:]) {
+		return nil, errors.New("binary zone serial mismatch")
+	}
+	return store, nil
+}
+
+// firstLabel returns the lower case first label of a presentation name,
+// escaped dots do not end the label
+func firstLabel(name string) string {
+	if name == "." {
+		return ""
+	}
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			return strings.ToLower(name[:i])
+		}
+	}
+	return strings.ToLower(name)
+}
+
+// writeZoneFiles writes store to the text zone file and the binary zone
+// file next to it, a failed binary file only costs a slower restart
+func writeZoneFiles(store *ZoneStore, filename string) error {
+	if err := store.ToFile(filename); err != nil {
+		return err
+	}
+	if err := writeBinaryZone(store, filename+binaryZoneSuffix, filename); err != nil {
+		log.Warnf("write binary zone file fail: %s", err)
+		os.Remove(filename + binaryZoneSuffix)
+	}
+	return nil
+}
+
+// readZoneFiles loads the zone from the binary zone file and falls back to
+// the text zone file when the binary file is missing, corrupt, of another
+// version or older than the text file
+func readZoneFiles(filename string) (*ZoneStore, error) {
+	start := time.Now()
+	store, err := readBinaryZone(filename+binaryZoneSuffix, filename)
+	if err == nil {
+		log.Infof("load zone serial %d from binary zone file in %s", store.Serial(), time.Since(start))
+		return store, nil
+	}
+	if os.IsNotExist(err) == false {
+		log.Warnf("load binary zone file fail, using text zone file: %s", err)
+	}
+	start = time.Now()
+	store, err = NewZoneStoreFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("load zone serial %d from text zone file in %s", store.Serial(), time.Since(start))
+	return store, nil
+}
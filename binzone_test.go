@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBinaryZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "binzone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "root.zone")
+	now := time.Now()
+	store := NewZoneStoreFromRRSet(signTestZone(t, now.Add(-time.Hour)))
+	if err := writeZoneFiles(store, filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readBinaryZone(filename+binaryZoneSuffix, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(loaded.TransferRRs()) != fmt.Sprint(store.TransferRRs()) {
+		t.Errorf("expect binary zone load the same records but got\n%v\n%v", loaded.TransferRRs(), store.TransferRRs())
+	}
+	if err := loaded.Validate(now); err != nil {
+		t.Errorf("expect signed zone from binary file valid but got %s", err)
+	}
+	for _, name := range []string{".", "www.com.", "xyz."} {
+		for _, qType := range []uint16{dns.TypeNS, dns.TypeDNSKEY} {
+			expect, got := store.Lookup(name, qType, false), loaded.Lookup(name, qType, false)
+			if fmt.Sprint(expect) != fmt.Sprint(got) {
+				t.Errorf("expect lookup %s %s from binary zone %v but got %v", name, dns.TypeToString[qType], expect, got)
+			}
+		}
+	}
+
+	data, err := ioutil.ReadFile(filename + binaryZoneSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// older version with a valid checksum
+	older := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(older[8:], binaryZoneVersion-1)
+	binary.BigEndian.PutUint32(older[len(older)-4:], crc32.Checksum(older[:len(older)-4], binaryZoneTable))
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	for _, c := range []struct {
+		name   string
+		data   []byte
+		expect string
+	}{
+		{"older version", older, "binary zone version 0 is not 1"},
+		{"corrupt", corrupt, "binary zone checksum mismatch"},
+		{"truncated", data[:len(data)-10], "binary zone checksum mismatch"},
+		{"text", []byte("not binary"), "not a binary zone file"},
+	} {
+		if err := ioutil.WriteFile(filename+binaryZoneSuffix, c.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readBinaryZone(filename+binaryZoneSuffix, filename); err == nil || err.Error() != c.expect {
+			t.Errorf("%s: expect error %q but got %v", c.name, c.expect, err)
+		}
+		if fallback, err := readZoneFiles(filename); err != nil || fallback.Serial() != store.Serial() {
+			t.Errorf("%s: expect fall back to text zone file but got %v", c.name, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filename+binaryZoneSuffix, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed := now.Add(time.Minute)
+	if err := os.Chtimes(filename, changed, changed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readBinaryZone(filename+binaryZoneSuffix, filename); err == nil || strings.Contains(err.Error(), "changed") == false {
+		t.Errorf("expect binary zone older than text file ignored but got %v", err)
+	}
+	os.Remove(filename + binaryZoneSuffix)
+	if _, err := readZoneFiles(filename); err != nil {
+		t.Errorf("expect text zone file loaded without binary file but got %s", err)
+	}
+}
+
+// BenchmarkLoadZone measures the startup load of a root sized zone from
+// the text zone file and from the binary zone file
+func BenchmarkLoadZone(b *testing.B) {
+	dir, err := ioutil.TempDir("", "binzone")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "root.zone")
+	if err := writeZoneFiles(NewZoneStoreFromRRSet(parseBenchZone(b, benchZoneRecords(1500))), filename); err != nil {
+		b.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		load func() (*ZoneStore, error)
+	}{
+		{"text", func() (*ZoneStore, error) { return NewZoneStoreFromFile(filename) }},
+		{"binary", func() (*ZoneStore, error) { return readBinaryZone(filename+binaryZoneSuffix, filename) }},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := c.load(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// IdentityConfig holds the values answered to CHAOS class identity queries
+// and the EDNS NSID option (RFC 5001), an empty value is hidden
+type IdentityConfig struct {
+	Version  string
+	Hostname string
+	ServerID string
+	NSID     string
+	Hide     bool
+}
+
+// chaosValue returns the configured value of a CHAOS identity name
+func (identity *IdentityConfig) chaosValue(name string) string {
+	if identity == nil || identity.Hide {
+		return ""
+	}
+	switch strings.ToLower(name) {
+	case "version.bind.", "version.server.":
+		return identity.Version
+	case "hostname.bind.":
+		return identity.Hostname
+	case "id.server.":
+		return identity.ServerID
+	}
+	return ""
+}
+
+// handleChaos answers CHAOS class queries, names which are unknown or
+// hidden are refused with the extended dns error returned
+func (manager *Manager) handleChaos(m *dns.Msg, question dns.Question) dns.EDNS0 {
+	switch strings.ToLower(question.Name) {
+	case "version.bind.", "version.server.", "hostname.bind.", "id.server.":
+	default:
+		m.Rcode = dns.RcodeRefused
+		return manager.edeOption(EDENotAuthoritative, "unknown chaos name")
+	}
+	value := manager.identity.chaosValue(question.Name)
+	if value == "" {
+		m.Rcode = dns.RcodeRefused
+		return manager.edeOption(EDEProhibited, "identity is hidden")
+	}
+	m.Authoritative = true
+	if question.Qtype != dns.TypeTXT && question.Qtype != dns.TypeANY {
+		// the name exists with a TXT record only
+		return nil
+	}
+	m.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+		Txt: []string{value},
+	}}
+	return nil
+}
+
+// nsidOption returns the NSID option for the response when the client
+// asks for it and an instance identifier is configured
+func (manager *Manager) nsidOption(r *dns.Msg) dns.EDNS0 {
+	if manager.identity == nil || manager.identity.Hide || manager.identity.NSID == "" {
+		return nil
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0NSID {
+			return &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(manager.identity.NSID))}
+		}
+	}
+	return nil
+}
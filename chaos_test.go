@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestChaosIdentity(t *testing.T) {
+	manager := newTestManager(t)
+	manager.SetIdentity(&IdentityConfig{Version: "rootdns 1.0", Hostname: "node1", ServerID: ""})
+	cases := []struct {
+		name  string
+		qType uint16
+		rcode int
+		value string
+	}{
+		{"version.bind.", dns.TypeTXT, dns.RcodeSuccess, "rootdns 1.0"},
+		{"VERSION.SERVER.", dns.TypeTXT, dns.RcodeSuccess, "rootdns 1.0"},
+		{"hostname.bind.", dns.TypeTXT, dns.RcodeSuccess, "node1"},
+		{"id.server.", dns.TypeTXT, dns.RcodeRefused, ""},
+		// the name exists, an other type gets no data
+		{"version.bind.", dns.TypeA, dns.RcodeSuccess, ""},
+		{"com.", dns.TypeTXT, dns.RcodeRefused, ""},
+	}
+	for _, c := range cases {
+		m := new(dns.Msg)
+		m.SetQuestion(c.name, c.qType)
+		m.Question[0].Qclass = dns.ClassCHAOS
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+		manager.handleRequest(w, m)
+		if w.msg.Rcode != c.rcode {
+			t.Errorf("expect rcode %d for %s but got %d", c.rcode, c.name, w.msg.Rcode)
+			continue
+		}
+		if c.value == "" {
+			if len(w.msg.Answer) != 0 {
+				t.Errorf("expect no answer for %s but got %v", c.name, w.msg.Answer)
+			}
+			continue
+		}
+		if len(w.msg.Answer) != 1 {
+			t.Errorf("expect one answer for %s but got %d", c.name, len(w.msg.Answer))
+			continue
+		}
+		txt, ok := w.msg.Answer[0].(*dns.TXT)
+		if ok == false || txt.Hdr.Class != dns.ClassCHAOS || txt.Txt[0] != c.value {
+			t.Errorf("expect CH TXT %s for %s but got %s", c.value, c.name, w.msg.Answer[0])
+		}
+	}
+
+	manager.SetIdentity(&IdentityConfig{Version: "rootdns 1.0", Hide: true})
+	m := new(dns.Msg)
+	m.SetQuestion("version.bind.", dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	manager.handleRequest(w, m)
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("expect hidden identity refused but got %d", w.msg.Rcode)
+	}
+
+	// other classes never fall into the IN zone data
+	m.SetQuestion("com.", dns.TypeNS)
+	m.Question[0].Qclass = dns.ClassHESIOD
+	manager.handleRequest(w, m)
+	if w.msg.Rcode != dns.RcodeRefused || len(w.msg.Ns) != 0 {
+		t.Errorf("expect HS query refused but got %s", w.msg)
+	}
+}
+
+func TestNSID(t *testing.T) {
+	manager := newTestManager(t)
+	manager.SetIdentity(&IdentityConfig{NSID: "fra1"})
+	nsid := func(r *dns.Msg) string {
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+		manager.handleRequest(w, r)
+		if opt := w.msg.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if casted, ok := option.(*dns.EDNS0_NSID); ok {
+					return casted.Nsid
+				}
+			}
+		}
+		return ""
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("com.", dns.TypeNS)
+	if value := nsid(m); value != "" {
+		t.Errorf("expect no nsid without edns but got %s", value)
+	}
+	m.SetEdns0(1232, false)
+	if value := nsid(m); value != "" {
+		t.Errorf("expect no nsid when not asked but got %s", value)
+	}
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	if value := nsid(m); value != hex.EncodeToString([]byte("fra1")) {
+		t.Errorf("expect nsid fra1 but got %s", value)
+	}
+	manager.SetIdentity(&IdentityConfig{NSID: "fra1", Hide: true})
+	if value := nsid(m); value != "" {
+		t.Errorf("expect hidden nsid but got %s", value)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"github.com/miekg/dns"
+	"math/bits"
+	"net"
+	"time"
+)
+
+// DNS cookie states of a query (RFC 7873 section 5.2)
+const (
+	CookieNone = iota
+	CookieMalformed
+	CookieClientOnly
+	CookieValid
+	CookieInvalid
+)
+
+// server cookie layout and lifetime of RFC 9018, a cookie older than
+// cookieRenewAge is replaced with a new one in the response
+const (
+	cookieVersion       = 1
+	clientCookieSize    = 8
+	serverCookieSize    = 16
+	cookieSecretSize    = 16
+	cookieMaxAge        = time.Hour
+	cookieRenewAge      = 30 * time.Minute
+	cookieMaxClockAhead = 5 * time.Minute
+)
+
+// CookieConfig holds the hex encoded 128 bit server secrets, all instances
+// behind one address should share them. A cookie made with the previous
+// secret is still accepted so the secret can be rolled over without
+// BADCOOKIE responses: deploy the new secret as Secret and the old one as
+// PreviousSecret everywhere, then drop PreviousSecret an hour later.
+type CookieConfig struct {
+	Secret         string
+	PreviousSecret string
+}
+
+// Cookies generates and validates interoperable server cookies (RFC 9018)
+type Cookies struct {
+	secret   []byte
+	previous []byte
+}
+
+func parseCookieSecret(value string) ([]byte, error) {
+	secret, err := hex.DecodeString(value)
+	if err != nil || len(secret) != cookieSecretSize {
+		return nil, errors.New("cookie secret should be 32 hex characters")
+	}
+	return secret, nil
+}
+
+// NewCookies creates cookie processor, a random secret is used when no
+// secret is configured
+func NewCookies(config CookieConfig) (*Cookies, error) {
+	cookies := &Cookies{}
+	if config.Secret == "" {
+		cookies.secret = make([]byte, cookieSecretSize)
+		if _, err := rand.Read(cookies.secret); err != nil {
+			return nil, err
+		}
+	} else {
+		secret, err := parseCookieSecret(config.Secret)
+		if err != nil {
+			return nil, err
+		}
+		cookies.secret = secret
+	}
+	if config.PreviousSecret != "" {
+		previous, err := parseCookieSecret(config.PreviousSecret)
+		if err != nil {
+			return nil, err
+		}
+		cookies.previous = previous
+	}
+	return cookies, nil
+}
+
+// serverCookie builds version | reserved | timestamp | hash where hash is
+// SipHash-2-4 of client cookie | version | reserved | timestamp | client ip
+// in the little endian byte order of the reference implementation
+func serverCookie(secret []byte, clientCookie []byte, client net.IP, timestamp uint32) []byte {
+	cookie := make([]byte, serverCookieSize)
+	cookie[0] = cookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], timestamp)
+	if ipv4 := client.To4(); ipv4 != nil {
+		client = ipv4
+	}
+	input := make([]byte, 0, clientCookieSize+8+net.IPv6len)
+	input = append(input, clientCookie...)
+	input = append(input, cookie[:8]...)
+	input = append(input, client...)
+	binary.LittleEndian.PutUint64(cookie[8:], siphash24(secret, input))
+	return cookie
+}
+
+func (cookies *Cookies) newOption(clientCookie []byte, client net.IP, now time.Time) *dns.EDNS0_COOKIE {
+	cookie := make([]byte, 0, clientCookieSize+serverCookieSize)
+	cookie = append(cookie, clientCookie...)
+	cookie = append(cookie, serverCookie(cookies.secret, clientCookie, client, uint32(now.Unix()))...)
+	return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)}
+}
+
+// Check validates the cookie of query r from client and returns its state
+// with the cookie option of the response
+func (cookies *Cookies) Check(client net.Addr, r *dns.Msg, now time.Time) (int, *dns.EDNS0_COOKIE) {
+	if cookies == nil {
+		return CookieNone, nil
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return CookieNone, nil
+	}
+	var option *dns.EDNS0_COOKIE
+	for _, value := range opt.Option {
+		if casted, ok := value.(*dns.EDNS0_COOKIE); ok == true {
+			option = casted
+			break
+		}
+	}
+	if option == nil {
+		return CookieNone, nil
+	}
+	cookie, err := hex.DecodeString(option.Cookie)
+	if err != nil || len(cookie) < clientCookieSize || len(cookie) > 40 ||
+		(len(cookie) > clientCookieSize && len(cookie) < clientCookieSize+8) {
+		return CookieMalformed, nil
+	}
+	ip := addrIP(client)
+	clientCookie := cookie[:clientCookieSize]
+	if len(cookie) == clientCookieSize {
+		return CookieClientOnly, cookies.newOption(clientCookie, ip, now)
+	}
+	received := cookie[clientCookieSize:]
+	if len(received) != serverCookieSize || received[0] != cookieVersion {
+		return CookieInvalid, cookies.newOption(clientCookie, ip, now)
+	}
+	timestamp := binary.BigEndian.Uint32(received[4:])
+	// serial number arithmetic handles the wrap of the 32 bit timestamp
+	age := time.Duration(int32(uint32(now.Unix())-timestamp)) * time.Second
+	if age > cookieMaxAge || age < -cookieMaxClockAhead {
+		return CookieInvalid, cookies.newOption(clientCookie, ip, now)
+	}
+	for i, secret := range [][]byte{cookies.secret, cookies.previous} {
+		if secret == nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare(received, serverCookie(secret, clientCookie, ip, timestamp)) == 1 {
+			// cookies of the previous secret are replaced at once
+			if age > cookieRenewAge || i > 0 {
+				return CookieValid, cookies.newOption(clientCookie, ip, now)
+			}
+			return CookieValid, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: option.Cookie}
+		}
+	}
+	return CookieInvalid, cookies.newOption(clientCookie, ip, now)
+}
+
+// cookieWriter adds the cookie option to responses carrying an OPT record
+type cookieWriter struct {
+	dns.ResponseWriter
+	option *dns.EDNS0_COOKIE
+}
+
+func (w *cookieWriter) WriteMsg(m *dns.Msg) error {
+	if opt := m.IsEdns0(); opt != nil {
+		opt.Option = append(opt.Option, w.option)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// checkCookie answers FORMERR to malformed cookies and BADCOOKIE to invalid
+// server cookies, it returns false when the query is answered
+func (manager *Manager) checkCookie(w dns.ResponseWriter, r *dns.Msg, state int) bool {
+	switch state {
+	case CookieMalformed:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return false
+	case CookieInvalid:
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeBadCookie)
+		manager.writeResponse(w, r, m)
+		return false
+	}
+	return true
+}
+
+// siphash24 is SipHash-2-4 with a 128 bit key and 64 bit output
+func siphash24(key []byte, data []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key)
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	length := len(data)
+	for ; len(data) >= 8; data = data[8:] {
+		m := binary.LittleEndian.Uint64(data)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	var last [8]byte
+	copy(last[:], data)
+	last[7] = byte(length)
+	m := binary.LittleEndian.Uint64(last[:])
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSipHash24(t *testing.T) {
+	// reference vector of the siphash paper, key 00..0f and message 00..0e
+	key := make([]byte, 16)
+	data := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if hash := siphash24(key, data); hash != 0xa129ca6149be45e5 {
+		t.Errorf("expect siphash 0xa129ca6149be45e5 but got %#x", hash)
+	}
+}
+
+func cookieQuery(cookie string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	return m
+}
+
+func TestCookiesCheck(t *testing.T) {
+	// test vectors of RFC 9018 appendix A.1 and A.2
+	cookies, err := NewCookies(CookieConfig{Secret: "e5e973e5a6b2a43f48e7dc849e37bfcf"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.100"), Port: 5353}
+	state, option := cookies.Check(client, cookieQuery("2464c4abcf10c957"), time.Unix(1559731985, 0))
+	if state != CookieClientOnly || option.Cookie != "2464c4abcf10c957010000005cf79f111f8130c3eee29480" {
+		t.Errorf("expect new server cookie but got %d %v", state, option)
+	}
+	learned := "2464c4abcf10c957010000005cf79f111f8130c3eee29480"
+	state, option = cookies.Check(client, cookieQuery(learned), time.Unix(1559731985+60, 0))
+	if state != CookieValid || option.Cookie != learned {
+		t.Errorf("expect fresh cookie echoed but got %d %v", state, option)
+	}
+	state, option = cookies.Check(client, cookieQuery(learned), time.Unix(1559734385, 0))
+	if state != CookieValid || option.Cookie != "2464c4abcf10c957010000005cf7a871d4a564a1442aca77" {
+		t.Errorf("expect renewed cookie but got %d %v", state, option)
+	}
+	if state, _ = cookies.Check(client, cookieQuery(learned), time.Unix(1559731985+7200, 0)); state != CookieInvalid {
+		t.Errorf("expect expired cookie invalid but got %d", state)
+	}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.101"), Port: 5353}
+	if state, _ = cookies.Check(other, cookieQuery(learned), time.Unix(1559731985, 0)); state != CookieInvalid {
+		t.Errorf("expect cookie of other address invalid but got %d", state)
+	}
+	if state, _ = cookies.Check(client, cookieQuery("2464c4abcf10c95701"), time.Unix(1559731985, 0)); state != CookieMalformed {
+		t.Errorf("expect short server cookie malformed but got %d", state)
+	}
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	if state, _ = cookies.Check(client, plain, time.Now()); state != CookieNone {
+		t.Errorf("expect no cookie but got %d", state)
+	}
+
+	// cookies of the previous secret are accepted after rollover
+	rolled, err := NewCookies(CookieConfig{
+		Secret:         "00112233445566778899aabbccddeeff",
+		PreviousSecret: "e5e973e5a6b2a43f48e7dc849e37bfcf",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, option = rolled.Check(client, cookieQuery(learned), time.Unix(1559731985, 0))
+	if state != CookieValid || option.Cookie == learned {
+		t.Errorf("expect previous secret cookie valid and replaced but got %d %v", state, option)
+	}
+	if _, err := NewCookies(CookieConfig{Secret: "e5e973"}); err == nil {
+		t.Error("expect short secret rejected")
+	}
+}
+
+func TestCookiesHandler(t *testing.T) {
+	manager := newTestManager(t)
+	if err := manager.EnableCookies(CookieConfig{Secret: "e5e973e5a6b2a43f48e7dc849e37bfcf"}); err != nil {
+		t.Fatal(err)
+	}
+	err := manager.EnableRRL(RRLConfig{ErrorsPerSecond: 1, ResponsesPerSecond: 1, NXDomainsPerSecond: 1, Window: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 56})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := manager.handler("udp", manager.handleRequest)
+	client := &net.UDPAddr{IP: net.ParseIP("198.51.100.100"), Port: 5353}
+	w := &testWriter{remote: client}
+	serve(w, cookieQuery("2464c4abcf10c957"))
+	var learned string
+	for _, option := range w.msg.IsEdns0().Option {
+		if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+			learned = cookie.Cookie
+		}
+	}
+	if len(learned) != 48 {
+		t.Fatalf("expect server cookie in response but got %s", w.msg)
+	}
+	// queries with valid cookies are never rate limited
+	for i := 0; i < 5; i++ {
+		w.msg = nil
+		serve(w, cookieQuery(learned))
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("expect query %d with valid cookie answered but got %v", i, w.msg)
+		}
+	}
+	serve(w, cookieQuery("2464c4abcf10c957"+hex.EncodeToString(make([]byte, 16))))
+	if w.msg.Rcode != dns.RcodeBadCookie {
+		t.Errorf("expect BADCOOKIE for invalid server cookie but got %d", w.msg.Rcode)
+	}
+}
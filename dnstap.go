@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dnstap message and frame streams constants, see dnstap.proto and the
+// frame streams control frame specification
+const (
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+
+	dnstapTypeMessage      = 1
+	dnstapAuthQuery        = 1
+	dnstapAuthResponse     = 2
+	dnstapFamilyINET       = 1
+	dnstapFamilyINET6      = 2
+	dnstapProtocolUDP      = 1
+	dnstapProtocolTCP      = 2
+	dnstapProtocolDOT      = 3
+	dnstapProtocolDOH      = 4
+	fstrmControlAccept     = 1
+	fstrmControlStart      = 2
+	fstrmControlStop       = 3
+	fstrmControlReady      = 4
+	fstrmControlFinish     = 5
+	fstrmFieldContentType  = 1
+	dnstapQueueSize        = 10000
+	dnstapFlushInterval    = time.Second
+	dnstapReconnectTimeout = 5 * time.Second
+)
+
+// DnstapStats counts frames written and dropped by the dnstap writer
+type DnstapStats struct {
+	Written uint64 `json:"written"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// Dnstap writes AUTH_QUERY and AUTH_RESPONSE frames to a unix socket, a
+// tcp endpoint or a file. Frames are queued and written by a background
+// goroutine, when the queue is full new frames are dropped so the query
+// path never blocks on a slow consumer. Each connection and the file get one
+// START frame, Close ends the stream with STOP.
+type Dnstap struct {
+	network  string
+	address  string
+	identity []byte
+	version  []byte
+	queue    chan []byte
+	stats    DnstapStats
+	// started is set once the file got its START frame, the file is then
+	// reopened in append mode after a write error
+	started bool
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+// NewDnstap creates dnstap writer for target in unix:/path, tcp:host:port
+// or file:/path format
+func NewDnstap(target string, identity string) (*Dnstap, error) {
+	index := strings.Index(target, ":")
+	if index <= 0 {
+		return nil, fmt.Errorf("dnstap target %s should be unix:, tcp: or file:", target)
+	}
+	network, address := target[:index], target[index+1:]
+	switch network {
+	case "unix", "tcp", "file":
+	default:
+		return nil, fmt.Errorf("unsupported dnstap target type %s", network)
+	}
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	tap := &Dnstap{
+		network:  network,
+		address:  address,
+		identity: []byte(identity),
+		version:  []byte("rootdns"),
+		queue:    make(chan []byte, dnstapQueueSize),
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go tap.run()
+	return tap, nil
+}
+
+// Close writes the queued frames and the STOP frame, a socket output waits
+// for the FINISH frame of the receiver
+func (tap *Dnstap) Close() {
+	close(tap.closing)
+	<-tap.closed
+}
+
+// Stats returns a copy of dnstap counters
+func (tap *Dnstap) Stats() DnstapStats {
+	return DnstapStats{
+		Written: atomic.LoadUint64(&tap.stats.Written),
+		Dropped: atomic.LoadUint64(&tap.stats.Dropped),
+	}
+}
+
+func (tap *Dnstap) enqueue(frame []byte) {
+	select {
+	case tap.queue <- frame:
+	default:
+		atomic.AddUint64(&tap.stats.Dropped, 1)
+	}
+}
+
+// Log queues the query and response frames of event
+func (tap *Dnstap) Log(event *queryEvent) {
+	if event.Query != nil {
+		tap.enqueue(tap.encode(dnstapAuthQuery, event))
+	}
+	if event.Response != nil {
+		tap.enqueue(tap.encode(dnstapAuthResponse, event))
+	}
+}
+
+func (tap *Dnstap) run() {
+	defer close(tap.closed)
+	for {
+		err := tap.session()
+		if err != nil {
+			log.Errorf("dnstap output %s:%s fail: %s", tap.network, tap.address, err)
+		}
+		select {
+		case <-tap.closing:
+			return
+		case <-time.After(dnstapReconnectTimeout):
+		}
+	}
+}
+
+// session opens the output and writes frames until an error happens or the
+// writer is closed
+func (tap *Dnstap) session() error {
+	var conn io.ReadWriteCloser
+	var err error
+	if tap.network == "file" {
+		// the file holds a single stream, it is only truncated and
+		// started by the first session
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if tap.started {
+			flags = os.O_WRONLY | os.O_APPEND
+		}
+		conn, err = os.OpenFile(tap.address, flags, 0644)
+	} else {
+		conn, err = net.DialTimeout(tap.network, tap.address, dnstapReconnectTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	writer := bufio.NewWriter(conn)
+	if tap.network != "file" {
+		// socket outputs use the bidirectional handshake
+		if err := writeControlFrame(conn, fstrmControlReady); err != nil {
+			return err
+		}
+		control, err := readControlFrame(conn)
+		if err != nil {
+			return err
+		}
+		if control != fstrmControlAccept {
+			return fmt.Errorf("expect frame streams accept but got control %d", control)
+		}
+	}
+	if tap.network != "file" || tap.started == false {
+		if err := writeControlFrame(writer, fstrmControlStart); err != nil {
+			return err
+		}
+		tap.started = true
+	}
+	ticker := time.NewTicker(dnstapFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame := <-tap.queue:
+			if err := tap.writeFrame(writer, frame); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+		case <-tap.closing:
+			return tap.stop(conn, writer)
+		}
+	}
+}
+
+func (tap *Dnstap) writeFrame(writer *bufio.Writer, frame []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+	if _, err := writer.Write(length[:]); err != nil {
+		return err
+	}
+	if _, err := writer.Write(frame); err != nil {
+		return err
+	}
+	atomic.AddUint64(&tap.stats.Written, 1)
+	return nil
+}
+
+// stop writes the frames left in the queue and the STOP frame, then waits
+// for the FINISH frame of a socket receiver
+func (tap *Dnstap) stop(conn io.ReadWriteCloser, writer *bufio.Writer) error {
+	// run is the only reader of the queue
+	for len(tap.queue) > 0 {
+		if err := tap.writeFrame(writer, <-tap.queue); err != nil {
+			return err
+		}
+	}
+	if err := writeControlFrame(writer, fstrmControlStop); err != nil {
+		return err
+	}
+	if tap.network == "file" {
+		return nil
+	}
+	if deadline, ok := conn.(net.Conn); ok == true {
+		deadline.SetReadDeadline(time.Now().Add(dnstapReconnectTimeout))
+	}
+	control, err := readControlFrame(conn)
+	if err != nil {
+		return err
+	}
+	if control != fstrmControlFinish {
+		return fmt.Errorf("expect frame streams finish but got control %d", control)
+	}
+	return nil
+}
+
+// writeControlFrame writes a frame streams control frame, accept, start
+// and ready frames carry the dnstap content type
+func writeControlFrame(w io.Writer, control uint32) error {
+	payload := make([]byte, 4, 64)
+	binary.BigEndian.PutUint32(payload, control)
+	if control == fstrmControlAccept || control == fstrmControlStart || control == fstrmControlReady {
+		field := make([]byte, 8)
+		binary.BigEndian.PutUint32(field, fstrmFieldContentType)
+		binary.BigEndian.PutUint32(field[4:], uint32(len(dnstapContentType)))
+		payload = append(payload, field...)
+		payload = append(payload, dnstapContentType...)
+	}
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	if _, err := w.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	if flusher, ok := w.(*bufio.Writer); ok == true {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func readControlFrame(r io.Reader) (uint32, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header) != 0 {
+		return 0, errors.New("expect frame streams control frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length < 4 || length > 512 {
+		return 0, fmt.Errorf("invalid control frame length %d", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// encode builds the protobuf encoded dnstap message of event
+func (tap *Dnstap) encode(messageType uint64, event *queryEvent) []byte {
+	var message protobuf
+	message.varint(1, messageType)
+	clientIP := addrIP(event.Client)
+	family := uint64(dnstapFamilyINET6)
+	if ipv4 := clientIP.To4(); ipv4 != nil {
+		family = dnstapFamilyINET
+		clientIP = ipv4
+	}
+	message.varint(2, family)
+	message.varint(3, dnstapProtocol(event.Transport))
+	if clientIP != nil {
+		message.bytes(4, clientIP)
+	}
+	if localIP := addrIP(event.Local); localIP != nil {
+		if ipv4 := localIP.To4(); ipv4 != nil {
+			localIP = ipv4
+		}
+		message.bytes(5, localIP)
+	}
+	message.varint(6, uint64(addrPort(event.Client)))
+	message.varint(7, uint64(addrPort(event.Local)))
+	message.varint(8, uint64(event.Start.Unix()))
+	message.fixed32(9, uint32(event.Start.Nanosecond()))
+	if messageType == dnstapAuthQuery {
+		message.bytes(10, event.Query)
+	} else {
+		message.varint(12, uint64(event.End.Unix()))
+		message.fixed32(13, uint32(event.End.Nanosecond()))
+		message.bytes(14, event.Response)
+	}
+	var frame protobuf
+	frame.bytes(1, tap.identity)
+	frame.bytes(2, tap.version)
+	if event.Generation > 0 {
+		// extra tells which zone snapshot answered the query
+		frame.bytes(3, []byte(fmt.Sprintf("serial=%d generation=%d", event.Serial, event.Generation)))
+	}
+	frame.bytes(14, message)
+	frame.varint(15, dnstapTypeMessage)
+	return frame
+}
+
+func dnstapProtocol(transport string) uint64 {
+	switch transport {
+	case "udp":
+		return dnstapProtocolUDP
+	case "dot":
+		return dnstapProtocolDOT
+	case "doh":
+		return dnstapProtocolDOH
+	}
+	return dnstapProtocolTCP
+}
+
+func addrPort(addr net.Addr) int {
+	switch casted := addr.(type) {
+	case *net.UDPAddr:
+		return casted.Port
+	case *net.TCPAddr:
+		return casted.Port
+	}
+	return 0
+}
+
+// protobuf is a minimal protocol buffers encoder for the dnstap schema
+type protobuf []byte
+
+func (p *protobuf) key(field int, wireType int) {
+	p.rawVarint(uint64(field<<3 | wireType))
+}
+
+func (p *protobuf) rawVarint(value uint64) {
+	for value >= 0x80 {
+		*p = append(*p, byte(value)|0x80)
+		value >>= 7
+	}
+	*p = append(*p, byte(value))
+}
+
+func (p *protobuf) varint(field int, value uint64) {
+	p.key(field, 0)
+	p.rawVarint(value)
+}
+
+func (p *protobuf) fixed32(field int, value uint32) {
+	p.key(field, 5)
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], value)
+	*p = append(*p, data[:]...)
+}
+
+func (p *protobuf) bytes(field int, value []byte) {
+	p.key(field, 2)
+	p.rawVarint(uint64(len(value)))
+	*p = append(*p, value...)
+}
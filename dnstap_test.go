@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decodeProtobuf returns varint and bytes fields of a protobuf message
+func decodeProtobuf(t *testing.T, data []byte) (map[int]uint64, map[int][]byte) {
+	varints, bytes := make(map[int]uint64), make(map[int][]byte)
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			varints[field] = value
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			bytes[field] = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 5:
+			varints[field] = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return varints, bytes
+}
+
+func TestDnstapSocketOutput(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	frames := make(chan []byte, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if control, err := readControlFrame(conn); err != nil || control != fstrmControlReady {
+			t.Errorf("expect ready control frame, got %d %v", control, err)
+			return
+		}
+		writeControlFrame(conn, fstrmControlAccept)
+		if control, err := readControlFrame(conn); err != nil || control != fstrmControlStart {
+			t.Errorf("expect start control frame, got %d %v", control, err)
+			return
+		}
+		for {
+			var length [4]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+			if _, err := io.ReadFull(conn, frame); err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	tap, err := NewDnstap("tcp:"+listener.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := newTestManager(t)
+	manager.tap = tap
+	m := new(dns.Msg)
+	m.SetQuestion("com.", dns.TypeNS)
+	manager.handler("udp", manager.handleRequest)(&testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}, m)
+
+	for _, expect := range []uint64{dnstapAuthQuery, dnstapAuthResponse} {
+		select {
+		case frame := <-frames:
+			varints, bytes := decodeProtobuf(t, frame)
+			if varints[15] != dnstapTypeMessage || string(bytes[1]) != "test" || string(bytes[3]) != "serial=2020081000 generation=1" {
+				t.Errorf("unexpected dnstap frame %v %v", varints, bytes)
+			}
+			message, messageBytes := decodeProtobuf(t, bytes[14])
+			if message[1] != expect || message[2] != dnstapFamilyINET || message[3] != dnstapProtocolUDP || message[6] != 5353 {
+				t.Errorf("unexpected dnstap message %v", message)
+			}
+			wire := messageBytes[10]
+			if expect == dnstapAuthResponse {
+				wire = messageBytes[14]
+			}
+			if net.IP(messageBytes[4]).String() != "192.0.2.1" {
+				t.Errorf("unexpected query address %v", messageBytes[4])
+			}
+			msg := new(dns.Msg)
+			if err := msg.Unpack(wire); err != nil || msg.Question[0].Name != "com." {
+				t.Errorf("expect dns message in frame, got %v %v", msg, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting dnstap frame")
+		}
+	}
+}
+
+func TestDnstapDropWhenFull(t *testing.T) {
+	// no writer goroutine consumes the queue
+	tap := &Dnstap{queue: make(chan []byte, 1)}
+	event := &queryEvent{Query: []byte{0}, Response: []byte{0}, Start: time.Now(), End: time.Now()}
+	tap.Log(event)
+	if stats := tap.Stats(); stats.Dropped != 1 {
+		t.Errorf("expect one frame dropped when queue full, got %+v", stats)
+	}
+}
+
+// readFrameStream reads a frame streams stream until STOP or the end of r,
+// it returns the control frames by name and "data" for each data frame
+func readFrameStream(r io.Reader) []string {
+	names := map[uint32]string{fstrmControlStart: "start", fstrmControlStop: "stop"}
+	stream := make([]string, 0)
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return stream
+		}
+		if size := binary.BigEndian.Uint32(length[:]); size > 0 {
+			if _, err := io.ReadFull(r, make([]byte, size)); err != nil {
+				return stream
+			}
+			stream = append(stream, "data")
+			continue
+		}
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return stream
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(r, payload); err != nil || len(payload) < 4 {
+			return stream
+		}
+		stream = append(stream, names[binary.BigEndian.Uint32(payload)])
+		if binary.BigEndian.Uint32(payload) == fstrmControlStop {
+			return stream
+		}
+	}
+}
+
+func TestDnstapFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "dnstap.fstrm")
+	ioutil.WriteFile(filename, []byte("stale stream"), 0644)
+	tap, err := NewDnstap("file:"+filename, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &queryEvent{Query: []byte{0}, Response: []byte{0}, Start: time.Now(), End: time.Now()}
+	tap.Log(event)
+	tap.Close()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream := strings.Join(readFrameStream(bytes.NewReader(data)), ","); stream != "start,data,data,stop" {
+		t.Errorf("expect one stream in the file but got %s", stream)
+	}
+
+	// a session opening the file again continues the stream without start
+	reopened := &Dnstap{network: "file", address: filename, queue: make(chan []byte, 1), started: true, closing: make(chan struct{})}
+	reopened.Log(event)
+	close(reopened.closing)
+	if err := reopened.session(); err != nil {
+		t.Fatal(err)
+	}
+	appended, _ := ioutil.ReadFile(filename)
+	if bytes.HasPrefix(appended, data) == false || len(readFrameStream(bytes.NewReader(appended[len(data):]))) != 2 {
+		t.Errorf("expect reopened file appended with data and stop but got %d bytes", len(appended))
+	}
+}
+
+func TestDnstapSocketClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	streams := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if control, err := readControlFrame(conn); err != nil || control != fstrmControlReady {
+			return
+		}
+		writeControlFrame(conn, fstrmControlAccept)
+		stream := readFrameStream(conn)
+		writeControlFrame(conn, fstrmControlFinish)
+		streams <- strings.Join(stream, ",")
+	}()
+	tap, err := NewDnstap("tcp:"+listener.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap.Log(&queryEvent{Query: []byte{0}, Start: time.Now(), End: time.Now()})
+	tap.Close()
+	select {
+	case stream := <-streams:
+		if stream != "start,data,stop" {
+			t.Errorf("expect close end the stream with stop but got %s", stream)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting dnstap stream")
+	}
+}
+
+func TestDnstapQueryNotPacked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnstap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	manager := newTestManager(t)
+	manager.tap = &Dnstap{queue: make(chan []byte, 2)}
+	if err := manager.EnableQueryLog(QueryLogConfig{Filename: filepath.Join(dir, "query.log"), SampleRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// a name which is not fully qualified can not be packed
+	m := new(dns.Msg)
+	m.Question = []dns.Question{{Name: "com", Qtype: dns.TypeNS, Qclass: dns.ClassINET}}
+	if _, err := m.Pack(); err == nil {
+		t.Fatal("expect query not packed")
+	}
+	manager.handler("udp", manager.handleRequest)(&testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}}, m)
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "query.log")); bytes.Contains(data, []byte(`"qname":"com"`)) == false {
+		t.Errorf("expect query without wire data still logged but got %q", data)
+	}
+	if len(manager.tap.queue) != 0 {
+		t.Errorf("expect no dnstap query frame without wire data but got %d frames", len(manager.tap.queue))
+	}
+}
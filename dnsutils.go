@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/miekg/dns"
 	"os"
 	"strings"
+	"time"
 )
 
 func getTLDFromDomain(domain string) string {
@@ -16,8 +19,18 @@ func getTLDFromDomain(domain string) string {
 	return sLabels[len(sLabels)-2] + "."
 }
 
-func queryAXFR(zone string, server string) ([]*dns.Envelope, error) {
+// queryAXFR transfers zone from server into a zone store as the envelopes
+// arrive, the transfer runs over tls (XoT) when tlsConfig is not nil and
+// is aborted when ctx is done
+func queryAXFR(ctx context.Context, zone string, server string, tlsConfig *tls.Config, limits SyncLimits) (*ZoneStore, error) {
 	t := new(dns.Transfer)
+	if tlsConfig != nil {
+		conn, err := dns.DialTimeoutWithTLS("tcp-tls", server, tlsConfig, xfrDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		t.Conn = conn
+	}
 	m := new(dns.Msg)
 	m.Question = make([]dns.Question, 1)
 	m.Question[0] = dns.Question{
@@ -27,15 +40,50 @@ func queryAXFR(zone string, server string) ([]*dns.Envelope, error) {
 	}
 	c, err := t.In(m, server)
 	if err != nil {
+		if t.Conn != nil {
+			t.Conn.Close()
+		}
 		return nil, err
 	}
-	result := make([]*dns.Envelope, 0)
+	// closing the connection ends the transfer goroutine, which is drained
+	// so it does not block on sending its error
+	conn := t.Conn
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.Close()
+		for range c {
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	receiver := newZoneReceiver(zone, true, limits)
 	for r := range c {
-		result = append(result, r)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		for _, rr := range r.RR {
+			if err := receiver.add(rr, dns.Len(rr)); err != nil {
+				return nil, err
+			}
+		}
 	}
-	return result, nil
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return receiver.finish()
 }
 
+const xfrDialTimeout = 5 * time.Second
+
 func queryHTTP(server string) ([]*dns.Envelope, error) {
 	result := make([]*dns.Envelope, 0)
 
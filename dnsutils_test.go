@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestGetTLDFromDomain(t *testing.T) {
 	for s, expect := range map[string]string{
@@ -19,11 +26,69 @@ func TestGetTLDFromDomain(t *testing.T) {
 }
 
 func TestQueryAXFR(t *testing.T) {
-	rootData, err := queryAXFR(".", DefaultAXFRRootList[0])
+	rootData, err := queryAXFR(context.Background(), ".", DefaultAXFRRootList[0], nil, DefaultSyncLimits)
 	if err != nil {
 		t.Errorf("expect root transfer success got data but got err:%s", err)
 	}
-	if len(rootData) == 0 {
+	if rootData == nil || len(rootData.TLDs()) == 0 {
 		t.Error("expect root transfer success got data but got zero")
 	}
 }
+
+// startTestTransferServer serves handler over plain tcp
+func startTestTransferServer(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: listener, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return listener.Addr().String(), func() { server.Shutdown() }
+}
+
+func TestQueryAXFRStream(t *testing.T) {
+	primary, stop := startTestTransferServer(t, newTestManager(t).handleTransfer)
+	defer stop()
+	store, err := queryAXFR(context.Background(), ".", primary, nil, DefaultSyncLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Serial() != 2020081000 || len(store.TransferRRs()) != len(testZoneRRs(t))+1 {
+		t.Errorf("expect test zone transferred but got serial %d with %d records", store.Serial(), len(store.TransferRRs()))
+	}
+	for _, c := range []struct {
+		limits SyncLimits
+		expect string
+	}{
+		{SyncLimits{MaxRecords: 5}, "zone exceeds 5 records"},
+		{SyncLimits{MaxBytes: 200}, "zone exceeds 200 bytes"},
+	} {
+		if _, err := queryAXFR(context.Background(), ".", primary, nil, c.limits); err == nil || err.Error() != c.expect {
+			t.Errorf("expect transfer fail with %q but got %v", c.expect, err)
+		}
+	}
+
+	// the stalled primary sends the opening soa and nothing more
+	release := make(chan struct{})
+	stalled, stopStalled := startTestTransferServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = testZoneRRs(t)[:1]
+		w.WriteMsg(m)
+		<-release
+	})
+	defer stopStalled()
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = queryAXFR(ctx, ".", stalled, nil, DefaultSyncLimits)
+	if err != context.Canceled || time.Since(start) > time.Second {
+		t.Errorf("expect stalled transfer canceled at once but got %v after %s", err, time.Since(start))
+	}
+	if _, err := queryAXFR(context.Background(), "org.", primary, nil, DefaultSyncLimits); err == nil || strings.Contains(err.Error(), "rcode: 9") == false {
+		t.Errorf("expect transfer of other zone refused but got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DoHContentType is the media type of dns wire format messages (RFC 8484)
+const DoHContentType = "application/dns-message"
+
+// DoHConfig holds settings of the dns over https listener (RFC 8484),
+// the listener serves plain http when no certificate is set which is
+// useful behind a tls terminating proxy
+type DoHConfig struct {
+	Listen   string
+	Path     string
+	CertFile string
+	KeyFile  string
+}
+
+// ServeDoH enables the dns over https listener
+func (manager *Manager) ServeDoH(config *DoHConfig) error {
+	if config.Path == "" || strings.HasPrefix(config.Path, "/") == false {
+		return fmt.Errorf("dns over https path %s should start with /", config.Path)
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		reloader, err := newCertReloader(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		manager.dohCert = reloader
+	}
+	manager.dohConfig = config
+	return nil
+}
+
+func (manager *Manager) runDoH() error {
+	config := manager.dohConfig
+	mux := http.NewServeMux()
+	mux.Handle(config.Path, manager.dohHandler())
+	server := &http.Server{
+		Addr:         config.Listen,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	if manager.dohCert == nil {
+		log.Warnf("start dns over https server without tls at : %s%s", config.Listen, config.Path)
+		return server.ListenAndServe()
+	}
+	// http.Server enables http/2 itself when serving tls
+	server.TLSConfig = &tls.Config{
+		GetCertificate: manager.dohCert.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	log.Infof("start dns over https server at : %s%s", config.Listen, config.Path)
+	return server.ListenAndServeTLS("", "")
+}
+
+// dohHandler decodes the dns message of GET and POST requests and answers
+// it with the same handler as the other transports
+func (manager *Manager) dohHandler() http.Handler {
+	serve := manager.handler("doh", manager.handleRequest)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var data []byte
+		switch req.Method {
+		case http.MethodGet:
+			encoded := strings.TrimRight(req.URL.Query().Get("dns"), "=")
+			decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+			if encoded == "" || err != nil {
+				http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+				return
+			}
+			data = decoded
+		case http.MethodPost:
+			if req.Header.Get("Content-Type") != DoHContentType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, dns.MaxMsgSize))
+			if err != nil {
+				http.Error(w, "invalid request body", http.StatusBadRequest)
+				return
+			}
+			data = body
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(data); err != nil {
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+		writer := &dohWriter{request: req}
+		serve(writer, msg)
+		if writer.data == nil && writer.err == nil {
+			// the query acl dropped the request, close the connection like
+			// the admin acl or forbid it when the connection can not be taken
+			if hijacker, ok := w.(http.Hijacker); ok == true {
+				if conn, _, err := hijacker.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		response := new(dns.Msg)
+		if writer.data == nil || response.Unpack(writer.data) != nil {
+			http.Error(w, "no response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", DoHContentType)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", minTTL(response)))
+		w.Write(writer.data)
+	})
+}
+
+// minTTL returns the smallest ttl of records in the response which is used
+// as http cache lifetime (RFC 8484 section 5.1)
+func minTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			value := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok == true && soa.Minttl < value {
+				value = soa.Minttl
+			}
+			if found == false || value < ttl {
+				ttl = value
+				found = true
+			}
+		}
+	}
+	return ttl
+}
+
+// dohWriter is the dns.ResponseWriter which keeps the response for the http
+// handler instead of writing it to a connection
+type dohWriter struct {
+	request *http.Request
+	data    []byte
+	// err is set when the response could not be packed
+	err error
+}
+
+func (w *dohWriter) LocalAddr() net.Addr {
+	if addr, ok := w.request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok == true {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func (w *dohWriter) RemoteAddr() net.Addr {
+	host, port, err := net.SplitHostPort(w.request.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	portNumber, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: portNumber}
+}
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *dohWriter) Write(data []byte) (int, error) {
+	w.data = data
+	return len(data), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDoHHandler(t *testing.T) {
+	manager := newTestManager(t)
+	server := httptest.NewServer(manager.dohHandler())
+	defer server.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Id = 0
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	get, _ := http.NewRequest(http.MethodGet, server.URL+"?dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+	post, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(data))
+	post.Header.Set("Content-Type", DoHContentType)
+	for _, req := range []*http.Request{get, post} {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != DoHContentType {
+			t.Errorf("%s: expect dns message response, got %d %s", req.Method, resp.StatusCode, resp.Header.Get("Content-Type"))
+			continue
+		}
+		// the com. delegation ttl is 172800 and glue ttl is 172800
+		if cache := resp.Header.Get("Cache-Control"); cache != "max-age=172800" {
+			t.Errorf("%s: expect max-age from minimum ttl, got %s", req.Method, cache)
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(body); err != nil || len(response.Ns) != 2 {
+			t.Errorf("%s: expect referral response, got %v %v", req.Method, response, err)
+		}
+	}
+	for _, c := range []struct {
+		method      string
+		url         string
+		contentType string
+		status      int
+	}{
+		{http.MethodGet, server.URL, "", http.StatusBadRequest},
+		{http.MethodGet, server.URL + "?dns=!!", "", http.StatusBadRequest},
+		{http.MethodPost, server.URL, "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPut, server.URL, DoHContentType, http.StatusMethodNotAllowed},
+	} {
+		req, _ := http.NewRequest(c.method, c.url, bytes.NewReader(data))
+		req.Header.Set("Content-Type", c.contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s: expect status %d, got %d", c.method, c.url, c.status, resp.StatusCode)
+		}
+	}
+	if counter := manager.stats.Snapshot()["doh"]; counter.Queries != 2 {
+		t.Errorf("expect 2 doh queries recorded, got %d", counter.Queries)
+	}
+}
+
+func TestDoHACLDrop(t *testing.T) {
+	filename, cleanup := writeTestACL(t, `{"query": {"rules": [{"prefixes": ["192.0.2.0/24"], "action": "drop"}]}}`)
+	defer cleanup()
+	manager := newTestManager(t)
+	if err := manager.EnableACL(filename); err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("com.", dns.TypeNS)
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+	req.RemoteAddr = "192.0.2.1:4433"
+	recorder := httptest.NewRecorder()
+	manager.dohHandler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("expect request dropped by acl forbidden but got %d", recorder.Code)
+	}
+
+	// a connection which can be taken is closed without response
+	ioutil.WriteFile(filename, []byte(`{"query": {"rules": [{"prefixes": ["127.0.0.0/8"], "action": "drop"}]}}`), 0644)
+	if err := manager.acl.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(manager.dohHandler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(data))
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("expect connection closed for request dropped by acl but got %d", resp.StatusCode)
+	}
+}
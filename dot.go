@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DoTConfig holds settings of the dns over tls listener (RFC 7858)
+type DoTConfig struct {
+	Listen      string
+	CertFile    string
+	KeyFile     string
+	IdleTimeout time.Duration
+	KeepAlive   time.Duration
+}
+
+// certReloadInterval limits how often the certificate files are checked
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves the certificate from disk and reloads it when the
+// files are rotated, so the listener never needs a restart
+type certReloader struct {
+	sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, filename := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(filename)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (reloader *certReloader) reload() error {
+	modTime := reloader.latestModTime()
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.cert = &cert
+	reloader.modTime = modTime
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.Lock()
+	defer reloader.Unlock()
+	if time.Since(reloader.checkedAt) >= certReloadInterval {
+		reloader.checkedAt = time.Now()
+		if reloader.latestModTime().After(reloader.modTime) {
+			if err := reloader.reload(); err != nil {
+				log.Errorf("reload certificate %s fail, keep using the old one: %s", reloader.certFile, err)
+			} else {
+				log.Infof("reload certificate %s success", reloader.certFile)
+			}
+		}
+	}
+	return reloader.cert, nil
+}
+
+// ServeDoT enables the dns over tls listener
+func (manager *Manager) ServeDoT(config *DoTConfig) error {
+	reloader, err := newCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return err
+	}
+	manager.dotConfig = config
+	manager.dotCert = reloader
+	return nil
+}
+
+func (manager *Manager) runDoT() error {
+	config := manager.dotConfig
+	listenConfig := net.ListenConfig{KeepAlive: config.KeepAlive}
+	listener, err := listenConfig.Listen(context.Background(), "tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	log.Infof("start dns over tls server at : %s", config.Listen)
+	return manager.serveDoT(listener, nil)
+}
+
+// serveDoT serves dns over tls on listener, started is called once the
+// server is ready
+func (manager *Manager) serveDoT(listener net.Listener, started func()) error {
+	config := manager.dotConfig
+	tlsConfig := &tls.Config{
+		GetCertificate: manager.dotCert.GetCertificate,
+		NextProtos:     []string{"dot"},
+		MinVersion:     tls.VersionTLS12,
+	}
+	server := dns.Server{
+		Listener:          tls.NewListener(listener, tlsConfig),
+		Handler:           manager.handler("dot", manager.handleRequest),
+		IdleTimeout:       func() time.Duration { return config.IdleTimeout },
+		NotifyStartedFunc: started,
+	}
+	return server.ActivateAndServe()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDoTQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := newTestCert(t, dir, "dot", nil)
+
+	manager := newTestManager(t)
+	err = manager.ServeDoT(&DoTConfig{CertFile: cert.certFile, KeyFile: cert.keyFile, IdleTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	go manager.serveDoT(listener, func() { close(started) })
+	<-started
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.cert)
+	client := dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: pool}}
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	response, _, err := client.Exchange(m, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expect dns over tls query success but got err: %s", err)
+	}
+	if len(response.Ns) != 2 {
+		t.Errorf("expect referral with 2 ns records, got %v", response.Ns)
+	}
+	counter := manager.stats.Snapshot()["dot"]
+	if counter.Queries != 1 || counter.Responses != 1 {
+		t.Errorf("expect 1 dot query and response, got %+v", counter)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first := newTestCert(t, dir, "server", nil)
+	reloader, err := newCertReloader(first.certFile, first.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := newTestCert(t, dir, "server", nil)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(second.certFile, future, future)
+	reloader.checkedAt = time.Time{}
+	cert, _ := reloader.GetCertificate(nil)
+	if string(cert.Certificate[0]) != string(second.cert.Raw) {
+		t.Error("expect rotated certificate to be served after reload")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// EDNS0EDE is the extended dns error option code (RFC 8914)
+const EDNS0EDE = 15
+
+// extended dns error info codes used by the server
+const (
+	EDEStaleAnswer      = 3
+	EDEDNSSECBogus      = 6
+	EDENotReady         = 14
+	EDEProhibited       = 18
+	EDENotAuthoritative = 20
+)
+
+// edeOption builds an extended dns error option, the extra text is left
+// out when it is disabled
+func (manager *Manager) edeOption(code uint16, text string) dns.EDNS0 {
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	if manager.edeText {
+		data = append(data, text...)
+	}
+	return &dns.EDNS0_LOCAL{Code: EDNS0EDE, Data: data}
+}
+
+// SetEDEText includes the explanation of extended dns errors as EXTRA-TEXT
+func (manager *Manager) SetEDEText(enable bool) {
+	manager.edeText = enable
+}
+
+// zoneErrors returns the extended dns errors of answers from snapshot
+func (manager *Manager) zoneErrors(snapshot *zoneSnapshot, now time.Time) []dns.EDNS0 {
+	options := make([]dns.EDNS0, 0)
+	if snapshot.bogus != "" {
+		options = append(options, manager.edeOption(EDEDNSSECBogus, snapshot.bogus))
+	}
+	if manager.zoneStale(snapshot, now) {
+		text := "zone data is " + now.Sub(snapshot.loaded).Truncate(time.Second).String() + " old"
+		if snapshot.embedded {
+			text = "embedded " + text
+		}
+		options = append(options, manager.edeOption(EDEStaleAnswer, text))
+	}
+	return options
+}
+
+// expiredError returns the extended dns error of queries refused because the
+// embedded zone expired
+func (manager *Manager) expiredError(snapshot *zoneSnapshot, now time.Time) dns.EDNS0 {
+	return manager.edeOption(EDENotReady, "embedded zone data is "+now.Sub(snapshot.loaded).Truncate(time.Second).String()+
+		" old, over soa expire "+snapshot.store.Expire().String())
+}
+
+// zoneStale reports whether the zone missed a sync and the soa refresh
+// interval has passed since, the embedded zone is always stale
+func (manager *Manager) zoneStale(snapshot *zoneSnapshot, now time.Time) bool {
+	if snapshot.embedded {
+		return true
+	}
+	if snapshot.loaded.IsZero() {
+		return false
+	}
+	return now.Sub(snapshot.loaded) > manager.syncDuration+snapshot.store.Refresh()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto"
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// queryEDE sends query r to handler and returns the extended errors
+func queryEDE(t *testing.T, serve dns.HandlerFunc, r *dns.Msg) map[uint16]string {
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	serve(w, r)
+	if w.msg == nil {
+		t.Fatal("expect response written")
+	}
+	errors := make(map[uint16]string)
+	if opt := w.msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == EDNS0EDE && len(local.Data) >= 2 {
+				errors[binary.BigEndian.Uint16(local.Data)] = string(local.Data[2:])
+			}
+		}
+	}
+	return errors
+}
+
+// signTestZone returns the test zone with a signed apex
+func signTestZone(t *testing.T, inception time.Time) []dns.RR {
+	rrs := testZoneRRs(t)
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 172800},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	privateKey, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrs = append(rrs, key)
+	store := NewZoneStoreFromRRSet(rrs)
+	for _, qType := range []uint16{dns.TypeSOA, dns.TypeDNSKEY} {
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: ".", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 86400},
+			Algorithm:  dns.ECDSAP256SHA256,
+			KeyTag:     key.KeyTag(),
+			SignerName: ".",
+			Inception:  uint32(inception.Unix()),
+			Expiration: uint32(inception.Add(14 * 24 * time.Hour).Unix()),
+		}
+		if err := sig.Sign(privateKey.(crypto.Signer), store.RRSet(".", qType)); err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, sig)
+	}
+	return rrs
+}
+
+func TestZoneStoreValidate(t *testing.T) {
+	now := time.Now()
+	if err := NewZoneStoreFromRRSet(testZoneRRs(t)).Validate(now); err != nil {
+		t.Errorf("expect unsigned zone not validated but got %s", err)
+	}
+	signed := signTestZone(t, now.Add(-time.Hour))
+	if err := NewZoneStoreFromRRSet(signed).Validate(now); err != nil {
+		t.Errorf("expect signed zone valid but got %s", err)
+	}
+	if err := NewZoneStoreFromRRSet(signed).Validate(now.Add(30 * 24 * time.Hour)); err == nil {
+		t.Error("expect expired signatures to fail validation")
+	}
+	for _, rr := range signed {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Serial++
+		}
+	}
+	if err := NewZoneStoreFromRRSet(signed).Validate(now); err == nil {
+		t.Error("expect modified soa to fail validation")
+	}
+}
+
+func TestExtendedErrors(t *testing.T) {
+	manager := &Manager{stats: NewStats(), syncDuration: time.Minute}
+	manager.SetEDEText(true)
+	query := func(name string, qClass uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeNS)
+		m.Question[0].Qclass = qClass
+		m.SetEdns0(1232, false)
+		return m
+	}
+	serve := manager.handler("udp", manager.handleRequest)
+	if errors := queryEDE(t, serve, query("com.", dns.ClassINET)); errors[EDENotReady] != "zone data is not loaded" {
+		t.Errorf("expect not ready before first load but got %v", errors)
+	}
+
+	manager.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), time.Now())
+	if errors := queryEDE(t, serve, query("com.", dns.ClassINET)); len(errors) != 0 {
+		t.Errorf("expect no extended error for fresh zone but got %v", errors)
+	}
+	// the test zone refresh is 1800 seconds
+	manager.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), time.Now().Add(-time.Hour))
+	if errors := queryEDE(t, serve, query("com.", dns.ClassINET)); errors[EDEStaleAnswer] != "zone data is 1h0m0s old" {
+		t.Errorf("expect stale answer but got %v", errors)
+	}
+
+	signed := signTestZone(t, time.Now().Add(-time.Hour))
+	for _, rr := range signed {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Serial++
+		}
+	}
+	manager.setZone(NewZoneStoreFromRRSet(signed), time.Now())
+	if errors := queryEDE(t, serve, query("com.", dns.ClassINET)); errors[EDEDNSSECBogus] == "" {
+		t.Errorf("expect dnssec bogus for invalid zone but got %v", errors)
+	}
+
+	if errors := queryEDE(t, serve, query("com.", dns.ClassHESIOD)); len(errors[EDENotAuthoritative]) == 0 {
+		t.Errorf("expect not authoritative for HS class but got %v", errors)
+	}
+	manager.SetIdentity(&IdentityConfig{Hide: true})
+	manager.SetEDEText(false)
+	errors := queryEDE(t, serve, query("version.bind.", dns.ClassCHAOS))
+	if text, ok := errors[EDEProhibited]; ok == false || text != "" {
+		t.Errorf("expect prohibited without text for hidden identity but got %v", errors)
+	}
+
+	filename, cleanup := writeTestACL(t, testACL)
+	defer cleanup()
+	if err := manager.EnableACL(filename); err != nil {
+		t.Fatal(err)
+	}
+	if errors := queryEDE(t, serve, query("com.", dns.ClassINET)); len(errors) != 1 {
+		t.Errorf("expect prohibited for acl refusal but got %v", errors)
+	} else if _, ok := errors[EDEProhibited]; ok == false {
+		t.Errorf("expect prohibited for acl refusal but got %v", errors)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// DefaultEDNSBufferSize avoids ip fragmentation (DNS Flag Day 2020)
+const DefaultEDNSBufferSize = 1232
+
+// paddingBlockSize is the recommended response block length (RFC 8467)
+const paddingBlockSize = 468
+
+// EDNSConfig holds the advertised udp payload size and the idle timeout of
+// plain tcp connections
+type EDNSConfig struct {
+	BufferSize     uint16
+	TCPIdleTimeout time.Duration
+}
+
+// SetEDNS sets the edns buffer size and tcp idle timeout
+func (manager *Manager) SetEDNS(config EDNSConfig) {
+	manager.edns = config
+}
+
+func (manager *Manager) ednsBufferSize() uint16 {
+	if manager.edns.BufferSize < 512 {
+		return DefaultEDNSBufferSize
+	}
+	return manager.edns.BufferSize
+}
+
+// idleTimeout returns the idle timeout of the connection oriented transport
+func (manager *Manager) idleTimeout(transport string) time.Duration {
+	switch transport {
+	case "tcp":
+		return manager.edns.TCPIdleTimeout
+	case "dot":
+		if manager.dotConfig != nil {
+			return manager.dotConfig.IdleTimeout
+		}
+	}
+	return 0
+}
+
+// ednsWriter fits responses to the transport: udp responses are truncated
+// to the smaller of the client and server buffer size, tcp and dot answer
+// edns-tcp-keepalive (RFC 7828) and encrypted transports pad responses of
+// padded queries (RFC 7830, RFC 8467)
+type ednsWriter struct {
+	dns.ResponseWriter
+	query       *dns.Msg
+	transport   string
+	bufferSize  uint16
+	idleTimeout time.Duration
+}
+
+// ednsWriter wraps w for query r received by transport
+func (manager *Manager) ednsWriter(w dns.ResponseWriter, r *dns.Msg, transport string) dns.ResponseWriter {
+	return &ednsWriter{
+		ResponseWriter: w,
+		query:          r,
+		transport:      transport,
+		bufferSize:     manager.ednsBufferSize(),
+		idleTimeout:    manager.idleTimeout(transport),
+	}
+}
+
+func (w *ednsWriter) WriteMsg(m *dns.Msg) error {
+	queryOpt := w.query.IsEdns0()
+	opt := m.IsEdns0()
+	switch w.transport {
+	case "udp":
+		size := dns.MinMsgSize
+		if queryOpt != nil {
+			size = int(queryOpt.UDPSize())
+			if size > int(w.bufferSize) {
+				size = int(w.bufferSize)
+			}
+		}
+		m.Truncate(size)
+	case "tcp", "dot":
+		if opt != nil && w.idleTimeout > 0 && hasOption(queryOpt, dns.EDNS0TCPKEEPALIVE) {
+			timeout := w.idleTimeout / (100 * time.Millisecond)
+			if timeout > 0xffff {
+				timeout = 0xffff
+			}
+			data := make([]byte, 2)
+			binary.BigEndian.PutUint16(data, uint16(timeout))
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: data})
+		}
+	}
+	if opt != nil && (w.transport == "dot" || w.transport == "doh") && hasOption(queryOpt, dns.EDNS0PADDING) {
+		m.Compress = true
+		// the padding option header takes 4 bytes
+		length := m.Len() + 4
+		padding := &dns.EDNS0_PADDING{Padding: make([]byte, (paddingBlockSize-length%paddingBlockSize)%paddingBlockSize)}
+		opt.Option = append(opt.Option, padding)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// WritePacked forwards cached responses, they are only used when the
+// response needs no change for the transport
+func (w *ednsWriter) WritePacked(m *dns.Msg, data []byte) error {
+	return writePacked(w.ResponseWriter, m, data)
+}
+
+func hasOption(opt *dns.OPT, code uint16) bool {
+	if opt == nil {
+		return false
+	}
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEDNSBufferSize(t *testing.T) {
+	manager := newTestManager(t)
+	manager.SetEDNS(EDNSConfig{BufferSize: 1232})
+	large := new(dns.Msg)
+	large.SetQuestion("com.", dns.TypeNS)
+	for i := 0; i < 100; i++ {
+		large.Extra = append(large.Extra, &dns.A{
+			Hdr: dns.RR_Header{Name: "a.gtld-servers.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 172800},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	cases := []struct {
+		clientSize uint16
+		limit      int
+	}{
+		{0, 512},
+		{4096, 1232},
+		{800, 800},
+	}
+	for _, c := range cases {
+		query := new(dns.Msg)
+		query.SetQuestion("com.", dns.TypeNS)
+		if c.clientSize > 0 {
+			query.SetEdns0(c.clientSize, false)
+		}
+		w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+		m := large.Copy()
+		m.SetReply(query)
+		manager.writeResponse(manager.ednsWriter(w, query, "udp"), query, m)
+		data, err := w.msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > c.limit || w.msg.Truncated == false {
+			t.Errorf("expect response truncated to %d but got %d bytes tc=%v", c.limit, len(data), w.msg.Truncated)
+		}
+		opt := w.msg.IsEdns0()
+		if c.clientSize == 0 && opt != nil {
+			t.Error("expect no opt record for query without edns")
+		}
+		if c.clientSize > 0 && (opt == nil || opt.UDPSize() != 1232) {
+			t.Errorf("expect advertised size 1232 but got %v", opt)
+		}
+	}
+}
+
+func TestEDNSKeepaliveAndPadding(t *testing.T) {
+	manager := newTestManager(t)
+	manager.SetEDNS(EDNSConfig{BufferSize: 1232, TCPIdleTimeout: 10 * time.Second})
+	query := func(option dns.EDNS0) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("com.", dns.TypeNS)
+		m.SetEdns0(1232, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, option)
+		return m
+	}
+	option := func(m *dns.Msg, code uint16) dns.EDNS0 {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, value := range opt.Option {
+				if value.Option() == code {
+					return value
+				}
+			}
+		}
+		return nil
+	}
+	keepalive := &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE}
+	w := &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	manager.handler("tcp", manager.handleRequest)(w, query(keepalive))
+	if local, ok := option(w.msg, dns.EDNS0TCPKEEPALIVE).(*dns.EDNS0_LOCAL); ok == false || binary.BigEndian.Uint16(local.Data) != 100 {
+		t.Errorf("expect keepalive timeout 100 in tcp response but got %s", w.msg)
+	}
+	w = &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	manager.handler("udp", manager.handleRequest)(w, query(keepalive))
+	if option(w.msg, dns.EDNS0TCPKEEPALIVE) != nil {
+		t.Error("expect no keepalive in udp response")
+	}
+
+	padding := &dns.EDNS0_PADDING{Padding: make([]byte, 16)}
+	w = &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	manager.handler("dot", manager.handleRequest)(w, query(padding))
+	// the response was written compressed
+	w.msg.Compress = true
+	data, err := w.msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if option(w.msg, dns.EDNS0PADDING) == nil || len(data)%paddingBlockSize != 0 {
+		t.Errorf("expect dot response padded to %d bytes block but got %d", paddingBlockSize, len(data))
+	}
+	w = &testWriter{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	manager.handler("tcp", manager.handleRequest)(w, query(padding))
+	if option(w.msg, dns.EDNS0PADDING) != nil {
+		t.Error("expect no padding on unencrypted tcp")
+	}
+}
@@ -6,4 +6,6 @@ require (
 	github.com/go-playground/validator/v10 v10.3.0
 	github.com/miekg/dns v1.1.31
 	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
+	golang.org/x/sys v0.0.0-20190924154521-2837fb4f24fe
 )
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"github.com/go-playground/validator/v10"
 	"github.com/miekg/dns"
@@ -12,6 +13,7 @@ import (
 type HTTPSynchronizer struct {
 	filename string   `validate:"required"`
 	urls     []string `validate:"required,url"`
+	limits   SyncLimits
 }
 
 func NewHTTPSynchronizer(filename string, url string) (*HTTPSynchronizer, error) {
@@ -21,7 +23,7 @@ func NewHTTPSynchronizer(filename string, url string) (*HTTPSynchronizer, error)
 	} else {
 		downloadURLS = ZoneDownloadURL
 	}
-	synchronizer := &HTTPSynchronizer{filename: filename, urls: downloadURLS}
+	synchronizer := &HTTPSynchronizer{filename: filename, urls: downloadURLS, limits: DefaultSyncLimits}
 	err := validator.New().Struct(synchronizer)
 	if err != nil {
 		return nil, err
@@ -29,43 +31,55 @@ func NewHTTPSynchronizer(filename string, url string) (*HTTPSynchronizer, error)
 	return synchronizer, nil
 }
 
-func (synchronizer *HTTPSynchronizer) Download() (*ZoneStore, error) {
+// SetLimits bounds the records and bytes of a download
+func (synchronizer *HTTPSynchronizer) SetLimits(limits SyncLimits) {
+	synchronizer.limits = limits
+}
+
+func (synchronizer *HTTPSynchronizer) Download(ctx context.Context) (*ZoneStore, error) {
 	var response *http.Response
-	var err error
+	err := errors.New("no zone download url")
 	for _, url := range synchronizer.urls {
 		log.Debugf("download zone file from %s start", url)
-		response, err = http.Get(url)
+		var request *http.Request
+		request, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		response, err = http.DefaultClient.Do(request)
 		if err != nil {
 			log.Errorf("download zone file from %s fail:%s", url, err)
 			continue
 		}
+		break
 	}
 
-	if response == nil || err != nil {
+	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
 
 	scanner := bufio.NewScanner(response.Body)
-
-	rrs := make([]dns.RR, 0)
+	receiver := newZoneReceiver(".", false, synchronizer.limits)
 	for scanner.Scan() {
 		rr, err := dns.NewRR(scanner.Text())
-		if err != nil {
+		if err != nil || rr == nil {
 			continue
 		}
-		rrs = append(rrs, rr)
+		if err := receiver.add(rr, len(scanner.Bytes())+1); err != nil {
+			return nil, err
+		}
 	}
-	zoneStore := NewZoneStoreFromRRSet(rrs)
-	if zoneStore == nil {
-		return nil, errors.New("zone store not create success")
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	return zoneStore, nil
+	return receiver.finish()
 }
 
 func (synchronizer *HTTPSynchronizer) SyncToFile(store *ZoneStore) error {
-	return store.ToFile(synchronizer.filename)
+	return writeZoneFiles(store, synchronizer.filename)
 }
 
 func (synchronizer *HTTPSynchronizer) SyncFromFile() (*ZoneStore, error) {
-	return NewZoneStoreFromFile(synchronizer.filename)
+	return readZoneFiles(synchronizer.filename)
 }
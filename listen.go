@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ListenAddr is a dns listen address with its transports, written as
+// udp+tcp://0.0.0.0:53, udp://[::1]:53 or a bare address serving both
+type ListenAddr struct {
+	Address    string
+	Transports []string
+}
+
+func (addr *ListenAddr) String() string {
+	return strings.Join(addr.Transports, "+") + "://" + addr.Address
+}
+
+// ParseListenAddr parses the listen address of the -listen flag
+func ParseListenAddr(value string) (*ListenAddr, error) {
+	addr := &ListenAddr{Address: value, Transports: []string{"udp", "tcp"}}
+	if index := strings.Index(value, "://"); index >= 0 {
+		addr.Address = value[index+3:]
+		addr.Transports = strings.Split(value[:index], "+")
+		for _, transport := range addr.Transports {
+			if transport != "udp" && transport != "tcp" {
+				return nil, fmt.Errorf("unsupported transport %s of listen address %s", transport, value)
+			}
+		}
+	}
+	if _, _, err := net.SplitHostPort(addr.Address); err != nil {
+		return nil, fmt.Errorf("invalid listen address %s: %s", value, err)
+	}
+	return addr, nil
+}
+
+// ListenConfig holds the dns listen addresses, each transport of an address
+// opens Sockets SO_REUSEPORT sockets so the kernel spreads the packets over
+// the cores, zero means GOMAXPROCS on linux and one elsewhere. PinReaders
+// locks the reader goroutine of each udp socket to its own thread. Batch
+// reads and writes up to that many udp packets per system call on linux,
+// zero serves udp with the miekg/dns server.
+type ListenConfig struct {
+	Addresses  []*ListenAddr
+	Sockets    int
+	PinReaders bool
+	Batch      int
+}
+
+// socketCount returns the number of sockets opened for each transport of
+// an address
+func (config *ListenConfig) socketCount() int {
+	if config.Sockets > 0 {
+		return config.Sockets
+	}
+	// only linux balances packets over reuseport sockets
+	if runtime.GOOS == "linux" {
+		return runtime.GOMAXPROCS(0)
+	}
+	return 1
+}
+
+// SocketStats counts the messages read from one listening socket
+type SocketStats struct {
+	Address    string `json:"address"`
+	Transport  string `json:"transport"`
+	Index      int    `json:"index"`
+	Queries    uint64 `json:"queries"`
+	BytesIn    uint64 `json:"bytes_in"`
+	ReadErrors uint64 `json:"read_errors"`
+	// Batches and WriteErrors are only counted by batched udp sockets
+	Batches     uint64 `json:"batches,omitempty"`
+	WriteErrors uint64 `json:"write_errors,omitempty"`
+}
+
+// socketReader counts the messages of a socket and pins the udp reader
+// goroutine to its thread when pin is set
+type socketReader struct {
+	dns.Reader
+	stats  *SocketStats
+	pin    bool
+	pinned bool
+}
+
+func (reader *socketReader) count(data []byte, err error) {
+	if err != nil {
+		// the server sets read deadlines and clients close tcp connections,
+		// neither is a failure
+		if netErr, ok := err.(net.Error); err != io.EOF && (ok == false || netErr.Timeout() == false) {
+			atomic.AddUint64(&reader.stats.ReadErrors, 1)
+		}
+		return
+	}
+	atomic.AddUint64(&reader.stats.Queries, 1)
+	atomic.AddUint64(&reader.stats.BytesIn, uint64(len(data)))
+}
+
+func (reader *socketReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+	// the udp serve loop reads in one goroutine for the server lifetime
+	if reader.pin && reader.pinned == false {
+		runtime.LockOSThread()
+		reader.pinned = true
+	}
+	data, session, err := reader.Reader.ReadUDP(conn, timeout)
+	reader.count(data, err)
+	return data, session, err
+}
+
+func (reader *socketReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	data, err := reader.Reader.ReadTCP(conn, timeout)
+	reader.count(data, err)
+	return data, err
+}
+
+// runListeners serves dns on all listen addresses and returns the first
+// error of any socket
+func (manager *Manager) runListeners(config *ListenConfig) error {
+	count := config.socketCount()
+	errs := make(chan error, len(config.Addresses)*2*count)
+	for _, addr := range config.Addresses {
+		for _, transport := range addr.Transports {
+			for index := 0; index < count; index++ {
+				stats := manager.stats.addSocket(addr.Address, transport, index)
+				pin := config.PinReaders && transport == "udp"
+				if transport == "udp" && config.Batch > 0 {
+					address := addr.Address
+					go func() {
+						errs <- manager.serveBatchUDP(address, count > 1, pin, config.Batch, stats)
+					}()
+					continue
+				}
+				server := &dns.Server{
+					Addr:      addr.Address,
+					Net:       transport,
+					Handler:   manager.handler(transport, manager.handleRequest),
+					ReusePort: count > 1,
+					DecorateReader: func(reader dns.Reader) dns.Reader {
+						return &socketReader{Reader: reader, stats: stats, pin: pin}
+					},
+				}
+				if transport == "tcp" && manager.edns.TCPIdleTimeout > 0 {
+					server.IdleTimeout = func() time.Duration { return manager.edns.TCPIdleTimeout }
+				}
+				go func() {
+					errs <- server.ListenAndServe()
+				}()
+			}
+			log.Infof("start dns %s server at : %s with %d sockets", transport, addr.Address, count)
+		}
+	}
+	return <-errs
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseListenAddr(t *testing.T) {
+	cases := []struct {
+		value      string
+		address    string
+		transports string
+		valid      bool
+	}{
+		{"0.0.0.0:53", "0.0.0.0:53", "udp+tcp", true},
+		{"udp://[::1]:5353", "[::1]:5353", "udp", true},
+		{"tcp+udp://127.0.0.1:53", "127.0.0.1:53", "tcp+udp", true},
+		{"dot://127.0.0.1:853", "", "", false},
+		{"udp://127.0.0.1", "", "", false},
+	}
+	for _, c := range cases {
+		addr, err := ParseListenAddr(c.value)
+		if c.valid == false {
+			if err == nil {
+				t.Errorf("expect %s invalid", c.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expect %s valid but got %s", c.value, err)
+			continue
+		}
+		if addr.Address != c.address || addr.String() != c.transports+"://"+c.address {
+			t.Errorf("expect %s parsed as %s://%s but got %s", c.value, c.transports, c.address, addr)
+		}
+	}
+}
+
+// freeListenAddress returns a loopback address with a free udp port
+func freeListenAddress(t testing.TB) string {
+	probe, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+	return "127.0.0.1:" + strconv.Itoa(probe.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// waitListener queries address until the listener answers
+func waitListener(t testing.TB, transport string, address string) {
+	query := new(dns.Msg)
+	query.SetQuestion(".", dns.TypeSOA)
+	client := &dns.Client{Net: transport, Timeout: time.Second}
+	var err error
+	for i := 0; i < 50; i++ {
+		if _, _, err = client.Exchange(query, address); err == nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expect %s listener at %s but got %s", transport, address, err)
+}
+
+func TestRunListeners(t *testing.T) {
+	address := freeListenAddress(t)
+	manager := newTestManager(t)
+	addr, err := ParseListenAddr(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go manager.runListeners(&ListenConfig{Addresses: []*ListenAddr{addr}, Sockets: 2, PinReaders: true})
+
+	query := new(dns.Msg)
+	query.SetQuestion("com.", dns.TypeNS)
+	for _, transport := range []string{"udp", "tcp"} {
+		waitListener(t, transport, address)
+		client := &dns.Client{Net: transport, Timeout: time.Second}
+		response, _, err := client.Exchange(query, address)
+		if err != nil || len(response.Ns) != 2 {
+			t.Fatalf("expect %s referral from listener but got %v %s", transport, response, err)
+		}
+		for i := 0; i < 8; i++ {
+			if _, _, err := client.Exchange(query, address); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sockets := manager.stats.Sockets()
+	if len(sockets) != 4 {
+		t.Fatalf("expect 2 udp and 2 tcp sockets but got %d", len(sockets))
+	}
+	queries := make(map[string]uint64)
+	for _, socket := range sockets {
+		queries[socket.Transport] += socket.Queries
+		if socket.ReadErrors != 0 {
+			t.Errorf("expect no read errors of socket %s #%d but got %d", socket.Transport, socket.Index, socket.ReadErrors)
+		}
+	}
+	if queries["udp"] != 10 || queries["tcp"] != 10 {
+		t.Errorf("expect 10 queries per transport over the sockets but got %v", queries)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadConfig describes a load run against a dns server. Queries are sent
+// over Workers udp sockets or tcp connections cycling through Queries,
+// each worker keeps up to Window queries in flight and waits Timeout for
+// their responses. The run stops after Count queries or Duration, whichever
+// is set and comes first, Rate limits the queries per second of all
+// workers and zero sends as fast as the window allows.
+type LoadConfig struct {
+	Address   string
+	Transport string
+	Queries   []*dns.Msg
+	Count     int
+	Duration  time.Duration
+	Rate      int
+	Workers   int
+	Window    int
+	Timeout   time.Duration
+}
+
+// LoadResult counts the queries of a load run, Latencies are sorted
+type LoadResult struct {
+	Sent       uint64
+	Received   uint64
+	Timeouts   uint64
+	SendErrors uint64
+	Elapsed    time.Duration
+	Rcodes     map[int]uint64
+	Latencies  []time.Duration
+}
+
+// QPS returns the answered queries per second
+func (result *LoadResult) QPS() float64 {
+	if result.Elapsed <= 0 {
+		return 0
+	}
+	return float64(result.Received) / result.Elapsed.Seconds()
+}
+
+// Percentile returns the latency below which p percent of the responses
+// arrived
+func (result *LoadResult) Percentile(p float64) time.Duration {
+	if len(result.Latencies) == 0 {
+		return 0
+	}
+	index := int(float64(len(result.Latencies))*p/100+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(result.Latencies) {
+		index = len(result.Latencies) - 1
+	}
+	return result.Latencies[index]
+}
+
+// runLoad sends the queries of config and waits for all workers
+func runLoad(config *LoadConfig) (*LoadResult, error) {
+	if len(config.Queries) == 0 {
+		return nil, errors.New("load needs queries")
+	}
+	if config.Count <= 0 && config.Duration <= 0 {
+		return nil, errors.New("load needs a query count or a duration")
+	}
+	if config.Transport != "" && config.Transport != "udp" && config.Transport != "tcp" {
+		return nil, errors.New("load transport should be udp or tcp")
+	}
+	workers, window, timeout := config.Workers, config.Window, config.Timeout
+	if workers <= 0 {
+		workers = 1
+	}
+	// ids of the queries in flight must be unique per worker
+	if window <= 0 || window > 0xffff {
+		window = 1
+	}
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	templates := make([][]byte, 0, len(config.Queries))
+	for _, query := range config.Queries {
+		data, err := query.Pack()
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, data)
+	}
+	var stop time.Time
+	start := time.Now()
+	if config.Duration > 0 {
+		stop = start.Add(config.Duration)
+	}
+	workerList := make([]*loadWorker, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		worker := &loadWorker{
+			tcp:     config.Transport == "tcp",
+			window:  window,
+			timeout: timeout,
+			stop:    stop,
+			next:    i,
+			stride:  workers,
+			count:   -1,
+			result:  &LoadResult{Rcodes: make(map[int]uint64)},
+		}
+		if config.Count > 0 {
+			worker.count = config.Count / workers
+			if i < config.Count%workers {
+				worker.count++
+			}
+		}
+		if config.Rate > 0 {
+			worker.interval = time.Duration(int64(time.Second) * int64(workers) / int64(config.Rate))
+		}
+		workerList[i] = worker
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = worker.run(config.Address, templates)
+		}(i)
+	}
+	wg.Wait()
+	result := &LoadResult{Elapsed: time.Since(start), Rcodes: make(map[int]uint64)}
+	var last time.Time
+	for i, worker := range workerList {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if worker.last.After(last) {
+			last = worker.last
+		}
+		result.Sent += worker.result.Sent
+		result.Received += worker.result.Received
+		result.Timeouts += worker.result.Timeouts
+		result.SendErrors += worker.result.SendErrors
+		for rcode, count := range worker.result.Rcodes {
+			result.Rcodes[rcode] += count
+		}
+		result.Latencies = append(result.Latencies, worker.result.Latencies...)
+	}
+	if last.IsZero() == false {
+		result.Elapsed = last.Sub(start)
+	}
+	sort.Slice(result.Latencies, func(i, j int) bool { return result.Latencies[i] < result.Latencies[j] })
+	return result, nil
+}
+
+// loadMaxReconnects bounds the tcp connections in a row the server closes
+// without answering any query
+const loadMaxReconnects = 3
+
+// inflightQuery is a sent query waiting for its response or timeout
+type inflightQuery struct {
+	id   uint16
+	sent time.Time
+}
+
+// loadWorker sends queries from one socket, the sender waits for a free
+// window slot before each query and the receiver and the timeout reaper
+// free the slots. Responses are matched by id, late answers of a query
+// already counted as timeout are ignored. Tcp connections closed by the
+// server are opened again and as many queries as were left unanswered are
+// sent again, the run fails after loadMaxReconnects connections in a row
+// without a response.
+type loadWorker struct {
+	tcp      bool
+	window   int
+	timeout  time.Duration
+	interval time.Duration
+	stop     time.Time
+	next     int
+	stride   int
+	count    int
+	sent     int
+	id       uint16
+	// last is when the last response arrived, queries timing out at the
+	// end of a run do not count as run time
+	last time.Time
+
+	sync.Mutex
+	conn     net.Conn
+	inflight map[uint16]time.Time
+	queue    []inflightQuery
+	slots    chan struct{}
+	sending  int32
+	closed   *sync.Once
+	result   *LoadResult
+}
+
+func (worker *loadWorker) run(address string, templates [][]byte) error {
+	network := "udp"
+	if worker.tcp {
+		network = "tcp"
+	}
+	queries := make([][]byte, len(templates))
+	for i, template := range templates {
+		if worker.tcp {
+			// the length prefix is sent in the same write as the query
+			queries[i] = make([]byte, 2, 2+len(template))
+			binary.BigEndian.PutUint16(queries[i], uint16(len(template)))
+			queries[i] = append(queries[i], template...)
+		} else {
+			queries[i] = append([]byte{}, template...)
+		}
+	}
+	failures := 0
+	for {
+		conn, err := net.DialTimeout(network, address, worker.timeout)
+		if err != nil {
+			return err
+		}
+		received := worker.result.Received
+		if worker.serve(conn, queries) {
+			return nil
+		}
+		if worker.result.Received > received {
+			failures = 0
+			continue
+		}
+		failures++
+		if failures >= loadMaxReconnects {
+			return fmt.Errorf("server %s closed %d connections in a row without response", address, failures)
+		}
+	}
+}
+
+// serve sends queries over conn until all are sent or the server closed
+// the connection, it returns whether all queries are sent
+func (worker *loadWorker) serve(conn net.Conn, queries [][]byte) bool {
+	worker.conn = conn
+	worker.inflight = make(map[uint16]time.Time, worker.window)
+	worker.queue = worker.queue[:0]
+	worker.slots = make(chan struct{}, worker.window)
+	worker.closed = new(sync.Once)
+	// the connection is closed once sending is done and nothing is in flight
+	atomic.StoreInt32(&worker.sending, 1)
+	received := make(chan struct{})
+	go func() {
+		worker.receive()
+		close(received)
+	}()
+	stopReap := make(chan struct{})
+	go worker.reap(stopReap)
+	finished := worker.send(queries, received)
+	atomic.StoreInt32(&worker.sending, 0)
+	worker.closeIfIdle()
+	<-received
+	close(stopReap)
+	worker.Lock()
+	defer worker.Unlock()
+	if finished {
+		// queries left when the server closed the connection are lost
+		worker.result.Timeouts += uint64(len(worker.inflight))
+	} else {
+		// the server did not read the queries left on the closed connection
+		worker.sent -= len(worker.inflight)
+		worker.next -= len(worker.inflight) * worker.stride
+		worker.result.Sent -= uint64(len(worker.inflight))
+	}
+	worker.inflight = nil
+	return finished
+}
+
+// send writes the queries until the count or the stop time is reached, it
+// returns false when the receiver ended before
+func (worker *loadWorker) send(queries [][]byte, received chan struct{}) bool {
+	header := 0
+	if worker.tcp {
+		header = 2
+	}
+	var stopped <-chan time.Time
+	if worker.stop.IsZero() == false {
+		timer := time.NewTimer(time.Until(worker.stop))
+		defer timer.Stop()
+		stopped = timer.C
+	}
+	scheduled := time.Now()
+	for worker.count < 0 || worker.sent < worker.count {
+		if worker.stop.IsZero() == false && time.Now().After(worker.stop) {
+			return true
+		}
+		if worker.interval > 0 {
+			scheduled = scheduled.Add(worker.interval)
+			if wait := time.Until(scheduled); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		select {
+		case worker.slots <- struct{}{}:
+		case <-received:
+			return false
+		case <-stopped:
+			return true
+		}
+		query := queries[worker.next%len(queries)]
+		worker.Lock()
+		for {
+			if _, ok := worker.inflight[worker.id]; ok == false {
+				break
+			}
+			worker.id++
+		}
+		query[header], query[header+1] = byte(worker.id>>8), byte(worker.id)
+		now := time.Now()
+		worker.inflight[worker.id] = now
+		worker.queue = append(worker.queue, inflightQuery{id: worker.id, sent: now})
+		worker.result.Sent++
+		worker.sent++
+		worker.next += worker.stride
+		worker.id++
+		worker.Unlock()
+		if _, err := worker.conn.Write(query); err != nil {
+			// a tcp connection closed by the server is opened again
+			if worker.tcp {
+				worker.conn.Close()
+				<-received
+				return false
+			}
+			worker.Lock()
+			worker.result.SendErrors++
+			worker.Unlock()
+		}
+	}
+	return true
+}
+
+// receive reads responses until the connection is closed
+func (worker *loadWorker) receive() {
+	var reader *bufio.Reader
+	if worker.tcp {
+		reader = bufio.NewReader(worker.conn)
+	}
+	buffer := make([]byte, dns.MaxMsgSize)
+	for {
+		var data []byte
+		if worker.tcp {
+			if _, err := io.ReadFull(reader, buffer[:2]); err != nil {
+				return
+			}
+			data = buffer[:binary.BigEndian.Uint16(buffer)]
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+		} else {
+			n, err := worker.conn.Read(buffer)
+			if err != nil {
+				if isClosedConn(err) {
+					return
+				}
+				// icmp unreachable reports of udp queries are skipped, the
+				// queries time out
+				continue
+			}
+			data = buffer[:n]
+		}
+		if len(data) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(data)
+		now := time.Now()
+		worker.Lock()
+		sent, ok := worker.inflight[id]
+		if ok == true {
+			delete(worker.inflight, id)
+			worker.result.Received++
+			worker.result.Rcodes[int(data[3]&0x0f)]++
+			worker.result.Latencies = append(worker.result.Latencies, now.Sub(sent))
+			worker.last = now
+		}
+		worker.Unlock()
+		if ok == true {
+			<-worker.slots
+			worker.closeIfIdle()
+		}
+	}
+}
+
+// reap counts the queries without response after the timeout
+func (worker *loadWorker) reap(stop chan struct{}) {
+	ticker := time.NewTicker(worker.timeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			expired := 0
+			worker.Lock()
+			for len(worker.queue) > 0 && now.Sub(worker.queue[0].sent) >= worker.timeout {
+				query := worker.queue[0]
+				worker.queue = worker.queue[1:]
+				if sent, ok := worker.inflight[query.id]; ok == true && sent.Equal(query.sent) {
+					delete(worker.inflight, query.id)
+					worker.result.Timeouts++
+					expired++
+				}
+			}
+			worker.Unlock()
+			for i := 0; i < expired; i++ {
+				<-worker.slots
+			}
+			worker.closeIfIdle()
+		}
+	}
+}
+
+// closeIfIdle closes the connection once all queries are sent and no
+// query is in flight, which ends the receiver
+func (worker *loadWorker) closeIfIdle() {
+	if atomic.LoadInt32(&worker.sending) == 1 {
+		return
+	}
+	worker.Lock()
+	idle := len(worker.inflight) == 0
+	worker.Unlock()
+	if idle {
+		worker.closed.Do(func() { worker.conn.Close() })
+	}
+}
+
+func isClosedConn(err error) bool {
+	if netErr, ok := err.(*net.OpError); ok == true {
+		return netErr.Err.Error() == "use of closed network connection"
+	}
+	return false
+}
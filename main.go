@@ -3,26 +3,150 @@ package main
 import (
 	"flag"
 	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
-var listenAt string
+// stringSlice collects a flag which can be set multiple times
+type stringSlice []string
+
+func (s *stringSlice) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+var listenAddrs stringSlice
+var listenConfig ListenConfig
 var syncDuration time.Duration
+var syncLimits SyncLimits
 var zoneFileName string
 var prefer string
 var syncMethod string
 var debug bool
+var xotEnable bool
+var xotCAFile string
+var xotCertFile string
+var xotKeyFile string
+var xotPins stringSlice
+var xotListen string
+var xotServerCertFile string
+var xotServerKeyFile string
+var xotClientCAFile string
+var dotListen string
+var dotCertFile string
+var dotKeyFile string
+var dotIdleTimeout time.Duration
+var dotKeepAlive time.Duration
+var dohListen string
+var dohPath string
+var dohCertFile string
+var dohKeyFile string
+var apiListen string
+var rrlConfig RRLConfig
+var aclFile string
+var identity IdentityConfig
+var cookiesEnable bool
+var edeText bool
+var ednsConfig EDNSConfig
+var ednsBufferSize uint
+var cookieConfig CookieConfig
+var dnstapTarget string
+var dnstapIdentity string
+var queryLogConfig QueryLogConfig
+var queryLogMaxSize int64
+var analyticsEnable bool
+var analyticsCapacity int
+var analyticsInterval time.Duration
+var archiveDir string
+var archiveKeep int
+var trustAnchorFile string
 
 func init() {
 	flag.StringVar(&syncMethod, "type", "axfr", "sync method for zone file only support axfr and http")
 	flag.StringVar(&prefer, "prefer", "", "custom prefer root servers or url for sync data")
 	flag.StringVar(&zoneFileName, "file", "root.zone", "local root zone file name")
-	flag.StringVar(&listenAt, "listen", "0.0.0.0:53", "root dns server listen port")
+	flag.Var(&listenAddrs, "listen", "dns listen address like udp+tcp://0.0.0.0:53 or udp://[::]:53, a bare address serves udp and tcp, can be set multiple times (default 0.0.0.0:53)")
+	flag.IntVar(&listenConfig.Sockets, "listen-sockets", 0, "SO_REUSEPORT sockets per listen address and transport, 0 uses GOMAXPROCS on linux")
+	flag.BoolVar(&listenConfig.PinReaders, "pin-readers", false, "lock the reader goroutine of each udp socket to an os thread")
+	flag.IntVar(&listenConfig.Batch, "udp-batch", 0, "read and write up to this many udp packets per recvmmsg and sendmmsg call on linux, 0 disable")
 	flag.DurationVar(&syncDuration, "interval", time.Minute, "sync original root zone file from upstream server")
+	flag.IntVar(&syncLimits.MaxRecords, "sync-max-records", DefaultSyncLimits.MaxRecords, "abort a zone sync exceeding this number of records, 0 disable")
+	flag.Int64Var(&syncLimits.MaxBytes, "sync-max-bytes", DefaultSyncLimits.MaxBytes, "abort a zone sync exceeding this number of bytes, 0 disable")
 	flag.BoolVar(&debug, "debug", false, "enable debug level log output")
+	flag.BoolVar(&xotEnable, "xot", false, "sync zone using axfr over tls (RFC 9103) from prefer server")
+	flag.StringVar(&xotCAFile, "xot-ca", "", "ca file for verifying the xot upstream server")
+	flag.StringVar(&xotCertFile, "xot-cert", "", "client certificate file for xot mutual tls")
+	flag.StringVar(&xotKeyFile, "xot-key", "", "client key file for xot mutual tls")
+	flag.Var(&xotPins, "xot-pin", "pin upstream certificate or spki as server=base64(sha256), can be repeated")
+	flag.StringVar(&xotListen, "xot-listen", "", "serve zone transfer over tls at this address")
+	flag.StringVar(&xotServerCertFile, "xot-server-cert", "", "certificate file for serving xot")
+	flag.StringVar(&xotServerKeyFile, "xot-server-key", "", "key file for serving xot")
+	flag.StringVar(&xotClientCAFile, "xot-client-ca", "", "require xot clients present a certificate signed by this ca")
+	flag.StringVar(&dotListen, "dot-listen", "", "serve dns over tls (RFC 7858) at this address, e.g. 0.0.0.0:853")
+	flag.StringVar(&dotCertFile, "dot-cert", "", "certificate file for dns over tls, reloaded when rotated")
+	flag.StringVar(&dotKeyFile, "dot-key", "", "key file for dns over tls, reloaded when rotated")
+	flag.DurationVar(&dotIdleTimeout, "dot-idle-timeout", 10*time.Second, "close idle dns over tls connections after this duration")
+	flag.DurationVar(&dotKeepAlive, "dot-keepalive", 30*time.Second, "tcp keepalive period of dns over tls connections")
+	flag.StringVar(&dohListen, "doh-listen", "", "serve dns over https (RFC 8484) at this address, e.g. 0.0.0.0:443")
+	flag.StringVar(&dohPath, "doh-path", "/dns-query", "url path of dns over https endpoint")
+	flag.StringVar(&dohCertFile, "doh-cert", "", "certificate file for dns over https, serve plain http if not set")
+	flag.StringVar(&dohKeyFile, "doh-key", "", "key file for dns over https")
+	flag.StringVar(&apiListen, "http-listen", "", "serve http api such as /resolve at this address, e.g. 127.0.0.1:8053")
+	flag.IntVar(&rrlConfig.ResponsesPerSecond, "rrl-responses-per-second", 0, "rate limit of answers and referrals per client prefix, 0 disable")
+	flag.IntVar(&rrlConfig.NXDomainsPerSecond, "rrl-nxdomains-per-second", 0, "rate limit of nxdomain responses per client prefix, 0 disable")
+	flag.IntVar(&rrlConfig.ErrorsPerSecond, "rrl-errors-per-second", 0, "rate limit of error responses per client prefix, 0 disable")
+	flag.IntVar(&rrlConfig.Window, "rrl-window", 15, "rate limit window in seconds")
+	flag.IntVar(&rrlConfig.Slip, "rrl-slip", 2, "send a truncated response for every n limited responses, 0 always drop")
+	flag.IntVar(&rrlConfig.IPv4PrefixLength, "rrl-ipv4-prefix", 24, "ipv4 prefix length of client used by rate limit")
+	flag.IntVar(&rrlConfig.IPv6PrefixLength, "rrl-ipv6-prefix", 56, "ipv6 prefix length of client used by rate limit")
+	flag.BoolVar(&rrlConfig.LogOnly, "rrl-log-only", false, "only count and log the responses would be limited")
+	flag.StringVar(&dnstapTarget, "dnstap", "", "send dnstap frames to unix:/path, tcp:host:port or file:/path")
+	flag.StringVar(&dnstapIdentity, "dnstap-identity", "", "identity of dnstap frames (default hostname)")
+	flag.StringVar(&queryLogConfig.Filename, "querylog", "", "write json query log to this file, separated from application log")
+	flag.Float64Var(&queryLogConfig.SampleRate, "querylog-sample", 1, "sample rate of query log in (0, 1]")
+	flag.Int64Var(&queryLogMaxSize, "querylog-max-size", 100, "rotate query log when it grows over this size in MB, 0 disable")
+	flag.DurationVar(&queryLogConfig.RotateInterval, "querylog-rotate", 24*time.Hour, "rotate query log after this duration, 0 disable")
+	flag.IntVar(&queryLogConfig.MaxBackups, "querylog-max-backups", 7, "keep this number of rotated query log files, 0 keep all")
+	flag.BoolVar(&queryLogConfig.Compress, "querylog-compress", true, "gzip rotated query log files")
+	flag.BoolVar(&analyticsEnable, "analytics", false, "keep top tlds, nxdomain tlds, qtypes and clients tables at /analytics")
+	flag.IntVar(&analyticsCapacity, "analytics-capacity", 1000, "number of counters of each analytics table")
+	flag.DurationVar(&analyticsInterval, "analytics-window", time.Hour, "roll over analytics tables and log summary after this duration")
+	flag.StringVar(&archiveDir, "archive-dir", "", "keep the last accepted zones in this directory for diff and pin, empty disable")
+	flag.IntVar(&archiveKeep, "archive-keep", 30, "number of accepted zones kept in the archive")
+	flag.StringVar(&trustAnchorFile, "trust-anchor", "", "file of DS records the zone dnskey must match, empty use the root KSK-2017 and KSK-2024")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&identity.Version, "version-string", "rootdns", "answer of version.bind and version.server CHAOS queries, empty to hide")
+	flag.StringVar(&identity.Hostname, "hostname", hostname, "answer of hostname.bind CHAOS query, empty to hide")
+	flag.StringVar(&identity.ServerID, "server-id", hostname, "answer of id.server CHAOS query, empty to hide")
+	flag.StringVar(&identity.NSID, "nsid", "", "instance identifier returned in EDNS NSID option (RFC 5001)")
+	flag.BoolVar(&identity.Hide, "hide-identity", false, "refuse all CHAOS identity queries and never return NSID")
+	flag.BoolVar(&cookiesEnable, "cookies", false, "enable edns cookies (RFC 7873, RFC 9018), clients with valid cookies skip rate limit")
+	flag.StringVar(&cookieConfig.Secret, "cookie-secret", "", "hex encoded 128 bit server cookie secret shared by all instances, random if empty")
+	flag.StringVar(&cookieConfig.PreviousSecret, "cookie-previous-secret", "", "hex encoded previous server cookie secret still accepted during rollover")
+	flag.UintVar(&ednsBufferSize, "edns-buffer-size", DefaultEDNSBufferSize, "advertised edns udp payload size, udp responses are truncated to the smaller of it and the client size")
+	flag.DurationVar(&ednsConfig.TCPIdleTimeout, "tcp-idle-timeout", 10*time.Second, "close idle dns over tcp connections after this duration, announced by edns-tcp-keepalive")
+	flag.BoolVar(&edeText, "ede-text", true, "include explanation text in extended dns errors (RFC 8914)")
+	flag.StringVar(&aclFile, "acl", "", "json file of client acl for query, transfer, notify and admin, reload on SIGHUP")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(runBench(os.Args[2:], os.Stdout))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:], os.Stdout))
+		case "archive":
+			os.Exit(runArchive(os.Args[2:], os.Stdout))
+		}
+	}
 	flag.Parse()
 	// 日志设置：如果不设置级别，默认为warning
 	customFormatter := new(log.TextFormatter)
@@ -36,11 +160,147 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 
 	}
-	manager, err := NewManager(zoneFileName, syncDuration, syncMethod, prefer)
+	if len(listenAddrs) == 0 {
+		listenAddrs = stringSlice{"0.0.0.0:53"}
+	}
+	for _, value := range listenAddrs {
+		addr, err := ParseListenAddr(value)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		listenConfig.Addresses = append(listenConfig.Addresses, addr)
+	}
+	var xot *XoTConfig
+	if xotEnable == true {
+		pins, err := ParseXoTPins(xotPins)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		xot = &XoTConfig{CAFile: xotCAFile, CertFile: xotCertFile, KeyFile: xotKeyFile, Pins: pins}
+	}
+	manager, err := NewManager(zoneFileName, syncDuration, syncMethod, prefer, xot)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	if xotListen != "" {
+		tlsConfig, err := NewXoTServerTLSConfig(xotServerCertFile, xotServerKeyFile, xotClientCAFile)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		manager.ServeXoT(xotListen, tlsConfig)
+	}
+	if dotListen != "" {
+		err := manager.ServeDoT(&DoTConfig{
+			Listen:      dotListen,
+			CertFile:    dotCertFile,
+			KeyFile:     dotKeyFile,
+			IdleTimeout: dotIdleTimeout,
+			KeepAlive:   dotKeepAlive,
+		})
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if dohListen != "" {
+		err := manager.ServeDoH(&DoHConfig{
+			Listen:   dohListen,
+			Path:     dohPath,
+			CertFile: dohCertFile,
+			KeyFile:  dohKeyFile,
+		})
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if apiListen != "" {
+		manager.ServeAPI(apiListen)
+	}
+	manager.SetSyncLimits(syncLimits)
+	manager.SetIdentity(&identity)
+	manager.SetEDEText(edeText)
+	if ednsBufferSize < 512 || ednsBufferSize > 65535 {
+		log.Errorf("edns buffer size should in [512, 65535]")
+		return
+	}
+	ednsConfig.BufferSize = uint16(ednsBufferSize)
+	manager.SetEDNS(ednsConfig)
+	if dnstapTarget != "" {
+		err := manager.EnableDnstap(dnstapTarget, dnstapIdentity)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		go func() {
+			// end the dnstap stream with a STOP frame on shutdown
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			<-signals
+			manager.tap.Close()
+			os.Exit(0)
+		}()
+	}
+	if queryLogConfig.Filename != "" {
+		queryLogConfig.MaxSize = queryLogMaxSize * 1024 * 1024
+		err := manager.EnableQueryLog(queryLogConfig)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if analyticsEnable == true {
+		err := manager.EnableAnalytics(analyticsCapacity, analyticsInterval)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if aclFile != "" {
+		err := manager.EnableACL(aclFile)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGHUP)
+			for range signals {
+				manager.ReloadACL()
+			}
+		}()
+	}
+	if cookiesEnable {
+		err := manager.EnableCookies(cookieConfig)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	if rrlConfig.ResponsesPerSecond > 0 || rrlConfig.NXDomainsPerSecond > 0 || rrlConfig.ErrorsPerSecond > 0 {
+		err := manager.EnableRRL(rrlConfig)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	// a pin restored by the archive is validated against the trust anchor
+	err = manager.EnableTrustAnchor(trustAnchorFile)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if archiveDir != "" {
+		err := manager.EnableArchive(archiveDir, archiveKeep)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
 	log.Infof("start sync from remote dns server")
 	err = manager.Sync()
 	if err != nil {
@@ -48,12 +308,19 @@ func main() {
 		// using local server file if exist
 		err := manager.SyncFromFile()
 		if err != nil {
-			log.Error(err)
-			return
+			log.Errorf("load local zone file fail: %s", err)
+			// the zone compiled into the binary is the last resort
+			err := manager.SyncFromSeed()
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			log.Warning("server will provide dns response using embedded zone data")
+		} else {
+			log.Warning("load local zone file success")
+			log.Warning("server will provide dns response using stale zone data")
 		}
-		log.Warning("load local zone file success")
-		log.Warning("server will provide dns response using stale zone data")
 	}
 	log.Infof("ready to serve root dns query")
-	log.Panic(manager.Run(listenAt))
+	log.Panic(manager.Run(&listenConfig))
 }
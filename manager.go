@@ -1,34 +1,68 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Manager struct {
-	sync.RWMutex
-	zoneStore    *ZoneStore
+	// zone holds the current *zoneSnapshot
+	zone        atomic.Value
+	publishLock sync.Mutex
+	generation  uint64
+	archive     *ZoneArchive
+	// pinLock orders publishing synced zones with pinning and guards synced,
+	// the loaded time of the last synced zone
+	pinLock      sync.Mutex
+	synced       time.Time
 	synchronizer ZoneSynchronizer
 	zoneFile     string
 	syncMethod   string
 	syncDuration time.Duration
+	xotListen    string
+	xotTLSConfig *tls.Config
+	dotConfig    *DoTConfig
+	dotCert      *certReloader
+	dohConfig    *DoHConfig
+	dohCert      *certReloader
+	apiListen    string
+	rrl          *RRL
+	acl          *ACL
+	tap          *Dnstap
+	queryLog     *QueryLog
+	analytics    *Analytics
+	trustAnchors *TrustAnchorSignals
+	anchors      []*dns.DS
+	identity     *IdentityConfig
+	cookies      *Cookies
+	edns         EDNSConfig
+	edeText      bool
+	stats        *Stats
 }
 
-func NewManager(fileName string, duration time.Duration, syncMethod string, preferServer string) (*Manager, error) {
+func NewManager(fileName string, duration time.Duration, syncMethod string, preferServer string, xot *XoTConfig) (*Manager, error) {
 	var synchronizer ZoneSynchronizer
 	var err error
 	if syncMethod == "axfr" {
-		synchronizer, err = NewAXFRSynchronizer(fileName, preferServer)
+		synchronizer, err = NewAXFRSynchronizer(fileName, preferServer, xot)
 		if err != nil {
 			return nil, err
 		}
 		if preferServer == "" {
 			preferServer = DefaultAXFRRootList[0]
 		}
-		log.Infof("using axfr to sync zone data from [%s,..]", preferServer)
+		if xot != nil {
+			log.Infof("using axfr over tls to sync zone data from %s", preferServer)
+		} else {
+			log.Infof("using axfr to sync zone data from [%s,..]", preferServer)
+		}
 	} else if syncMethod == "http" {
 		synchronizer, err = NewHTTPSynchronizer(fileName, preferServer)
 		if err != nil {
@@ -49,18 +83,99 @@ func NewManager(fileName string, duration time.Duration, syncMethod string, pref
 		syncDuration: duration,
 		syncMethod:   syncMethod,
 		synchronizer: synchronizer,
+		stats:        NewStats(),
+		trustAnchors: NewTrustAnchorSignals(),
+		edns:         EDNSConfig{BufferSize: DefaultEDNSBufferSize, TCPIdleTimeout: 10 * time.Second},
 	}
 	return &manager, nil
 }
 
+// ServeXoT enables serving zone transfer over tls at listenAt
+func (manager *Manager) ServeXoT(listenAt string, config *tls.Config) {
+	manager.xotListen = listenAt
+	manager.xotTLSConfig = config
+}
+
+// EnableRRL enables response rate limiting for udp queries
+func (manager *Manager) EnableRRL(config RRLConfig) error {
+	rrl, err := NewRRL(config)
+	if err != nil {
+		return err
+	}
+	manager.rrl = rrl
+	return nil
+}
+
+// EnableCookies answers and validates edns cookies with the server secrets
+func (manager *Manager) EnableCookies(config CookieConfig) error {
+	cookies, err := NewCookies(config)
+	if err != nil {
+		return err
+	}
+	manager.cookies = cookies
+	return nil
+}
+
+// EnableACL loads client acl from filename
+func (manager *Manager) EnableACL(filename string) error {
+	acl, err := NewACLFromFile(filename)
+	if err != nil {
+		return err
+	}
+	manager.acl = acl
+	return nil
+}
+
+// EnableDnstap sends query and response frames to the dnstap target
+func (manager *Manager) EnableDnstap(target string, identity string) error {
+	tap, err := NewDnstap(target, identity)
+	if err != nil {
+		return err
+	}
+	manager.tap = tap
+	return nil
+}
+
+// EnableQueryLog writes sampled queries into a json query log
+func (manager *Manager) EnableQueryLog(config QueryLogConfig) error {
+	queryLog, err := NewQueryLog(config)
+	if err != nil {
+		return err
+	}
+	manager.queryLog = queryLog
+	return nil
+}
+
+// EnableAnalytics keeps top-N query tables rolled over every interval
+func (manager *Manager) EnableAnalytics(capacity int, interval time.Duration) error {
+	if capacity <= 0 || interval <= 0 {
+		return errors.New("analytics capacity and window should greater than 0")
+	}
+	manager.analytics = NewAnalytics(capacity, interval)
+	return nil
+}
+
+// SetSyncLimits bounds the records and bytes accepted from a zone sync
+func (manager *Manager) SetSyncLimits(limits SyncLimits) {
+	manager.synchronizer.SetLimits(limits)
+}
+
+// SetIdentity sets the values of CHAOS identity queries and NSID
+func (manager *Manager) SetIdentity(identity *IdentityConfig) {
+	manager.identity = identity
+}
+
+// Sync downloads the zone and publishes it, a download still running at
+// the next sync interval is aborted
 func (manager *Manager) Sync() error {
-	data, err := manager.synchronizer.Download()
+	ctx, cancel := context.WithTimeout(context.Background(), manager.syncDuration)
+	defer cancel()
+	data, err := manager.synchronizer.Download(ctx)
 	if err != nil {
 		return err
 	}
-	manager.Lock()
-	manager.zoneStore = data
-	manager.Unlock()
+	manager.archiveZone(data)
+	manager.setSyncedZone(data, time.Now())
 	return manager.synchronizer.SyncToFile(data)
 }
 
@@ -69,48 +184,165 @@ func (manager *Manager) SyncFromFile() error {
 	if err != nil {
 		return err
 	}
-	manager.zoneStore = data
+	// the zone file is as old as its last write
+	loaded := time.Now()
+	if info, err := os.Stat(manager.zoneFile); err == nil {
+		loaded = info.ModTime()
+	}
+	manager.archiveZone(data)
+	manager.setSyncedZone(data, loaded)
 	return nil
 }
 
+// setZone validates and publishes the zone data, a zone failing validation
+// is still served but its answers carry the DNSSEC Bogus error
+func (manager *Manager) setZone(data *ZoneStore, loaded time.Time) {
+	snapshot := manager.newSnapshot(data, loaded)
+	manager.publish(snapshot)
+	log.Debugf("publish zone serial %d generation %d", data.Serial(), snapshot.generation)
+}
+
+// newSnapshot validates data and builds its snapshot with the response cache
+func (manager *Manager) newSnapshot(data *ZoneStore, loaded time.Time) *zoneSnapshot {
+	snapshot := &zoneSnapshot{store: data, loaded: loaded}
+	validate := data.Validate
+	if manager.anchors != nil {
+		validate = func(now time.Time) error { return data.validateAnchor(manager.anchors, now) }
+	}
+	if err := validate(time.Now()); err != nil {
+		log.Warnf("zone serial %d validation fail: %s", data.Serial(), err)
+		snapshot.bogus = err.Error()
+	}
+	snapshot.cache = manager.buildResponseCache(data)
+	return snapshot
+}
+
 func (manager *Manager) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	snapshot := manager.snapshot()
+	if manager.writeCached(w, r, snapshot) {
+		return
+	}
 	m := new(dns.Msg)
 	m.SetReply(r)
 	if len(r.Question) == 0 {
 		w.WriteMsg(m)
 		return
 	}
+	switch r.Question[0].Qclass {
+	case dns.ClassINET, dns.ClassANY:
+	case dns.ClassCHAOS:
+		if ede := manager.handleChaos(m, r.Question[0]); ede != nil {
+			manager.writeResponse(w, r, m, ede)
+			return
+		}
+		manager.writeResponse(w, r, m)
+		return
+	default:
+		m.Rcode = dns.RcodeRefused
+		manager.writeResponse(w, r, m, manager.edeOption(EDENotAuthoritative, "only IN and CH classes are served"))
+		return
+	}
 	domain := r.Question[0].Name
 	qType := r.Question[0].Qtype
-	do := r.IsEdns0().Do()
-	manager.RLock()
-	defer manager.RUnlock()
-	if manager.zoneStore == nil {
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	if snapshot == nil {
 		m.Rcode = dns.RcodeServerFailure
+		manager.writeResponse(w, r, m, manager.edeOption(EDENotReady, "zone data is not loaded"))
+		return
+	}
+	now := time.Now()
+	if snapshot.expired(now) {
+		m.Rcode = dns.RcodeServerFailure
+		manager.writeResponse(w, r, m, manager.expiredError(snapshot, now))
+		return
+	}
+	result := snapshot.store.Lookup(domain, qType, do)
+	m.Answer = result.Answer
+	m.Ns = result.Ns
+	// the additional section is shared by all queries, capping it makes
+	// the opt record appended later copy instead of writing into the store
+	m.Extra = result.Additional[:len(result.Additional):len(result.Additional)]
+	m.Authoritative = result.AA
+	m.Rcode = result.Rcode
+	manager.writeResponse(w, r, m, manager.zoneErrors(snapshot, now)...)
+}
+
+// writeResponse adds the edns options of response m to query r and writes it
+func (manager *Manager) writeResponse(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, options ...dns.EDNS0) {
+	queryOpt := r.IsEdns0()
+	if queryOpt == nil {
+		// edns options are only sent to clients supporting edns (RFC 6891)
 		w.WriteMsg(m)
 		return
 	}
-	answer, ns, additional, aa := manager.zoneStore.Query(domain, qType, do)
-	m.Answer = answer
-	m.Ns = ns
-	m.Extra = additional
-	m.Authoritative = aa
-	m.SetEdns0(4096, false)
+	m.SetEdns0(manager.ednsBufferSize(), queryOpt.Do())
+	opt := m.IsEdns0()
+	if nsid := manager.nsidOption(r); nsid != nil {
+		opt.Option = append(opt.Option, nsid)
+	}
+	opt.Option = append(opt.Option, options...)
 	w.WriteMsg(m)
 }
 
-func (manager *Manager) Run(listenAt string) error {
+func (manager *Manager) Run(listen *ListenConfig) error {
 	go func() {
 		for range time.NewTicker(manager.syncDuration).C {
 			err := manager.Sync()
 			if err != nil {
 				log.Errorf("sync fail: %s ", err)
+				manager.warnEmbedded(time.Now())
+			}
+			for transport, counter := range manager.stats.Snapshot() {
+				log.Debugf("transport %s: queries=%d responses=%d write_errors=%d bytes_out=%d",
+					transport, counter.Queries, counter.Responses, counter.WriteErrors, counter.BytesOut)
+			}
+			for _, socket := range manager.stats.Sockets() {
+				log.Debugf("socket %s %s #%d: queries=%d bytes_in=%d read_errors=%d batches=%d write_errors=%d",
+					socket.Transport, socket.Address, socket.Index, socket.Queries, socket.BytesIn, socket.ReadErrors, socket.Batches, socket.WriteErrors)
+			}
+			if manager.rrl != nil {
+				rrlStats := manager.rrl.Stats()
+				log.Debugf("rrl: limited=%d dropped=%d slipped=%d log_only=%d evicted=%d",
+					rrlStats.Limited, rrlStats.Dropped, rrlStats.Slipped, rrlStats.LogOnly, rrlStats.Evicted)
+			}
+			if manager.tap != nil {
+				tapStats := manager.tap.Stats()
+				log.Debugf("dnstap: written=%d dropped=%d", tapStats.Written, tapStats.Dropped)
 			}
 		}
 	}()
-	server := dns.Server{Addr: listenAt, Net: "udp"}
-	dns.HandleFunc(".", manager.handleRequest)
-	log.Infof("start dns server at : %s", listenAt)
-	err := server.ListenAndServe()
-	return err
+	if manager.xotListen != "" {
+		go func() {
+			xotServer := dns.Server{
+				Addr:      manager.xotListen,
+				Net:       "tcp-tls",
+				TLSConfig: manager.xotTLSConfig,
+				Handler:   manager.handler("xot", manager.handleTransfer),
+			}
+			log.Infof("start zone transfer over tls server at : %s", manager.xotListen)
+			log.Error(xotServer.ListenAndServe())
+		}()
+	}
+	if manager.dotConfig != nil {
+		go func() {
+			log.Error(manager.runDoT())
+		}()
+	}
+	if manager.dohConfig != nil {
+		go func() {
+			log.Error(manager.runDoH())
+		}()
+	}
+	if manager.analytics != nil {
+		go manager.analytics.run()
+	}
+	if manager.apiListen != "" {
+		go func() {
+			log.Error(manager.runAPI())
+		}()
+	}
+	return manager.runListeners(listen)
 }
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+// link types of the captured frames
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// maxCaptureRecord limits the memory of one captured frame or block
+const maxCaptureRecord = 1 << 18
+
+// captureReader reads the frames of a pcap or pcapng file, next returns
+// io.EOF at the end
+type captureReader interface {
+	next() (frame []byte, linkType uint32, captured time.Time, err error)
+}
+
+// openCapture detects the format of a capture file by its magic number
+func openCapture(reader io.Reader) (captureReader, error) {
+	buffered := bufio.NewReader(reader)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("read capture header fail: %s", err)
+	}
+	if binary.BigEndian.Uint32(magic) == 0x0a0d0d0a {
+		return &pcapngReader{reader: buffered}, nil
+	}
+	return newPcapReader(buffered)
+}
+
+// pcapReader reads the packets of a classic pcap file
+type pcapReader struct {
+	reader   io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+	header   [16]byte
+}
+
+func newPcapReader(reader io.Reader) (*pcapReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header fail: %s", err)
+	}
+	pcap := &pcapReader{reader: reader}
+	switch {
+	case binary.LittleEndian.Uint32(header[:]) == 0xa1b2c3d4:
+		pcap.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header[:]) == 0xa1b2c3d4:
+		pcap.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(header[:]) == 0xa1b23c4d:
+		pcap.order, pcap.nano = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(header[:]) == 0xa1b23c4d:
+		pcap.order, pcap.nano = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+	pcap.linkType = pcap.order.Uint32(header[20:])
+	return pcap, nil
+}
+
+func (pcap *pcapReader) next() ([]byte, uint32, time.Time, error) {
+	if _, err := io.ReadFull(pcap.reader, pcap.header[:]); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	seconds := int64(pcap.order.Uint32(pcap.header[0:]))
+	fraction := int64(pcap.order.Uint32(pcap.header[4:]))
+	if pcap.nano == false {
+		fraction *= 1000
+	}
+	length := pcap.order.Uint32(pcap.header[8:])
+	if length > maxCaptureRecord {
+		return nil, 0, time.Time{}, fmt.Errorf("pcap record of %d bytes is too large", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(pcap.reader, frame); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return frame, pcap.linkType, time.Unix(seconds, fraction), nil
+}
+
+// pcapngInterface is an interface description of a pcapng section,
+// resolution is the number of timestamp units per second
+type pcapngInterface struct {
+	linkType   uint32
+	resolution float64
+}
+
+// pcapngReader reads the enhanced and simple packet blocks of a pcapng
+// file, each section sets its byte order and interfaces
+type pcapngReader struct {
+	reader     io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+}
+
+func (pcapng *pcapngReader) next() ([]byte, uint32, time.Time, error) {
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(pcapng.reader, header[:]); err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		blockType := binary.BigEndian.Uint32(header[:])
+		if blockType == 0x0a0d0d0a {
+			// the section header is symmetric in both byte orders, its
+			// byte order magic follows the block length
+			var magic [4]byte
+			if _, err := io.ReadFull(pcapng.reader, magic[:]); err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic[:]) == 0x1a2b3c4d:
+				pcapng.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic[:]) == 0x1a2b3c4d:
+				pcapng.order = binary.BigEndian
+			default:
+				return nil, 0, time.Time{}, errors.New("invalid pcapng byte order magic")
+			}
+			pcapng.interfaces = pcapng.interfaces[:0]
+			length := pcapng.order.Uint32(header[4:])
+			if length < 16 || length > maxCaptureRecord {
+				return nil, 0, time.Time{}, fmt.Errorf("invalid pcapng section header length %d", length)
+			}
+			if _, err := io.CopyN(ioutil.Discard, pcapng.reader, int64(length-12)); err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			continue
+		}
+		if pcapng.order == nil {
+			return nil, 0, time.Time{}, errors.New("pcapng block before section header")
+		}
+		blockType = pcapng.order.Uint32(header[:])
+		length := pcapng.order.Uint32(header[4:])
+		if length < 12 || length%4 != 0 || length > maxCaptureRecord {
+			return nil, 0, time.Time{}, fmt.Errorf("invalid pcapng block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(pcapng.reader, body); err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		body = body[:len(body)-4]
+		switch blockType {
+		case 1:
+			if len(body) < 8 {
+				return nil, 0, time.Time{}, errors.New("short pcapng interface block")
+			}
+			pcapng.interfaces = append(pcapng.interfaces, pcapngInterface{
+				linkType:   uint32(pcapng.order.Uint16(body[0:])),
+				resolution: pcapngResolution(pcapng.order, body[8:]),
+			})
+		case 3:
+			// simple packet blocks belong to the first interface
+			if len(pcapng.interfaces) == 0 || len(body) < 4 {
+				continue
+			}
+			length := pcapng.order.Uint32(body[0:])
+			frame := body[4:]
+			if int(length) < len(frame) {
+				frame = frame[:length]
+			}
+			return frame, pcapng.interfaces[0].linkType, time.Time{}, nil
+		case 6:
+			if len(body) < 20 {
+				continue
+			}
+			index := int(pcapng.order.Uint32(body[0:]))
+			if index >= len(pcapng.interfaces) {
+				continue
+			}
+			captured := int(pcapng.order.Uint32(body[12:]))
+			if captured > len(body)-20 {
+				captured = len(body) - 20
+			}
+			units := uint64(pcapng.order.Uint32(body[4:]))<<32 | uint64(pcapng.order.Uint32(body[8:]))
+			resolution := pcapng.interfaces[index].resolution
+			seconds := math.Floor(float64(units) / resolution)
+			nanos := (float64(units) - seconds*resolution) * 1e9 / resolution
+			return body[20 : 20+captured], pcapng.interfaces[index].linkType, time.Unix(int64(seconds), int64(nanos)), nil
+		}
+	}
+}
+
+// pcapngResolution returns the timestamp units per second of the
+// if_tsresol option, microseconds by default
+func pcapngResolution(order binary.ByteOrder, options []byte) float64 {
+	for len(options) >= 4 {
+		code := order.Uint16(options[0:])
+		length := int(order.Uint16(options[2:]))
+		if code == 0 || len(options) < 4+length {
+			break
+		}
+		if code == 9 && length >= 1 {
+			value := options[4]
+			if value&0x80 != 0 {
+				return math.Pow(2, float64(value&0x7f))
+			}
+			return math.Pow(10, float64(value))
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	return 1e6
+}
+
+// capturedMessage is a dns message decoded from a capture
+type capturedMessage struct {
+	Time      time.Time
+	Transport string
+	Src       net.IP
+	Dst       net.IP
+	SrcPort   uint16
+	DstPort   uint16
+	Data      []byte
+}
+
+// capturedSegment is the udp or tcp payload of a captured ip packet
+type capturedSegment struct {
+	protocol byte
+	src      net.IP
+	dst      net.IP
+	srcPort  uint16
+	dstPort  uint16
+	seq      uint32
+	flags    byte
+	payload  []byte
+}
+
+// tcp flags used by stream reassembly
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+)
+
+// decodeFrame returns the udp or tcp segment carried by frame, frames of
+// other protocols and ip fragments return nil
+func decodeFrame(linkType uint32, frame []byte) *capturedSegment {
+	var packet []byte
+	switch linkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:])
+		packet = frame[14:]
+		// 802.1q vlan tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(packet) >= 4 {
+			etherType = binary.BigEndian.Uint16(packet[2:])
+			packet = packet[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil
+		}
+		packet = frame[16:]
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return nil
+		}
+		packet = frame[4:]
+	case linkTypeRaw:
+		packet = frame
+	default:
+		return nil
+	}
+	return decodeIP(packet)
+}
+
+// decodeIP decodes the transport header of an ipv4 or ipv6 packet
+func decodeIP(packet []byte) *capturedSegment {
+	if len(packet) == 0 {
+		return nil
+	}
+	segment := &capturedSegment{}
+	var payload []byte
+	switch packet[0] >> 4 {
+	case 4:
+		headerLength := int(packet[0]&0x0f) * 4
+		if headerLength < 20 || len(packet) < headerLength {
+			return nil
+		}
+		// fragments other than a complete datagram are skipped
+		if binary.BigEndian.Uint16(packet[6:])&0x3fff != 0 {
+			return nil
+		}
+		total := int(binary.BigEndian.Uint16(packet[2:]))
+		if total < headerLength || total > len(packet) {
+			total = len(packet)
+		}
+		segment.protocol = packet[9]
+		segment.src, segment.dst = net.IP(packet[12:16]), net.IP(packet[16:20])
+		payload = packet[headerLength:total]
+	case 6:
+		if len(packet) < 40 {
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(packet[4:]))
+		if 40+length > len(packet) {
+			length = len(packet) - 40
+		}
+		segment.protocol = packet[6]
+		segment.src, segment.dst = net.IP(packet[8:24]), net.IP(packet[24:40])
+		payload = packet[40 : 40+length]
+		// hop by hop, routing and destination options headers
+		for segment.protocol == 0 || segment.protocol == 43 || segment.protocol == 60 {
+			if len(payload) < 8 {
+				return nil
+			}
+			extension := 8 + int(payload[1])*8
+			if len(payload) < extension {
+				return nil
+			}
+			segment.protocol = payload[0]
+			payload = payload[extension:]
+		}
+	default:
+		return nil
+	}
+	switch segment.protocol {
+	case 17:
+		if len(payload) < 8 {
+			return nil
+		}
+		segment.payload = payload[8:]
+		if length := int(binary.BigEndian.Uint16(payload[4:])); length >= 8 && length <= len(payload) {
+			segment.payload = payload[8:length]
+		}
+	case 6:
+		if len(payload) < 20 {
+			return nil
+		}
+		offset := int(payload[12]>>4) * 4
+		if offset < 20 || offset > len(payload) {
+			return nil
+		}
+		segment.seq = binary.BigEndian.Uint32(payload[4:])
+		segment.flags = payload[13]
+		segment.payload = payload[offset:]
+	default:
+		return nil
+	}
+	segment.srcPort = binary.BigEndian.Uint16(payload[0:])
+	segment.dstPort = binary.BigEndian.Uint16(payload[2:])
+	return segment
+}
+
+// tcpFlow identifies one direction of a tcp connection
+type tcpFlow struct {
+	src     string
+	dst     string
+	srcPort uint16
+	dstPort uint16
+}
+
+// tcpStream reassembles one direction of a tcp connection, pending holds
+// segments received ahead of the next sequence number
+type tcpStream struct {
+	next    uint32
+	data    []byte
+	pending map[uint32][]byte
+}
+
+// tcpReassembler splits the dns over tcp streams of a capture into
+// messages, connections seen without their handshake start at the first
+// captured segment
+type tcpReassembler struct {
+	streams map[tcpFlow]*tcpStream
+}
+
+func newTCPReassembler() *tcpReassembler {
+	return &tcpReassembler{streams: make(map[tcpFlow]*tcpStream)}
+}
+
+// add returns the dns messages completed by segment
+func (reassembler *tcpReassembler) add(segment *capturedSegment) [][]byte {
+	flow := tcpFlow{src: string(segment.src), dst: string(segment.dst), srcPort: segment.srcPort, dstPort: segment.dstPort}
+	stream, ok := reassembler.streams[flow]
+	if segment.flags&tcpSYN != 0 {
+		stream = &tcpStream{next: segment.seq + 1, pending: make(map[uint32][]byte)}
+		reassembler.streams[flow] = stream
+		return nil
+	}
+	if ok == false {
+		if len(segment.payload) == 0 {
+			return nil
+		}
+		stream = &tcpStream{next: segment.seq, pending: make(map[uint32][]byte)}
+		reassembler.streams[flow] = stream
+	}
+	if segment.flags&(tcpFIN|tcpRST) != 0 {
+		defer delete(reassembler.streams, flow)
+	}
+	if len(segment.payload) > 0 {
+		stream.pending[segment.seq] = segment.payload
+	}
+	for {
+		progress := false
+		for seq, payload := range stream.pending {
+			// sequence numbers wrap, a retransmission is behind next
+			offset := int32(stream.next - seq)
+			if offset < 0 {
+				continue
+			}
+			delete(stream.pending, seq)
+			if int(offset) < len(payload) {
+				stream.data = append(stream.data, payload[offset:]...)
+				stream.next += uint32(len(payload) - int(offset))
+				progress = true
+			}
+		}
+		if progress == false {
+			break
+		}
+	}
+	messages := make([][]byte, 0)
+	for len(stream.data) >= 2 {
+		length := int(binary.BigEndian.Uint16(stream.data))
+		if len(stream.data) < 2+length {
+			break
+		}
+		messages = append(messages, stream.data[2:2+length])
+		stream.data = stream.data[2+length:]
+	}
+	if len(stream.data) == 0 {
+		stream.data = nil
+	}
+	return messages
+}
+
+// readCapture returns the dns messages to or from port 53 in a pcap or
+// pcapng file, udp datagrams and reassembled tcp streams over ipv4 and ipv6
+func readCapture(filename string) ([]*capturedMessage, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	capture, err := openCapture(file)
+	if err != nil {
+		return nil, err
+	}
+	reassembler := newTCPReassembler()
+	messages := make([]*capturedMessage, 0)
+	for {
+		frame, linkType, captured, err := capture.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// captures cut while writing end in a partial record
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		segment := decodeFrame(linkType, frame)
+		if segment == nil || (segment.srcPort != 53 && segment.dstPort != 53) {
+			continue
+		}
+		message := &capturedMessage{
+			Time:    captured,
+			Src:     segment.src,
+			Dst:     segment.dst,
+			SrcPort: segment.srcPort,
+			DstPort: segment.dstPort,
+		}
+		if segment.protocol == 17 {
+			message.Transport = "udp"
+			message.Data = segment.payload
+			messages = append(messages, message)
+			continue
+		}
+		for _, data := range reassembler.add(segment) {
+			tcpMessage := *message
+			tcpMessage.Transport = "tcp"
+			tcpMessage.Data = data
+			messages = append(messages, &tcpMessage)
+		}
+	}
+	return messages, nil
+}
+
+// readCaptureQueries returns the dns queries sent to port 53 in a capture
+func readCaptureQueries(filename string) ([]*dns.Msg, error) {
+	messages, err := readCapture(filename)
+	if err != nil {
+		return nil, err
+	}
+	queries := make([]*dns.Msg, 0)
+	for _, message := range messages {
+		if message.DstPort != 53 {
+			continue
+		}
+		query := new(dns.Msg)
+		if query.Unpack(message.Data) != nil || query.Response || len(query.Question) != 1 {
+			continue
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
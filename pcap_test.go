@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testUDPPacket builds an ipv4 or ipv6 udp packet without checksums
+func testUDPPacket(src string, dst string, srcPort uint16, dstPort uint16, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP.To4() != nil {
+		packet := make([]byte, 20, 20+len(udp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(udp)))
+		packet[8], packet[9] = 64, 17
+		copy(packet[12:], srcIP.To4())
+		copy(packet[16:], dstIP.To4())
+		return append(packet, udp...)
+	}
+	packet := make([]byte, 40, 40+len(udp))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(udp)))
+	packet[6], packet[7] = 17, 64
+	copy(packet[8:], srcIP)
+	copy(packet[24:], dstIP)
+	return append(packet, udp...)
+}
+
+// testTCPPacket builds an ipv4 or ipv6 tcp segment without checksums
+func testTCPPacket(src string, dst string, srcPort uint16, dstPort uint16, seq uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12], tcp[13] = 5<<4, flags
+	tcp = append(tcp, payload...)
+	// reuse the udp packet layout and patch the protocol
+	packet := testUDPPacket(src, dst, srcPort, dstPort, nil)
+	if packet[0]>>4 == 4 {
+		packet = append(packet[:20], tcp...)
+		binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+		packet[9] = 6
+		return packet
+	}
+	packet = append(packet[:40], tcp...)
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+	packet[6] = 6
+	return packet
+}
+
+// testEthernetFrame wraps packet in an ethernet frame
+func testEthernetFrame(packet []byte) []byte {
+	frame := make([]byte, 14, 14+len(packet))
+	etherType := uint16(0x0800)
+	if packet[0]>>4 == 6 {
+		etherType = 0x86dd
+	}
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	return append(frame, packet...)
+}
+
+// writeTestPcap writes frames to a little endian classic pcap file
+func writeTestPcap(t *testing.T, dir string, linkType uint32, frames [][]byte) string {
+	data := make([]byte, 24)
+	binary.LittleEndian.PutUint32(data[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(data[4:], 2)
+	binary.LittleEndian.PutUint16(data[6:], 4)
+	binary.LittleEndian.PutUint32(data[16:], 65535)
+	binary.LittleEndian.PutUint32(data[20:], linkType)
+	for i, frame := range frames {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], uint32(1600000000+i))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+		data = append(data, record...)
+		data = append(data, frame...)
+	}
+	filename := filepath.Join(dir, "capture.pcap")
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// writeTestPcapng writes frames to a big endian pcapng file with one
+// interface of nanosecond resolution
+func writeTestPcapng(t *testing.T, dir string, linkType uint16, frames [][]byte) string {
+	block := func(blockType uint32, body []byte) []byte {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		data := make([]byte, 8, 12+len(body))
+		binary.BigEndian.PutUint32(data[0:], blockType)
+		binary.BigEndian.PutUint32(data[4:], uint32(12+len(body)))
+		data = append(data, body...)
+		return append(data, data[4:8]...)
+	}
+	section := make([]byte, 16)
+	binary.BigEndian.PutUint32(section[0:], 0x1a2b3c4d)
+	binary.BigEndian.PutUint16(section[4:], 1)
+	binary.BigEndian.PutUint64(section[8:], 0xffffffffffffffff)
+	data := block(0x0a0d0d0a, section)
+	// if_tsresol 9 and end of options
+	iface := []byte{0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 9, 0, 1, 9, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(iface[0:], linkType)
+	data = append(data, block(1, iface)...)
+	// a block of an unknown type is skipped
+	data = append(data, block(0x0bad, []byte{1, 2, 3, 4})...)
+	for i, frame := range frames {
+		packet := make([]byte, 20, 20+len(frame))
+		nanos := uint64(1600000000+i) * 1e9
+		binary.BigEndian.PutUint32(packet[4:], uint32(nanos>>32))
+		binary.BigEndian.PutUint32(packet[8:], uint32(nanos))
+		binary.BigEndian.PutUint32(packet[12:], uint32(len(frame)))
+		binary.BigEndian.PutUint32(packet[16:], uint32(len(frame)))
+		data = append(data, block(6, append(packet, frame...))...)
+	}
+	filename := filepath.Join(dir, "capture.pcapng")
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadCaptureQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pack := func(name string, qType uint16, response bool) []byte {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qType)
+		m.Response = response
+		data, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	frames := [][]byte{
+		testEthernetFrame(testUDPPacket("192.0.2.1", "192.0.2.53", 40000, 53, pack("com.", dns.TypeNS, false))),
+		testEthernetFrame(testUDPPacket("192.0.2.53", "192.0.2.1", 53, 40000, pack("com.", dns.TypeNS, true))),
+		testEthernetFrame(testUDPPacket("2001:db8::1", "2001:db8::53", 40001, 53, pack("xyz.", dns.TypeAAAA, false))),
+		testEthernetFrame(testUDPPacket("192.0.2.1", "192.0.2.53", 40002, 5353, pack("org.", dns.TypeNS, false))),
+		testEthernetFrame(testUDPPacket("192.0.2.1", "192.0.2.53", 40003, 53, []byte{1, 2, 3})),
+	}
+	filename := writeTestPcap(t, dir, linkTypeEthernet, frames)
+	// a capture cut while writing ends in a partial record
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{1, 2, 3, 4, 5})
+	file.Close()
+
+	queries, err := readCaptureQueries(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 || queries[0].Question[0].Name != "com." || queries[1].Question[0].Name != "xyz." {
+		t.Fatalf("expect com. and xyz. queries from capture but got %v", queries)
+	}
+
+	raw := writeTestPcap(t, dir, linkTypeRaw, [][]byte{testUDPPacket("2001:db8::1", "2001:db8::53", 40001, 53, pack("net.", dns.TypeDS, false))})
+	queries, err = readCaptureQueries(raw)
+	if err != nil || len(queries) != 1 || queries[0].Question[0].Qtype != dns.TypeDS {
+		t.Errorf("expect DS query from raw ip capture but got %v %s", queries, err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("not a capture file at all"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCaptureQueries(filename); err == nil {
+		t.Error("expect error reading a file which is not a capture")
+	}
+}
+
+func TestReadCaptureTCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stream := func(names ...string) []byte {
+		data := make([]byte, 0)
+		for _, name := range names {
+			m := new(dns.Msg)
+			m.SetQuestion(name, dns.TypeNS)
+			packed, err := m.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, byte(len(packed)>>8), byte(len(packed)))
+			data = append(data, packed...)
+		}
+		return data
+	}
+	// two pipelined queries split over segments delivered out of order
+	// and retransmitted, the second connection misses its handshake
+	first := stream("com.", "net.")
+	second := stream("xyz.")
+	client, server := "2001:db8::1", "2001:db8::53"
+	frames := [][]byte{
+		testTCPPacket(client, server, 40000, 53, 1000, tcpSYN, nil),
+		testTCPPacket(client, server, 40000, 53, 1001, 0, first[:10]),
+		testTCPPacket(client, server, 40000, 53, 1021, 0, first[20:]),
+		testTCPPacket(client, server, 40000, 53, 1001, 0, first[:15]),
+		testTCPPacket(client, server, 40000, 53, 1011, 0, first[10:20]),
+		testTCPPacket("192.0.2.1", "192.0.2.53", 40001, 53, 0xfffffffe, 0, second[:3]),
+		testTCPPacket("192.0.2.1", "192.0.2.53", 40001, 53, 1, tcpFIN, second[3:]),
+		testTCPPacket(client, server, 40000, 53, 1001+uint32(len(first)), tcpFIN, nil),
+	}
+	for _, filename := range []string{
+		writeTestPcap(t, dir, linkTypeRaw, frames),
+		writeTestPcapng(t, dir, linkTypeRaw, frames),
+	} {
+		messages, err := readCapture(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0)
+		for _, message := range messages {
+			m := new(dns.Msg)
+			if err := m.Unpack(message.Data); err != nil || message.Transport != "tcp" {
+				t.Fatalf("expect tcp dns message in %s but got %s %s", filename, message.Transport, err)
+			}
+			names = append(names, m.Question[0].Name)
+		}
+		if len(names) != 3 || names[0] != "com." || names[1] != "net." || names[2] != "xyz." {
+			t.Errorf("expect com. net. xyz. reassembled from %s but got %v", filename, names)
+		}
+	}
+	pcapng := writeTestPcapng(t, dir, linkTypeEthernet, [][]byte{testEthernetFrame(testUDPPacket("192.0.2.1", "192.0.2.53", 40000, 53, stream("org.")[2:]))})
+	messages, err := readCapture(pcapng)
+	if err != nil || len(messages) != 1 || messages[0].Time.Unix() != 1600000000 || messages[0].Transport != "udp" {
+		t.Errorf("expect one udp message at 1600000000 from pcapng but got %v %s", messages, err)
+	}
+}
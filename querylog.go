@@ -0,0 +1,243 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryLogConfig holds settings of the json query log, MaxSize is in bytes
+// and zero MaxSize or RotateInterval disables that kind of rotation
+type QueryLogConfig struct {
+	Filename       string
+	SampleRate     float64
+	MaxSize        int64
+	RotateInterval time.Duration
+	MaxBackups     int
+	Compress       bool
+}
+
+// QueryLog writes sampled queries as line delimited json, it uses its own
+// logrus logger so the entries never mix with the application log
+type QueryLog struct {
+	config QueryLogConfig
+	logger *log.Logger
+	writer *rotateWriter
+}
+
+func NewQueryLog(config QueryLogConfig) (*QueryLog, error) {
+	if config.SampleRate <= 0 || config.SampleRate > 1 {
+		return nil, errors.New("query log sample rate should in (0, 1]")
+	}
+	writer, err := newRotateWriter(config)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.New()
+	logger.SetOutput(writer)
+	logger.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	logger.SetLevel(log.InfoLevel)
+	return &QueryLog{config: config, logger: logger, writer: writer}, nil
+}
+
+// Log writes the event if it is sampled
+func (queryLog *QueryLog) Log(event *queryEvent) {
+	if queryLog.config.SampleRate < 1 && rand.Float64() >= queryLog.config.SampleRate {
+		return
+	}
+	query := event.Request
+	if query == nil || len(query.Question) == 0 {
+		return
+	}
+	fields := log.Fields{
+		"client":     addrIP(event.Client).String(),
+		"transport":  event.Transport,
+		"qname":      query.Question[0].Name,
+		"qtype":      dns.TypeToString[query.Question[0].Qtype],
+		"qclass":     dns.ClassToString[query.Question[0].Qclass],
+		"flags":      queryFlags(query),
+		"latency_us": event.End.Sub(event.Start).Microseconds(),
+		"serial":     event.Serial,
+		"generation": event.Generation,
+	}
+	if event.Reply != nil {
+		fields["rcode"] = dns.RcodeToString[event.Reply.Rcode]
+		fields["answer"] = len(event.Reply.Answer)
+		fields["authority"] = len(event.Reply.Ns)
+		fields["additional"] = len(event.Reply.Extra)
+		fields["tc"] = event.Reply.Truncated
+		fields["size"] = len(event.Response)
+	} else if len(event.Response) >= 12 {
+		// responses written as wire data are only read from the header
+		data := event.Response
+		fields["rcode"] = dns.RcodeToString[int(data[3]&0x0f)]
+		fields["answer"] = int(binary.BigEndian.Uint16(data[6:]))
+		fields["authority"] = int(binary.BigEndian.Uint16(data[8:]))
+		fields["additional"] = int(binary.BigEndian.Uint16(data[10:]))
+		fields["tc"] = data[2]&0x02 != 0
+		fields["size"] = len(data)
+	} else {
+		fields["rcode"] = "NONE"
+	}
+	queryLog.logger.WithFields(fields).Info("query")
+}
+
+func queryFlags(m *dns.Msg) string {
+	flags := make([]string, 0, 3)
+	if m.RecursionDesired {
+		flags = append(flags, "rd")
+	}
+	if m.CheckingDisabled {
+		flags = append(flags, "cd")
+	}
+	if opt := m.IsEdns0(); opt != nil {
+		flags = append(flags, "edns")
+		if opt.Do() {
+			flags = append(flags, "do")
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// rotateWriter is a file writer rotating by size and time, rotated files
+// are renamed with a timestamp suffix and compressed in background
+type rotateWriter struct {
+	sync.Mutex
+	config   QueryLogConfig
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	// cleanup serializes background compression and pruning
+	cleanup sync.Mutex
+}
+
+func newRotateWriter(config QueryLogConfig) (*rotateWriter, error) {
+	writer := &rotateWriter{config: config}
+	if err := writer.open(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (writer *rotateWriter) open() error {
+	file, err := os.OpenFile(writer.config.Filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	writer.file = file
+	writer.size = info.Size()
+	writer.openedAt = time.Now()
+	return nil
+}
+
+func (writer *rotateWriter) Write(data []byte) (int, error) {
+	writer.Lock()
+	defer writer.Unlock()
+	expired := writer.config.RotateInterval > 0 && time.Since(writer.openedAt) >= writer.config.RotateInterval
+	full := writer.config.MaxSize > 0 && writer.size > 0 && writer.size+int64(len(data)) > writer.config.MaxSize
+	if expired || full {
+		if err := writer.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := writer.file.Write(data)
+	writer.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file to a backup and opens a new one, when
+// the rename fails the file is opened again so queries are still logged and
+// the next rotation is tried after another MaxSize bytes or RotateInterval
+func (writer *rotateWriter) rotate() error {
+	writer.file.Close()
+	backup := fmt.Sprintf("%s.%s", writer.config.Filename, time.Now().Format("20060102-150405.000000"))
+	if err := os.Rename(writer.config.Filename, backup); err != nil {
+		log.Errorf("rotate query log %s fail: %s", writer.config.Filename, err)
+		if err := writer.open(); err != nil {
+			log.Errorf("open query log %s fail: %s", writer.config.Filename, err)
+			return err
+		}
+		writer.size = 0
+		return nil
+	}
+	if err := writer.open(); err != nil {
+		log.Errorf("open query log %s fail: %s", writer.config.Filename, err)
+		return err
+	}
+	go func() {
+		writer.cleanup.Lock()
+		defer writer.cleanup.Unlock()
+		if writer.config.Compress {
+			if err := compressFile(backup); err != nil {
+				log.Errorf("compress query log %s fail: %s", backup, err)
+			}
+		}
+		writer.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest backups beyond MaxBackups
+func (writer *rotateWriter) prune() {
+	if writer.config.MaxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(writer.config.Filename + ".*")
+	if err != nil {
+		return
+	}
+	// the timestamp suffix sorts in time order
+	sort.Strings(backups)
+	for len(backups) > writer.config.MaxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+func (writer *rotateWriter) Close() error {
+	writer.Lock()
+	defer writer.Unlock()
+	return writer.file.Close()
+}
+
+func compressFile(filename string) error {
+	source, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.Create(filename + ".gz")
+	if err != nil {
+		return err
+	}
+	compressor := gzip.NewWriter(target)
+	if _, err := io.Copy(compressor, source); err != nil {
+		target.Close()
+		os.Remove(filename + ".gz")
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		target.Close()
+		return err
+	}
+	if err := target.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
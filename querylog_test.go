@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "query.log")
+	manager := newTestManager(t)
+	if err := manager.EnableQueryLog(QueryLogConfig{Filename: filename, SampleRate: 1}); err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("xyz.", dns.TypeAAAA)
+	m.SetEdns0(1232, true)
+	manager.handler("udp", manager.handleRequest)(&testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}}, m)
+	// a response written as wire data is logged from its header
+	referral := new(dns.Msg)
+	referral.SetQuestion("com.", dns.TypeNS)
+	response := new(dns.Msg)
+	response.SetReply(referral)
+	response.Ns = manager.snapshot().store.Lookup("com.", dns.TypeNS, false).Ns
+	response.Truncated = true
+	data, err := response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.queryLog.Log(&queryEvent{Request: referral, Response: data, Start: time.Now(), End: time.Now()})
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if scanner.Scan() == false {
+		t.Fatal("expect one query log line")
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for key, expect := range map[string]interface{}{
+		"client":    "192.0.2.1",
+		"qname":     "xyz.",
+		"qtype":     "AAAA",
+		"flags":     "rd,edns,do",
+		"rcode":     "NXDOMAIN",
+		"authority": float64(1),
+		"serial":    float64(2020081000),
+	} {
+		if entry[key] != expect {
+			t.Errorf("expect query log %s=%v, got %v", key, expect, entry[key])
+		}
+	}
+	if scanner.Scan() == false {
+		t.Fatal("expect second query log line")
+	}
+	entry = nil
+	if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	for key, expect := range map[string]interface{}{
+		"qname":      "com.",
+		"rcode":      "NOERROR",
+		"authority":  float64(2),
+		"additional": float64(0),
+		"tc":         true,
+	} {
+		if entry[key] != expect {
+			t.Errorf("expect query log of referral %s=%v, got %v", key, expect, entry[key])
+		}
+	}
+}
+
+func TestQueryLogSample(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "query.log")
+	queryLog, err := NewQueryLog(QueryLogConfig{Filename: filename, SampleRate: 1e-9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("com.", dns.TypeNS)
+	for i := 0; i < 100; i++ {
+		queryLog.Log(&queryEvent{Request: m, Start: time.Now(), End: time.Now()})
+	}
+	if info, _ := os.Stat(filename); info.Size() != 0 {
+		t.Errorf("expect nearly no sampled query, got %d bytes", info.Size())
+	}
+}
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "query.log")
+	writer, err := newRotateWriter(QueryLogConfig{Filename: filename, MaxSize: 10, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		writer.Write([]byte("0123456789"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	writer.Close()
+	var backups []string
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		backups, _ = filepath.Glob(filename + ".*.gz")
+		plain, _ := filepath.Glob(filename + ".*[0-9]")
+		if len(backups) == 2 && len(plain) == 0 {
+			break
+		}
+	}
+	if len(backups) != 2 {
+		t.Errorf("expect 2 compressed backups kept, got %v", backups)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != 10 {
+		t.Errorf("expect current log holds the last write, got %v %v", info, err)
+	}
+}
+
+func TestRotateWriterRenameFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := new(bytes.Buffer)
+	saved := log.StandardLogger().Out
+	log.SetOutput(output)
+	defer log.SetOutput(saved)
+	filename := filepath.Join(dir, "query.log")
+	writer, err := newRotateWriter(QueryLogConfig{Filename: filename, MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	writer.Write([]byte("0123456789"))
+	// the rotation can not rename a removed file
+	os.Remove(filename)
+	if n, err := writer.Write([]byte("0123456789")); n != 10 || err != nil {
+		t.Errorf("expect write after failed rotation succeed but got %d %v", n, err)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Size() != 10 {
+		t.Errorf("expect query log opened again after failed rotation but got %v %v", info, err)
+	}
+	if strings.Contains(output.String(), "rotate query log "+filename+" fail") == false {
+		t.Errorf("expect failed rotation logged but got %q", output.String())
+	}
+}
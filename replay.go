@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayFields are the parts of two responses compared by replay, in
+// report order
+var replayFields = []string{"error", "rcode", "flags", "question", "answer", "authority", "additional", "edns"}
+
+// ReplayConfig holds the arguments of the replay subcommand, Transport
+// capture sends each query over the transport it was captured on
+type ReplayConfig struct {
+	Pcap      string
+	Targets   [2]string
+	Transport string
+	Workers   int
+	Timeout   time.Duration
+	Count     int
+	IgnoreTTL bool
+	Show      int
+}
+
+// replayQuery is a captured query with the responses of both targets
+type replayQuery struct {
+	query     *dns.Msg
+	transport string
+	responses [2]*dns.Msg
+	errs      [2]error
+	fields    []string
+}
+
+// runReplay runs the replay subcommand with its arguments and writes the
+// report to out, it returns 1 if any response differs
+func runReplay(args []string, out io.Writer) int {
+	config := ReplayConfig{}
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.StringVar(&config.Pcap, "pcap", "", "pcap or pcapng file with the queries to port 53 to replay")
+	flags.StringVar(&config.Targets[0], "a", "", "address of the first dns server")
+	flags.StringVar(&config.Targets[1], "b", "", "address of the second dns server")
+	flags.StringVar(&config.Transport, "transport", "capture", "send queries over udp, tcp or the transport they were captured on")
+	flags.IntVar(&config.Workers, "workers", 8, "number of queries replayed concurrently")
+	flags.DurationVar(&config.Timeout, "timeout", 2*time.Second, "timeout of each query")
+	flags.IntVar(&config.Count, "count", 0, "replay only the first queries of the capture, 0 all")
+	flags.BoolVar(&config.IgnoreTTL, "ignore-ttl", false, "compare records without their ttl")
+	flags.IntVar(&config.Show, "show", 10, "number of differences printed in detail")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if config.Pcap == "" || config.Targets[0] == "" || config.Targets[1] == "" {
+		fmt.Fprintln(out, "replay needs -pcap, -a and -b")
+		return 2
+	}
+	if config.Transport != "capture" && config.Transport != "udp" && config.Transport != "tcp" {
+		fmt.Fprintf(out, "unsupported replay transport %s\n", config.Transport)
+		return 2
+	}
+	queries, err := readReplayQueries(config.Pcap, config.Transport)
+	if err != nil {
+		fmt.Fprintf(out, "load replay queries fail: %s\n", err)
+		return 1
+	}
+	if config.Count > 0 && config.Count < len(queries) {
+		queries = queries[:config.Count]
+	}
+	fmt.Fprintf(out, "replay %d queries from %s to a %s and b %s\n", len(queries), config.Pcap, config.Targets[0], config.Targets[1])
+	replay(&config, queries)
+	if writeReplayReport(out, &config, queries) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readReplayQueries returns the queries of a capture with the transport
+// they are replayed over
+func readReplayQueries(filename string, transport string) ([]*replayQuery, error) {
+	messages, err := readCapture(filename)
+	if err != nil {
+		return nil, err
+	}
+	queries := make([]*replayQuery, 0)
+	for _, message := range messages {
+		if message.DstPort != 53 {
+			continue
+		}
+		query := new(dns.Msg)
+		if query.Unpack(message.Data) != nil || query.Response || len(query.Question) != 1 {
+			continue
+		}
+		replayed := &replayQuery{query: query, transport: transport}
+		if transport == "capture" {
+			replayed.transport = message.Transport
+		}
+		queries = append(queries, replayed)
+	}
+	if len(queries) == 0 {
+		return nil, errors.New("no query found in capture")
+	}
+	return queries, nil
+}
+
+// replay sends every query to both targets and compares the responses
+func replay(config *ReplayConfig, queries []*replayQuery) {
+	clients := map[string]*dns.Client{
+		"udp": {Net: "udp", Timeout: config.Timeout, UDPSize: dns.MaxMsgSize},
+		"tcp": {Net: "tcp", Timeout: config.Timeout},
+	}
+	workers := config.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	next := make(chan *replayQuery)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for query := range next {
+				for target := range config.Targets {
+					query.responses[target], _, query.errs[target] = clients[query.transport].Exchange(query.query, config.Targets[target])
+				}
+				query.fields = diffResponses(query.responses, query.errs, config.IgnoreTTL)
+			}
+		}()
+	}
+	for _, query := range queries {
+		next <- query
+	}
+	close(next)
+	wg.Wait()
+}
+
+// diffResponses returns the fields in which two responses differ, a
+// failure of both targets is no difference
+func diffResponses(responses [2]*dns.Msg, errs [2]error, ignoreTTL bool) []string {
+	if errs[0] != nil || errs[1] != nil {
+		if errs[0] != nil && errs[1] != nil {
+			return nil
+		}
+		return []string{"error"}
+	}
+	fields := make([]string, 0)
+	a, b := normalizeResponse(responses[0], ignoreTTL), normalizeResponse(responses[1], ignoreTTL)
+	for _, field := range replayFields[1:] {
+		if equalStrings(a[field], b[field]) == false {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// normalizeResponse returns the comparable lines of each field of a
+// response. Records are sorted with lower case owner names and the edns
+// options which differ between instances by design are reduced to their code.
+func normalizeResponse(m *dns.Msg, ignoreTTL bool) map[string][]string {
+	rcode, ok := dns.RcodeToString[m.Rcode]
+	if ok == false {
+		rcode = fmt.Sprintf("RCODE%d", m.Rcode)
+	}
+	fields := map[string][]string{
+		"rcode":      {rcode},
+		"flags":      {responseFlags(m)},
+		"question":   normalizeRRs(nil, ignoreTTL),
+		"answer":     normalizeRRs(m.Answer, ignoreTTL),
+		"authority":  normalizeRRs(m.Ns, ignoreTTL),
+		"additional": normalizeRRs(m.Extra, ignoreTTL),
+		"edns":       {ednsSummary(m.IsEdns0())},
+	}
+	for _, question := range m.Question {
+		fields["question"] = append(fields["question"], strings.ToLower(question.String()))
+	}
+	return fields
+}
+
+// responseFlags returns the opcode and header flags of a response
+func responseFlags(m *dns.Msg) string {
+	flags := []string{strings.ToLower(dns.OpcodeToString[m.Opcode])}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"qr", m.Response}, {"aa", m.Authoritative}, {"tc", m.Truncated}, {"rd", m.RecursionDesired},
+		{"ra", m.RecursionAvailable}, {"z", m.Zero}, {"ad", m.AuthenticatedData}, {"cd", m.CheckingDisabled},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+	return strings.Join(flags, " ")
+}
+
+// normalizeRRs returns the sorted presentation of rrs without the opt
+// record, the order of records is not significant
+func normalizeRRs(rrs []dns.RR, ignoreTTL bool) []string {
+	lines := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if ignoreTTL {
+			rr.Header().Ttl = 0
+		}
+		lines = append(lines, rr.String())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// ednsSummary returns the comparable parts of an opt record. Nsid, cookie,
+// keepalive and padding values are per instance or per connection and only
+// their presence is compared, padding not at all.
+func ednsSummary(opt *dns.OPT) string {
+	if opt == nil {
+		return "none"
+	}
+	summary := fmt.Sprintf("version %d, udp %d", opt.Version(), opt.UDPSize())
+	if opt.Do() {
+		summary += ", do"
+	}
+	options := make([]string, 0, len(opt.Option))
+	for _, option := range opt.Option {
+		switch option := option.(type) {
+		case *dns.EDNS0_PADDING:
+		case *dns.EDNS0_NSID, *dns.EDNS0_COOKIE, *dns.EDNS0_TCP_KEEPALIVE:
+			options = append(options, dnsOptionName(option.Option()))
+		case *dns.EDNS0_LOCAL:
+			// the extra text of extended dns errors is informational
+			if option.Code == EDNS0EDE && len(option.Data) >= 2 {
+				options = append(options, fmt.Sprintf("EDE %d", binary.BigEndian.Uint16(option.Data)))
+				continue
+			}
+			options = append(options, fmt.Sprintf("%s %s", dnsOptionName(option.Option()), option.String()))
+		default:
+			options = append(options, fmt.Sprintf("%s %s", dnsOptionName(option.Option()), option.String()))
+		}
+	}
+	sort.Strings(options)
+	if len(options) > 0 {
+		summary += ", " + strings.Join(options, ", ")
+	}
+	return summary
+}
+
+func dnsOptionName(code uint16) string {
+	switch code {
+	case dns.EDNS0NSID:
+		return "NSID"
+	case dns.EDNS0COOKIE:
+		return "COOKIE"
+	case dns.EDNS0TCPKEEPALIVE:
+		return "KEEPALIVE"
+	}
+	return fmt.Sprintf("OPTION%d", code)
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeReplayReport writes the counts of differing fields and the details
+// of the first differences, it returns the number of differing responses
+func writeReplayReport(out io.Writer, config *ReplayConfig, queries []*replayQuery) int {
+	different, failed := 0, 0
+	counts := make(map[string]int)
+	for _, query := range queries {
+		if query.errs[0] != nil && query.errs[1] != nil {
+			failed++
+		}
+		if len(query.fields) == 0 {
+			continue
+		}
+		different++
+		for _, field := range query.fields {
+			counts[field]++
+		}
+	}
+	fmt.Fprintf(out, "identical:   %d\n", len(queries)-different-failed)
+	fmt.Fprintf(out, "different:   %d\n", different)
+	fmt.Fprintf(out, "both failed: %d\n", failed)
+	for _, field := range replayFields {
+		if counts[field] > 0 {
+			fmt.Fprintf(out, "%-12s %d\n", field+":", counts[field])
+		}
+	}
+	shown := 0
+	for _, query := range queries {
+		if len(query.fields) == 0 || shown >= config.Show {
+			continue
+		}
+		shown++
+		question := query.query.Question[0]
+		fmt.Fprintf(out, "\n%s %s %s over %s differs in %s\n", question.Name, dns.ClassToString[question.Qclass],
+			dns.TypeToString[question.Qtype], query.transport, strings.Join(query.fields, ", "))
+		if query.fields[0] == "error" {
+			for target, err := range query.errs {
+				if err != nil {
+					fmt.Fprintf(out, "  %c error: %s\n", 'a'+target, err)
+				}
+			}
+			continue
+		}
+		a := normalizeResponse(query.responses[0], config.IgnoreTTL)
+		b := normalizeResponse(query.responses[1], config.IgnoreTTL)
+		for _, field := range query.fields {
+			switch field {
+			case "rcode", "flags", "edns":
+				fmt.Fprintf(out, "  %s: a %s, b %s\n", field, a[field][0], b[field][0])
+			default:
+				onlyA, onlyB := differenceStrings(a[field], b[field]), differenceStrings(b[field], a[field])
+				for _, line := range onlyA {
+					fmt.Fprintf(out, "  %s a: %s\n", field, line)
+				}
+				for _, line := range onlyB {
+					fmt.Fprintf(out, "  %s b: %s\n", field, line)
+				}
+			}
+		}
+	}
+	return different
+}
+
+// differenceStrings returns the lines of sorted a missing in sorted b,
+// counting duplicates
+func differenceStrings(a []string, b []string) []string {
+	lines := make([]string, 0)
+	j := 0
+	for _, line := range a {
+		for j < len(b) && b[j] < line {
+			j++
+		}
+		if j < len(b) && b[j] == line {
+			j++
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
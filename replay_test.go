@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffResponses(t *testing.T) {
+	response := func(records ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("com.", dns.TypeNS)
+		m.Response = true
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.Ns = append(m.Ns, rr)
+		}
+		return m
+	}
+	nsid := func(m *dns.Msg, id string) *dns.Msg {
+		m.SetEdns0(1232, true)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: id})
+		return m
+	}
+	a := nsid(response("com. 172800 IN NS a.gtld-servers.net.", "com. 172800 IN NS b.gtld-servers.net."), "6131")
+	b := nsid(response("COM. 172800 IN NS b.gtld-servers.net.", "com. 172800 IN NS a.gtld-servers.net."), "6232")
+	if fields := diffResponses([2]*dns.Msg{a, b}, [2]error{}, false); len(fields) != 0 {
+		t.Errorf("expect rr order, owner case and nsid value ignored but got %v", fields)
+	}
+
+	c := nsid(response("com. 86400 IN NS a.gtld-servers.net."), "6131")
+	c.Rcode = dns.RcodeNameError
+	c.Authoritative = true
+	c.IsEdns0().Option = append(c.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: EDNS0EDE, Data: []byte{0, 3}})
+	fields := diffResponses([2]*dns.Msg{a, c}, [2]error{}, false)
+	if strings.Join(fields, ",") != "rcode,flags,authority,edns" {
+		t.Errorf("expect rcode, flags, authority and edns differ but got %v", fields)
+	}
+	timeout := errors.New("i/o timeout")
+	if fields := diffResponses([2]*dns.Msg{a, nil}, [2]error{nil, timeout}, false); strings.Join(fields, ",") != "error" {
+		t.Errorf("expect error differ but got %v", fields)
+	}
+	if fields := diffResponses([2]*dns.Msg{}, [2]error{timeout, timeout}, false); len(fields) != 0 {
+		t.Errorf("expect failure of both targets not differ but got %v", fields)
+	}
+	d := nsid(response("com. 86400 IN NS b.gtld-servers.net.", "com. 86400 IN NS a.gtld-servers.net."), "")
+	if fields := diffResponses([2]*dns.Msg{a, d}, [2]error{}, true); len(fields) != 0 {
+		t.Errorf("expect ttl ignored but got %v", fields)
+	}
+}
+
+func TestRunReplay(t *testing.T) {
+	start := func(manager *Manager) string {
+		address := freeListenAddress(t)
+		addr, err := ParseListenAddr(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go manager.runListeners(&ListenConfig{Addresses: []*ListenAddr{addr}, Sockets: 1})
+		waitListener(t, "udp", address)
+		waitListener(t, "tcp", address)
+		return address
+	}
+	same, other := start(newTestManager(t)), start(newTestManager(t))
+	// the changed server delegates org. which does not exist in the test zone
+	changed := newTestManager(t)
+	org, err := dns.NewRR("org. 172800 IN NS a0.org.afilias-nst.info.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed.setZone(NewZoneStoreFromRRSet(append(testZoneRRs(t), org)), time.Time{})
+	different := start(changed)
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	frames := make([][]byte, 0)
+	for i, name := range []string{"com.", "org.", "www.net.", "."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeNS)
+		m.SetEdns0(1232, i%2 == 0)
+		data, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, testEthernetFrame(testUDPPacket("192.0.2.1", "192.0.2.53", uint16(40000+i), 53, data)))
+		length := []byte{byte(len(data) >> 8), byte(len(data))}
+		frames = append(frames, testEthernetFrame(testTCPPacket("2001:db8::1", "2001:db8::53", uint16(41000+i), 53, 1, 0, append(length, data...))))
+	}
+	filename := writeTestPcap(t, dir, linkTypeEthernet, frames)
+
+	out := new(bytes.Buffer)
+	if code := runReplay([]string{"-pcap", filename, "-a", same, "-b", other}, out); code != 0 {
+		t.Fatalf("expect replay to identical servers success but got %d: %s", code, out)
+	}
+	if strings.Contains(out.String(), "identical:   8\n") == false {
+		t.Errorf("expect 8 identical responses but got\n%s", out)
+	}
+
+	out.Reset()
+	if code := runReplay([]string{"-pcap", filename, "-a", same, "-b", different, "-show", "1"}, out); code != 1 {
+		t.Fatalf("expect replay to changed server report differences but got %d: %s", code, out)
+	}
+	report := out.String()
+	for _, expect := range []string{
+		"identical:   6\n", "different:   2\n", "rcode:       2\n", "flags:       2\n", "authority:   2\n",
+		"org. IN NS over udp differs in rcode, flags, authority\n",
+		"  rcode: a NXDOMAIN, b NOERROR\n",
+		"  authority b: org.\t172800\tIN\tNS\ta0.org.afilias-nst.info.\n",
+	} {
+		if strings.Contains(report, expect) == false {
+			t.Errorf("expect replay report contains %q but got\n%s", expect, report)
+		}
+	}
+	if strings.Contains(report, "over tcp differs") {
+		t.Errorf("expect only %d difference shown but got\n%s", 1, report)
+	}
+	if code := runReplay([]string{"-pcap", filename, "-a", same}, new(bytes.Buffer)); code != 2 {
+		t.Errorf("expect replay without second target fail with 2 but got %d", code)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// cachedQTypes are the query types packed for every delegation, the apex
+// also gets the types it owns
+var cachedQTypes = []uint16{
+	dns.TypeA, dns.TypeAAAA, dns.TypeNS, dns.TypeDS, dns.TypeSOA, dns.TypeDNSKEY, dns.TypeMX, dns.TypeTXT,
+}
+
+// responseKey identifies a cached response, owner is lower case and edns
+// tells the buffer size class: plain dns limited to 512 bytes, or edns
+// limited to the server buffer size
+type responseKey struct {
+	owner string
+	qType uint16
+	do    bool
+	edns  bool
+}
+
+// cachedResponse is a packed response, limit is the smallest client buffer
+// size the data is valid for and truncated marks data cut to that size
+type cachedResponse struct {
+	msg       *dns.Msg
+	data      []byte
+	limit     int
+	truncated bool
+}
+
+// ResponseCache holds the packed responses of queries for the zone apex
+// and the delegations, so the hot query path only copies the bytes and
+// patches the id, the question name case and the flags
+type ResponseCache struct {
+	responses  map[responseKey]*cachedResponse
+	bufferSize uint16
+}
+
+// packedWriter is implemented by response writers which can send packed
+// responses directly, m is the response data used for rate limiting
+type packedWriter interface {
+	WritePacked(m *dns.Msg, data []byte) error
+}
+
+// writePacked sends data to w, writers not supporting packed responses
+// get the message instead
+func writePacked(w dns.ResponseWriter, m *dns.Msg, data []byte) error {
+	if packed, ok := w.(packedWriter); ok == true {
+		return packed.WritePacked(m, data)
+	}
+	return w.WriteMsg(m)
+}
+
+// keepWriter keeps the written message when building the cache
+type keepWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *keepWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+// buildResponseCache packs the responses of the cached names and types
+// with the same code as the slow path, manager settings must not change
+// while it runs
+func (manager *Manager) buildResponseCache(store *ZoneStore) *ResponseCache {
+	cache := &ResponseCache{
+		responses:  make(map[responseKey]*cachedResponse),
+		bufferSize: manager.ednsBufferSize(),
+	}
+	for _, owner := range append([]string{"."}, store.TLDs()...) {
+		qTypes := cachedQTypes
+		if owner == "." {
+			qTypes = append([]uint16{}, cachedQTypes...)
+			for _, rrset := range store.root.rrsets {
+				qTypes = append(qTypes, rrset.rrtype)
+			}
+		}
+		for _, qType := range qTypes {
+			for _, do := range []bool{false, true} {
+				for _, edns := range []bool{false, true} {
+					key := responseKey{owner: strings.ToLower(owner), qType: qType, do: do, edns: edns}
+					if _, ok := cache.responses[key]; ok == true {
+						continue
+					}
+					if response := manager.packResponse(store, owner, qType, do, edns, cache.bufferSize); response != nil {
+						cache.responses[key] = response
+					}
+				}
+			}
+		}
+	}
+	return cache
+}
+
+func (manager *Manager) packResponse(store *ZoneStore, owner string, qType uint16, do bool, edns bool, bufferSize uint16) *cachedResponse {
+	query := new(dns.Msg)
+	query.SetQuestion(owner, qType)
+	query.RecursionDesired = false
+	limit := dns.MinMsgSize
+	if edns {
+		query.SetEdns0(bufferSize, do)
+		limit = int(bufferSize)
+	} else if do {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(query)
+	result := store.Lookup(owner, qType, do)
+	m.Answer = result.Answer
+	m.Ns = result.Ns
+	m.Extra = result.Additional[:len(result.Additional):len(result.Additional)]
+	m.Authoritative = result.AA
+	m.Rcode = result.Rcode
+	keep := &keepWriter{}
+	manager.writeResponse(manager.ednsWriter(keep, query, "udp"), query, m)
+	data, err := keep.msg.Pack()
+	if err != nil {
+		return nil
+	}
+	response := &cachedResponse{msg: keep.msg, data: data, limit: len(data), truncated: keep.msg.Truncated}
+	if response.truncated {
+		response.limit = limit
+	}
+	return response
+}
+
+// writeCached answers query r from the response cache, it returns false
+// when the query needs the slow path
+func (manager *Manager) writeCached(w dns.ResponseWriter, r *dns.Msg, snapshot *zoneSnapshot) bool {
+	packed, ok := w.(packedWriter)
+	if ok == false || snapshot == nil || snapshot.cache == nil || r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 || r.Question[0].Qclass != dns.ClassINET {
+		return false
+	}
+	key := responseKey{owner: strings.ToLower(r.Question[0].Name), qType: r.Question[0].Qtype}
+	limit := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		// any option or a new edns version may change the response
+		if opt.Version() != 0 || len(opt.Option) != 0 {
+			return false
+		}
+		key.edns = true
+		key.do = opt.Do()
+		limit = int(opt.UDPSize())
+	}
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	cache := snapshot.cache
+	if snapshot.bogus != "" || manager.zoneStale(snapshot, time.Now()) || cache.bufferSize != manager.ednsBufferSize() {
+		return false
+	}
+	response, ok := cache.responses[key]
+	if ok == false {
+		return false
+	}
+	if key.edns && limit > int(cache.bufferSize) {
+		limit = int(cache.bufferSize)
+	}
+	if udp && limit < response.limit || udp == false && response.truncated {
+		return false
+	}
+	data := make([]byte, len(response.data))
+	copy(data, response.data)
+	data[0], data[1] = byte(r.Id>>8), byte(r.Id)
+	// rd and cd are copied from the query like dns.Msg.SetReply
+	data[2] &^= 0x01
+	if r.RecursionDesired {
+		data[2] |= 0x01
+	}
+	data[3] &^= 0x10
+	if r.CheckingDisabled {
+		data[3] |= 0x10
+	}
+	// the question name starts at offset 12 and only differs in case, the
+	// length byte before each label is skipped
+	name := r.Question[0].Name
+	if strings.IndexByte(name, '\\') >= 0 {
+		return false
+	}
+	offset := 13
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' {
+			offset++
+			continue
+		}
+		data[offset] = name[i]
+		offset++
+	}
+	reply := *response.msg
+	reply.Id = r.Id
+	reply.RecursionDesired = r.RecursionDesired
+	reply.CheckingDisabled = r.CheckingDisabled
+	reply.Question = r.Question
+	packed.WritePacked(&reply, data)
+	return true
+}
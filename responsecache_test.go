@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newCachedTestManager returns a test manager with response cache built
+func newCachedTestManager(t testing.TB) *Manager {
+	manager := &Manager{stats: NewStats(), syncDuration: time.Minute}
+	manager.SetEDNS(EDNSConfig{BufferSize: 1232})
+	manager.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), time.Now())
+	return manager
+}
+
+func TestResponseCache(t *testing.T) {
+	cached := newCachedTestManager(t)
+	if cached.snapshot().cache == nil || len(cached.snapshot().cache.responses) == 0 {
+		t.Fatal("expect response cache built on zone load")
+	}
+	slow := newCachedTestManager(t)
+	disableResponseCache(slow)
+
+	query := func(name string, qType uint16, edns bool, do bool, size uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qType)
+		m.Id = 4242
+		if edns {
+			m.SetEdns0(size, do)
+		}
+		return m
+	}
+	cases := []*dns.Msg{
+		query(".", dns.TypeSOA, false, false, 0),
+		query(".", dns.TypeNS, true, true, 4096),
+		query(".", dns.TypeA, true, false, 1232),
+		query("com.", dns.TypeNS, true, false, 1232),
+		query("com.", dns.TypeDS, true, true, 1400),
+		query("net.", dns.TypeA, false, false, 0),
+		query("com.", dns.TypeNS, true, false, 256),
+		query("www.example.com.", dns.TypeA, true, false, 1232),
+		query("nonexist.", dns.TypeA, true, false, 1232),
+	}
+	cases[0].RecursionDesired = false
+	cases[1].CheckingDisabled = true
+	for _, transport := range []string{"udp", "tcp"} {
+		for _, r := range cases {
+			var remote net.Addr = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+			if transport == "tcp" {
+				remote = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+			}
+			fast := &testWriter{remote: remote}
+			cached.handler(transport, cached.handleRequest)(fast, r)
+			expect := &testWriter{remote: remote}
+			slow.handler(transport, slow.handleRequest)(expect, r)
+			if fast.msg == nil || expect.msg == nil || fast.msg.String() != expect.msg.String() {
+				t.Errorf("expect cached %s response for %s same as slow path\n%s\nbut got\n%s",
+					transport, r.Question[0].Name, expect.msg, fast.msg)
+			}
+		}
+	}
+
+	// the question keeps the case of the query
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	cached.handler("udp", cached.handleRequest)(w, query("CoM.", dns.TypeNS, true, false, 1232))
+	if w.msg.Question[0].Name != "CoM." || len(w.msg.Ns) != 2 {
+		t.Errorf("expect referral with question case kept but got %s", w.msg)
+	}
+
+	// queries with options take the slow path
+	cached.SetIdentity(&IdentityConfig{NSID: "node1"})
+	r := query("com.", dns.TypeNS, true, false, 1232)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	cached.handler("udp", cached.handleRequest)(w, r)
+	if nsid := cached.nsidOption(r); nsid == nil || len(w.msg.IsEdns0().Option) != 1 {
+		t.Errorf("expect nsid answered by slow path but got %s", w.msg)
+	}
+
+	// a stale zone is never answered from the cache
+	cached.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), time.Now().Add(-time.Hour))
+	writer := &statsWriter{ResponseWriter: w, counter: &TransportStats{}}
+	if cached.writeCached(writer, query("com.", dns.TypeNS, true, false, 1232), cached.snapshot()) {
+		t.Error("expect stale zone answered by slow path")
+	}
+}
+
+// disableResponseCache republishes the zone without response cache
+func disableResponseCache(manager *Manager) {
+	snapshot := *manager.snapshot()
+	snapshot.cache = nil
+	manager.publish(&snapshot)
+}
+
+// discardWriter drops the responses
+type discardWriter struct {
+	testWriter
+}
+
+func (w *discardWriter) WriteMsg(m *dns.Msg) error {
+	_, err := m.Pack()
+	return err
+}
+func (w *discardWriter) Write(data []byte) (int, error) { return len(data), nil }
+
+func benchmarkHandleRequest(b *testing.B, cache bool) {
+	manager := newCachedTestManager(b)
+	if cache == false {
+		disableResponseCache(manager)
+	}
+	serve := manager.handler("udp", manager.handleRequest)
+	w := &discardWriter{testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}}
+	r := new(dns.Msg)
+	r.SetQuestion("com.", dns.TypeNS)
+	r.SetEdns0(1232, true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		serve(w, r)
+	}
+}
+
+func BenchmarkHandleRequestSlowPath(b *testing.B) {
+	benchmarkHandleRequest(b, false)
+}
+
+func BenchmarkHandleRequestCached(b *testing.B) {
+	benchmarkHandleRequest(b, true)
+}
+
+// TestAdditionalNotShared checks responses do not append their opt record
+// into the additional section shared through the zone store, run with -race
+// for the concurrent part
+func TestAdditionalNotShared(t *testing.T) {
+	manager := newCachedTestManager(t)
+	disableResponseCache(manager)
+	remote := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}
+	query := func(do bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("com.", dns.TypeNS)
+		r.SetEdns0(1232, do)
+		return r
+	}
+	first, second := &testWriter{remote: remote}, &testWriter{remote: remote}
+	manager.handleRequest(first, query(true))
+	manager.handleRequest(second, query(false))
+	if opt := first.msg.IsEdns0(); opt == nil || opt.Do() == false {
+		t.Errorf("expect opt record of the first response kept but got %v", opt)
+	}
+	for _, rr := range manager.snapshot().store.Lookup("com.", dns.TypeNS, false).Additional {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			t.Errorf("expect no opt record in the zone additional section but got %s", rr)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(do bool) {
+			defer wg.Done()
+			w := &discardWriter{testWriter{remote: remote}}
+			for j := 0; j < 200; j++ {
+				manager.handleRequest(w, query(do))
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RRLConfig holds the response rate limiting settings, rates are responses
+// per second for one client prefix and response bucket, zero disables the
+// limit of that kind of response
+type RRLConfig struct {
+	ResponsesPerSecond int
+	NXDomainsPerSecond int
+	ErrorsPerSecond    int
+	Window             int
+	Slip               int
+	IPv4PrefixLength   int
+	IPv6PrefixLength   int
+	LogOnly            bool
+}
+
+// RRLStats counts what response rate limiting did
+type RRLStats struct {
+	Limited uint64 `json:"limited"`
+	Dropped uint64 `json:"dropped"`
+	Slipped uint64 `json:"slipped"`
+	LogOnly uint64 `json:"log_only"`
+	// Evicted counts buckets still in use removed to make room
+	Evicted uint64 `json:"evicted"`
+}
+
+// rrlMaxBuckets bounds memory used by buckets, when it is reached idle
+// buckets are removed first and then the least recently used one
+const rrlMaxBuckets = 100000
+
+type rrlBucket struct {
+	key     string
+	balance float64
+	updated time.Time
+	slip    int
+}
+
+// RRL implements response rate limiting like bind and knot, every
+// response is accounted to a bucket of client prefix, response kind and
+// the name it is about
+type RRL struct {
+	sync.Mutex
+	config  RRLConfig
+	ipv4    net.IPMask
+	ipv6    net.IPMask
+	buckets map[string]*list.Element
+	// lru orders the buckets from the most to the least recently used
+	lru        *list.List
+	maxBuckets int
+	stats      RRLStats
+}
+
+func NewRRL(config RRLConfig) (*RRL, error) {
+	if config.IPv4PrefixLength < 0 || config.IPv4PrefixLength > 32 ||
+		config.IPv6PrefixLength < 0 || config.IPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("invalid rrl prefix length %d/%d", config.IPv4PrefixLength, config.IPv6PrefixLength)
+	}
+	if config.Window <= 0 {
+		return nil, errors.New("rrl window should greater than 0")
+	}
+	if config.Slip < 0 {
+		return nil, errors.New("rrl slip should not be negative")
+	}
+	return &RRL{
+		config:     config,
+		ipv4:       net.CIDRMask(config.IPv4PrefixLength, 32),
+		ipv6:       net.CIDRMask(config.IPv6PrefixLength, 128),
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxBuckets: rrlMaxBuckets,
+	}, nil
+}
+
+// Stats returns a copy of rrl counters
+func (rrl *RRL) Stats() RRLStats {
+	return RRLStats{
+		Limited: atomic.LoadUint64(&rrl.stats.Limited),
+		Dropped: atomic.LoadUint64(&rrl.stats.Dropped),
+		Slipped: atomic.LoadUint64(&rrl.stats.Slipped),
+		LogOnly: atomic.LoadUint64(&rrl.stats.LogOnly),
+		Evicted: atomic.LoadUint64(&rrl.stats.Evicted),
+	}
+}
+
+// rrlClass returns the kind of response, the name used as bucket key and
+// the rate limit of the response
+func (rrl *RRL) rrlClass(m *dns.Msg) (kind string, name string, rate int) {
+	var qName string
+	var qType uint16
+	if len(m.Question) > 0 {
+		qName = strings.ToLower(m.Question[0].Name)
+		qType = m.Question[0].Qtype
+	}
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		// all nxdomain responses are about the root zone itself
+		return "nxdomain", ".", rrl.config.NXDomainsPerSecond
+	case m.Rcode != dns.RcodeSuccess:
+		return "error", "", rrl.config.ErrorsPerSecond
+	case len(m.Answer) == 0 && len(m.Ns) > 0 && m.Authoritative == false:
+		return "referral", getTLDFromDomain(qName), rrl.config.ResponsesPerSecond
+	default:
+		return "answer", qName + "/" + dns.TypeToString[qType], rrl.config.ResponsesPerSecond
+	}
+}
+
+func (rrl *RRL) clientPrefix(addr net.Addr) string {
+	var ip net.IP
+	switch casted := addr.(type) {
+	case *net.UDPAddr:
+		ip = casted.IP
+	case *net.TCPAddr:
+		ip = casted.IP
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(rrl.ipv4).String()
+	}
+	return ip.Mask(rrl.ipv6).String()
+}
+
+// Action of rrl on a response
+const (
+	RRLSend = iota
+	RRLDrop
+	RRLSlip
+)
+
+// Check accounts response m to client and decides how it should be sent
+func (rrl *RRL) Check(client net.Addr, m *dns.Msg, now time.Time) int {
+	kind, name, rate := rrl.rrlClass(m)
+	if rate <= 0 {
+		return RRLSend
+	}
+	key := rrl.clientPrefix(client) + "|" + kind + "|" + name
+	rrl.Lock()
+	var bucket *rrlBucket
+	if element, ok := rrl.buckets[key]; ok == true {
+		rrl.lru.MoveToFront(element)
+		bucket = element.Value.(*rrlBucket)
+	} else {
+		rrl.makeRoom(now)
+		bucket = &rrlBucket{key: key, balance: float64(rate), updated: now}
+		rrl.buckets[key] = rrl.lru.PushFront(bucket)
+	}
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.updated = now
+	bucket.balance += elapsed * float64(rate)
+	if bucket.balance > float64(rate) {
+		bucket.balance = float64(rate)
+	}
+	bucket.balance--
+	if floor := -float64(rate * rrl.config.Window); bucket.balance < floor {
+		bucket.balance = floor
+	}
+	limited := bucket.balance < 0
+	slip := false
+	if limited == true && rrl.config.Slip > 0 {
+		bucket.slip++
+		if bucket.slip >= rrl.config.Slip {
+			bucket.slip = 0
+			slip = true
+		}
+	}
+	rrl.Unlock()
+
+	if limited == false {
+		return RRLSend
+	}
+	atomic.AddUint64(&rrl.stats.Limited, 1)
+	if rrl.config.LogOnly == true {
+		atomic.AddUint64(&rrl.stats.LogOnly, 1)
+		log.Debugf("rrl would limit %s response to %s", kind, client)
+		return RRLSend
+	}
+	if slip == true {
+		atomic.AddUint64(&rrl.stats.Slipped, 1)
+		return RRLSlip
+	}
+	atomic.AddUint64(&rrl.stats.Dropped, 1)
+	return RRLDrop
+}
+
+// makeRoom removes the least recently used buckets idle for a whole window
+// when the buckets are full, if none is idle the least recently used one
+// is evicted. Buckets in use by a flood keep their state as spoofed
+// sources only push out the buckets they created.
+func (rrl *RRL) makeRoom(now time.Time) {
+	if len(rrl.buckets) < rrl.maxBuckets {
+		return
+	}
+	idle := time.Duration(rrl.config.Window) * time.Second
+	for element := rrl.lru.Back(); element != nil; element = rrl.lru.Back() {
+		bucket := element.Value.(*rrlBucket)
+		if now.Sub(bucket.updated) <= idle {
+			break
+		}
+		rrl.lru.Remove(element)
+		delete(rrl.buckets, bucket.key)
+	}
+	if len(rrl.buckets) < rrl.maxBuckets {
+		return
+	}
+	element := rrl.lru.Back()
+	rrl.lru.Remove(element)
+	delete(rrl.buckets, element.Value.(*rrlBucket).key)
+	atomic.AddUint64(&rrl.stats.Evicted, 1)
+}
+
+// rrlWriter applies response rate limiting to the responses of udp queries
+type rrlWriter struct {
+	dns.ResponseWriter
+	rrl *RRL
+}
+
+func (w *rrlWriter) WriteMsg(m *dns.Msg) error {
+	switch w.rrl.Check(w.RemoteAddr(), m, time.Now()) {
+	case RRLDrop:
+		return nil
+	case RRLSlip:
+		return w.ResponseWriter.WriteMsg(truncatedReply(m))
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *rrlWriter) WritePacked(m *dns.Msg, data []byte) error {
+	switch w.rrl.Check(w.RemoteAddr(), m, time.Now()) {
+	case RRLDrop:
+		return nil
+	case RRLSlip:
+		return w.ResponseWriter.WriteMsg(truncatedReply(m))
+	}
+	return writePacked(w.ResponseWriter, m, data)
+}
+
+// truncatedReply makes real clients retry over tcp, the opt record of the
+// response built for the query is kept with its cookie and edns options
+func truncatedReply(m *dns.Msg) *dns.Msg {
+	truncated := new(dns.Msg)
+	truncated.SetReply(m)
+	truncated.Rcode = m.Rcode
+	truncated.Truncated = true
+	if opt := m.IsEdns0(); opt != nil {
+		truncated.Extra = []dns.RR{opt}
+	}
+	return truncated
+}
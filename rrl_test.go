@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRRLCheck(t *testing.T) {
+	rrl, err := NewRRL(RRLConfig{
+		ResponsesPerSecond: 5,
+		NXDomainsPerSecond: 2,
+		Window:             5,
+		Slip:               2,
+		IPv4PrefixLength:   24,
+		IPv6PrefixLength:   56,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	referral := new(dns.Msg)
+	referral.SetQuestion("www.example.com.", dns.TypeA)
+	referral.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS}, Ns: "a.gtld-servers.net."}}
+	nxdomain := new(dns.Msg)
+	nxdomain.SetQuestion("xyz.", dns.TypeA)
+	nxdomain.Rcode = dns.RcodeNameError
+
+	now := time.Now()
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}
+	neighbour := &net.UDPAddr{IP: net.ParseIP("192.0.2.200")}
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.1")}
+	for i := 0; i < 5; i++ {
+		if action := rrl.Check(client, referral, now); action != RRLSend {
+			t.Fatalf("expect response %d within rate to be sent, got %d", i, action)
+		}
+	}
+	// the same /24 shares the bucket, limited responses alternate slip and drop
+	if action := rrl.Check(neighbour, referral, now); action != RRLDrop {
+		t.Errorf("expect response over rate to be dropped, got %d", action)
+	}
+	if action := rrl.Check(client, referral, now); action != RRLSlip {
+		t.Errorf("expect second limited response to slip, got %d", action)
+	}
+	if action := rrl.Check(other, referral, now); action != RRLSend {
+		t.Errorf("expect other client not limited, got %d", action)
+	}
+	// nxdomain has its own bucket and rate
+	for i := 0; i < 2; i++ {
+		if action := rrl.Check(client, nxdomain, now); action != RRLSend {
+			t.Errorf("expect nxdomain %d within rate to be sent, got %d", i, action)
+		}
+	}
+	if action := rrl.Check(client, nxdomain, now); action == RRLSend {
+		t.Error("expect nxdomain over rate to be limited")
+	}
+	// credit comes back as time goes on
+	if action := rrl.Check(client, referral, now.Add(2*time.Second)); action != RRLSend {
+		t.Errorf("expect response sent after credit refill, got %d", action)
+	}
+	if stats := rrl.Stats(); stats.Dropped != 2 || stats.Slipped != 1 || stats.Limited != 3 {
+		t.Errorf("unexpected rrl stats %+v", stats)
+	}
+}
+
+func TestRRLLogOnly(t *testing.T) {
+	rrl, _ := NewRRL(RRLConfig{ErrorsPerSecond: 1, Window: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 56, LogOnly: true})
+	servfail := new(dns.Msg)
+	servfail.SetQuestion(".", dns.TypeSOA)
+	servfail.Rcode = dns.RcodeServerFailure
+	client := &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if action := rrl.Check(client, servfail, now); action != RRLSend {
+			t.Errorf("expect log only mode always send, got %d", action)
+		}
+	}
+	if stats := rrl.Stats(); stats.LogOnly != 2 || stats.Dropped != 0 {
+		t.Errorf("unexpected rrl stats %+v", stats)
+	}
+}
+
+func TestRRLEvict(t *testing.T) {
+	rrl, _ := NewRRL(RRLConfig{ResponsesPerSecond: 1, Window: 5, IPv4PrefixLength: 32, IPv6PrefixLength: 56})
+	rrl.maxBuckets = 3
+	referral := new(dns.Msg)
+	referral.SetQuestion("www.example.com.", dns.TypeA)
+	referral.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS}, Ns: "a.gtld-servers.net."}}
+	now := time.Now()
+	victim := &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}
+	rrl.Check(victim, referral, now)
+	// a flood of spoofed sources only evicts least recently used buckets
+	for i := 0; i < 10; i++ {
+		spoofed := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i))}
+		rrl.Check(spoofed, referral, now)
+		if action := rrl.Check(victim, referral, now); action == RRLSend {
+			t.Fatalf("expect victim still limited after %d spoofed sources", i+1)
+		}
+	}
+	if len(rrl.buckets) != 3 || rrl.lru.Len() != 3 {
+		t.Errorf("expect 3 buckets but got %d", len(rrl.buckets))
+	}
+	if stats := rrl.Stats(); stats.Evicted != 8 {
+		t.Errorf("expect 8 evicted buckets but got %+v", stats)
+	}
+	// idle buckets are removed without counting evictions
+	rrl.Check(&net.UDPAddr{IP: net.ParseIP("203.0.113.1")}, referral, now.Add(10*time.Second))
+	if stats := rrl.Stats(); len(rrl.buckets) != 1 || stats.Evicted != 8 {
+		t.Errorf("expect idle buckets removed but got %d buckets and %+v", len(rrl.buckets), stats)
+	}
+}
+
+func TestRRLSlipEDNS(t *testing.T) {
+	rrl, _ := NewRRL(RRLConfig{ResponsesPerSecond: 1, Window: 1, Slip: 1, IPv4PrefixLength: 24, IPv6PrefixLength: 56})
+	query := new(dns.Msg)
+	query.SetQuestion("com.", dns.TypeNS)
+	query.SetEdns0(1232, true)
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708a1a2a3a4a5a6a7a8"}
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}}
+	writer := &rrlWriter{ResponseWriter: w, rrl: rrl}
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetReply(query)
+		m.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeNS}, Ns: "a.gtld-servers.net."}}
+		m.SetEdns0(1232, true)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, cookie)
+		writer.WriteMsg(m)
+	}
+	opt := w.msg.IsEdns0()
+	if w.msg.Truncated == false || len(w.msg.Ns) != 0 || opt == nil || opt.Do() == false || len(opt.Option) != 1 {
+		t.Errorf("expect slipped reply truncated with the opt record and cookie but got %v", w.msg)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+//go:generate go run seed_gen.go -zone root.zone -anchor root-anchors.xml -out seed_data.go
+
+// seedZone is a root zone snapshot and the root trust anchor compiled into
+// the binary, built with -tags seed after go generate. It is only served
+// when both the sync and the local zone file fail, so a first boot without
+// network still answers.
+type seedZone struct {
+	// zone is the gzip compressed zone file
+	zone []byte
+	// anchor holds the DS records of the root trust anchor
+	anchor string
+	// published is the inception of the soa signature, the age of the
+	// snapshot counts from it
+	published time.Time
+}
+
+// embeddedSeed is set by the generated seed_data.go, nil without the seed tag
+var embeddedSeed *seedZone
+
+// load returns the zone store of the seed, which must be signed by a key of
+// the trust anchor and not be older than the soa expire interval at now
+func (seed *seedZone) load(now time.Time) (*ZoneStore, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(seed.zone))
+	if err != nil {
+		return nil, err
+	}
+	store, err := newZoneStoreFromReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	age := now.Sub(seed.published)
+	if age > store.Expire() {
+		return nil, fmt.Errorf("embedded zone serial %d is %s old, over soa expire %s",
+			store.Serial(), age.Truncate(time.Second), store.Expire())
+	}
+	anchors, err := parseTrustAnchor(seed.anchor)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.validateAnchor(anchors, now); err != nil {
+		return nil, fmt.Errorf("embedded zone serial %d: %s", store.Serial(), err)
+	}
+	return store, nil
+}
+
+// DefaultTrustAnchor holds the DS records of the root KSK-2017 and KSK-2024
+const DefaultTrustAnchor = `. 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+// EnableTrustAnchor validates the dnskey rrset of every synced or loaded
+// zone with the DS records in filename, the default root trust anchor is
+// used when filename is empty. A zone not signed by a key of the anchor is
+// served as bogus.
+func (manager *Manager) EnableTrustAnchor(filename string) error {
+	text := DefaultTrustAnchor
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+	anchors, err := parseTrustAnchor(text)
+	if err != nil {
+		return err
+	}
+	manager.anchors = anchors
+	return nil
+}
+
+// parseTrustAnchor parses the DS records of a trust anchor, one per line
+func parseTrustAnchor(text string) ([]*dns.DS, error) {
+	anchors := make([]*dns.DS, 0)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, fmt.Errorf("parse trust anchor fail: %s", err)
+		}
+		if ds, ok := rr.(*dns.DS); ok == true {
+			anchors = append(anchors, ds)
+		}
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("trust anchor has no DS record")
+	}
+	return anchors, nil
+}
+
+// validateAnchor checks the apex dnskey rrset is signed by a key matching
+// a DS record of the trust anchor and then validates the zone
+func (store *ZoneStore) validateAnchor(anchors []*dns.DS, now time.Time) error {
+	keys := store.root.rrset(dns.TypeDNSKEY).rrs
+	trusted := make([]dns.RR, 0)
+	for _, rr := range keys {
+		key, ok := rr.(*dns.DNSKEY)
+		if ok == false {
+			continue
+		}
+		for _, anchor := range anchors {
+			ds := key.ToDS(anchor.DigestType)
+			if ds != nil && ds.KeyTag == anchor.KeyTag && ds.Algorithm == anchor.Algorithm &&
+				strings.EqualFold(ds.Digest, anchor.Digest) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return errors.New("no dnskey matches the trust anchor")
+	}
+	if err := store.verifyRRSet(keys, trusted, now); err != nil {
+		return fmt.Errorf("DNSKEY rrset: %s", err)
+	}
+	return store.Validate(now)
+}
+
+// SyncFromSeed serves the zone embedded at build time, the last resort
+// when neither the sync nor the local zone file gave a zone. The embedded
+// zone is never written to the zone file, the next sync replaces it.
+func (manager *Manager) SyncFromSeed() error {
+	if embeddedSeed == nil {
+		return errors.New("no embedded zone, build with -tags seed after go generate")
+	}
+	now := time.Now()
+	data, err := embeddedSeed.load(now)
+	if err != nil {
+		return err
+	}
+	manager.pinLock.Lock()
+	defer manager.pinLock.Unlock()
+	if current := manager.snapshot(); current != nil && current.pinned {
+		return nil
+	}
+	snapshot := manager.newSnapshot(data, embeddedSeed.published)
+	snapshot.embedded = true
+	manager.publish(snapshot)
+	log.Warnf("serving embedded zone serial %d published %s, %s old",
+		data.Serial(), embeddedSeed.published.Format(time.RFC3339), now.Sub(embeddedSeed.published).Truncate(time.Second))
+	return nil
+}
+
+// warnEmbedded logs the age of the embedded zone while it is served
+func (manager *Manager) warnEmbedded(now time.Time) {
+	snapshot := manager.snapshot()
+	if snapshot == nil || snapshot.embedded == false {
+		return
+	}
+	age := now.Sub(snapshot.loaded)
+	if age > snapshot.store.Expire() {
+		log.Errorf("embedded zone serial %d is %s old and over soa expire %s, answering SERVFAIL",
+			snapshot.store.Serial(), age.Truncate(time.Second), snapshot.store.Expire())
+		return
+	}
+	log.Warnf("still serving embedded zone serial %d, %s old", snapshot.store.Serial(), age.Truncate(time.Second))
+}
@@ -0,0 +1,168 @@
+//go:build ignore
+// +build ignore
+
+// seed_gen writes seed_data.go embedding a root zone file and the root
+// trust anchor into the server, it runs with go generate and the result is
+// built in with go build -tags seed
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// trustAnchor is the iana root-anchors.xml format (RFC 7958)
+type trustAnchor struct {
+	Zone       string `xml:"Zone"`
+	KeyDigests []struct {
+		ValidFrom  string `xml:"validFrom,attr"`
+		ValidUntil string `xml:"validUntil,attr"`
+		KeyTag     uint16 `xml:"KeyTag"`
+		Algorithm  uint8  `xml:"Algorithm"`
+		DigestType uint8  `xml:"DigestType"`
+		Digest     string `xml:"Digest"`
+	} `xml:"KeyDigest"`
+}
+
+func main() {
+	zoneFile := flag.String("zone", "root.zone", "root zone file to embed")
+	anchorFile := flag.String("anchor", "root-anchors.xml", "root trust anchor as iana root-anchors.xml, or DS and DNSKEY records")
+	out := flag.String("out", "seed_data.go", "generated go file")
+	flag.Parse()
+	if err := generate(*zoneFile, *anchorFile, *out); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func generate(zoneFile string, anchorFile string, out string) error {
+	zone, err := ioutil.ReadFile(zoneFile)
+	if err != nil {
+		return err
+	}
+	published, serial, err := zonePublished(zone)
+	if err != nil {
+		return err
+	}
+	if published.IsZero() {
+		// the server refuses an embedded zone not signed by the trust anchor
+		return fmt.Errorf("zone file %s has no soa signature, only a signed zone can be embedded", zoneFile)
+	}
+	data, err := ioutil.ReadFile(anchorFile)
+	if err != nil {
+		return err
+	}
+	anchor, err := anchorRecords(data, time.Now())
+	if err != nil {
+		return err
+	}
+	compressed := new(bytes.Buffer)
+	writer, err := gzip.NewWriterLevel(compressed, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	writer.Write(zone)
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	source := new(bytes.Buffer)
+	fmt.Fprintf(source, "// Code generated by seed_gen.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(source, "//go:build seed\n// +build seed\n\npackage main\n\nimport \"time\"\n\n")
+	fmt.Fprintf(source, "// zone serial %d from %s\n", serial, zoneFile)
+	fmt.Fprintf(source, "func init() {\n\tembeddedSeed = &seedZone{\n")
+	fmt.Fprintf(source, "\t\tzone: []byte(%q),\n", compressed.String())
+	fmt.Fprintf(source, "\t\tanchor: %q,\n", strings.Join(anchor, "\n"))
+	fmt.Fprintf(source, "\t\tpublished: time.Unix(%d, 0),\n", published.Unix())
+	fmt.Fprintf(source, "\t}\n}\n")
+	formatted, err := format.Source(source.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(out, formatted, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("embed zone serial %d published %s (%d bytes compressed) and %d trust anchor records into %s\n",
+		serial, published.UTC().Format(time.RFC3339), compressed.Len(), len(anchor), out)
+	return nil
+}
+
+// zonePublished returns the inception of the apex soa signature and the
+// zone serial
+func zonePublished(zone []byte) (time.Time, uint32, error) {
+	var published time.Time
+	var soa *dns.SOA
+	for _, line := range strings.Split(string(zone), "\n") {
+		rr, err := dns.NewRR(line)
+		if err != nil || rr == nil || rr.Header().Name != "." {
+			continue
+		}
+		switch record := rr.(type) {
+		case *dns.SOA:
+			soa = record
+		case *dns.RRSIG:
+			if record.TypeCovered == dns.TypeSOA {
+				published = time.Unix(int64(record.Inception), 0)
+			}
+		}
+	}
+	if soa == nil {
+		return published, 0, errors.New("zone file has no soa record")
+	}
+	return published, soa.Serial, nil
+}
+
+// anchorRecords returns the DS records of the trust anchor valid at now
+func anchorRecords(data []byte, now time.Time) ([]string, error) {
+	records := make([]string, 0)
+	if bytes.Contains(data, []byte("<TrustAnchor")) {
+		anchor := trustAnchor{}
+		if err := xml.Unmarshal(data, &anchor); err != nil {
+			return nil, err
+		}
+		for _, digest := range anchor.KeyDigests {
+			if from, err := time.Parse(time.RFC3339, digest.ValidFrom); err == nil && from.After(now) {
+				continue
+			}
+			if until, err := time.Parse(time.RFC3339, digest.ValidUntil); err == nil && until.Before(now) {
+				continue
+			}
+			ds := &dns.DS{
+				Hdr:        dns.RR_Header{Name: dns.Fqdn(anchor.Zone), Rrtype: dns.TypeDS, Class: dns.ClassINET},
+				KeyTag:     digest.KeyTag,
+				Algorithm:  digest.Algorithm,
+				DigestType: digest.DigestType,
+				Digest:     strings.ToUpper(digest.Digest),
+			}
+			records = append(records, ds.String())
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			rr, err := dns.NewRR(line)
+			if err != nil || rr == nil {
+				continue
+			}
+			switch record := rr.(type) {
+			case *dns.DS:
+				records = append(records, record.String())
+			case *dns.DNSKEY:
+				if record.Flags&dns.SEP != 0 {
+					records = append(records, record.ToDS(dns.SHA256).String())
+				}
+			}
+		}
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no valid trust anchor found")
+	}
+	return records, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSeed builds a seed of a zone signed at inception and its trust anchor
+func testSeed(t *testing.T, inception time.Time) *seedZone {
+	rrs := signTestZone(t, inception)
+	zone := new(bytes.Buffer)
+	writer := gzip.NewWriter(zone)
+	anchor := ""
+	for _, rr := range rrs {
+		writer.Write([]byte(rr.String() + "\n"))
+		if key, ok := rr.(*dns.DNSKEY); ok == true {
+			anchor = key.ToDS(dns.SHA256).String()
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &seedZone{zone: zone.Bytes(), anchor: anchor, published: inception}
+}
+
+func TestSeedZone(t *testing.T) {
+	now := time.Now()
+	seed := testSeed(t, now.Add(-24*time.Hour))
+	store, err := seed.load(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Serial() != 2020081000 || len(store.Lookup("com.", dns.TypeNS, false).Ns) != 2 {
+		t.Errorf("expect seed zone serial 2020081000 with com. delegation but got %d", store.Serial())
+	}
+	// the soa expire of the test zone is 7 days
+	if _, err := seed.load(now.Add(7 * 24 * time.Hour)); err == nil || strings.Contains(err.Error(), "over soa expire 168h0m0s") == false {
+		t.Errorf("expect seed older than soa expire refused but got %v", err)
+	}
+	other := testSeed(t, now.Add(-24*time.Hour))
+	seed.anchor = other.anchor
+	if _, err := seed.load(now); err == nil || strings.Contains(err.Error(), "no dnskey matches the trust anchor") == false {
+		t.Errorf("expect seed signed by another key refused but got %v", err)
+	}
+	seed.anchor = ""
+	if _, err := seed.load(now); err == nil || err.Error() != "trust anchor has no DS record" {
+		t.Errorf("expect seed without trust anchor refused but got %v", err)
+	}
+}
+
+func TestSyncFromSeed(t *testing.T) {
+	saved := embeddedSeed
+	defer func() { embeddedSeed = saved }()
+	manager := newTestManager(t)
+	manager.SetEDEText(true)
+	embeddedSeed = nil
+	if err := manager.SyncFromSeed(); err == nil {
+		t.Error("expect sync from seed fail without embedded zone")
+	}
+
+	embeddedSeed = testSeed(t, time.Now().Add(-48*time.Hour))
+	if err := manager.SyncFromSeed(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := manager.snapshot()
+	stats := snapshot.stats()
+	if stats.Embedded == false || strings.HasPrefix(stats.Age, "48h0m") == false || stats.Bogus != "" {
+		t.Errorf("expect zone stats mark embedded zone 48h old but got %+v", stats)
+	}
+	options := manager.zoneErrors(snapshot, time.Now())
+	if len(options) != 1 || strings.HasPrefix(string(options[0].(*dns.EDNS0_LOCAL).Data[2:]), "embedded zone data is 48h0m") == false {
+		t.Errorf("expect answers from embedded zone carry stale answer error but got %v", options)
+	}
+
+	// the embedded zone is still served after the soa expire of 7 days
+	// when no sync succeeded, but queries are refused with SERVFAIL
+	expired := manager.newSnapshot(snapshot.store, time.Now().Add(-8*24*time.Hour))
+	expired.embedded = true
+	manager.publish(expired)
+	query := new(dns.Msg)
+	query.SetQuestion("com.", dns.TypeNS)
+	query.SetEdns0(1232, false)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+	manager.handler("udp", manager.handleRequest)(w, query)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure || len(w.msg.Ns) != 0 {
+		t.Fatalf("expect SERVFAIL from expired embedded zone but got %v", w.msg)
+	}
+	errors := queryEDE(t, manager.handler("udp", manager.handleRequest), query)
+	if errors[EDENotReady] != "embedded zone data is 192h0m0s old, over soa expire 168h0m0s" {
+		t.Errorf("expect not ready error for expired embedded zone but got %v", errors)
+	}
+	if stats := manager.snapshot().stats(); stats.Expired == false {
+		t.Errorf("expect zone stats mark embedded zone expired but got %+v", stats)
+	}
+
+	manager.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), time.Now())
+	if manager.snapshot().embedded == true {
+		t.Error("expect synced zone replace the embedded zone")
+	}
+}
+
+func TestTrustAnchor(t *testing.T) {
+	manager := &Manager{stats: NewStats(), syncDuration: time.Minute}
+	manager.SetEDEText(true)
+	if err := manager.EnableTrustAnchor(""); err != nil || len(manager.anchors) != 2 {
+		t.Fatalf("expect default root trust anchor but got %v", err)
+	}
+	now := time.Now()
+	seed := testSeed(t, now.Add(-time.Hour))
+	anchor, err := ioutil.TempFile("", "anchor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(anchor.Name())
+	anchor.WriteString(seed.anchor + "\n")
+	anchor.Close()
+	if err := manager.EnableTrustAnchor(anchor.Name()); err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := seed.load(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.setZone(trusted, now)
+	if bogus := manager.snapshot().bogus; bogus != "" {
+		t.Errorf("expect zone signed by the anchor key valid but got %s", bogus)
+	}
+	// a zone consistently signed by a key not in the anchor is bogus
+	manager.setZone(NewZoneStoreFromRRSet(signTestZone(t, now.Add(-time.Hour))), now)
+	if bogus := manager.snapshot().bogus; bogus != "no dnskey matches the trust anchor" {
+		t.Errorf("expect zone signed by a foreign key bogus but got %q", bogus)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("com.", dns.TypeNS)
+	query.SetEdns0(1232, false)
+	serve := manager.handler("udp", manager.handleRequest)
+	if errors := queryEDE(t, serve, query); errors[EDEDNSSECBogus] != "no dnskey matches the trust anchor" {
+		t.Errorf("expect dnssec bogus for zone signed by a foreign key but got %v", errors)
+	}
+	manager.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), now)
+	if manager.snapshot().bogus == "" {
+		t.Error("expect unsigned zone bogus with a trust anchor")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"time"
+)
+
+// zoneSnapshot is one published version of the zone with everything the
+// query path derives from it. A snapshot is never changed after it is
+// published, readers load it without locking and keep using it until they
+// are done, the replaced snapshot is collected once no query refers to it.
+type zoneSnapshot struct {
+	store  *ZoneStore
+	cache  *ResponseCache
+	loaded time.Time
+	bogus  string
+	// embedded is set when the zone is the seed compiled into the binary,
+	// loaded is then the time the seed was published
+	embedded bool
+	// pinned is set when the zone is an archived serial served until the
+	// pin is released
+	pinned bool
+	// generation increases with every published snapshot
+	generation uint64
+}
+
+// snapshot returns the current zone snapshot, nil before the first load
+func (manager *Manager) snapshot() *zoneSnapshot {
+	snapshot, _ := manager.zone.Load().(*zoneSnapshot)
+	return snapshot
+}
+
+// publish makes snapshot the current zone, publishers are serialized so
+// generations are published in order
+func (manager *Manager) publish(snapshot *zoneSnapshot) {
+	manager.publishLock.Lock()
+	defer manager.publishLock.Unlock()
+	manager.generation++
+	snapshot.generation = manager.generation
+	manager.zone.Store(snapshot)
+}
+
+// ZoneStats describes the zone snapshot being served
+type ZoneStats struct {
+	Serial     uint32    `json:"serial"`
+	Generation uint64    `json:"generation"`
+	Loaded     time.Time `json:"loaded"`
+	Bogus      string    `json:"bogus,omitempty"`
+	// Embedded marks the zone compiled into the binary and Age how old
+	// it is
+	Embedded bool   `json:"embedded,omitempty"`
+	Age      string `json:"age,omitempty"`
+	Pinned   bool   `json:"pinned,omitempty"`
+	// Expired marks the embedded zone older than the soa expire, queries
+	// are answered with SERVFAIL
+	Expired bool `json:"expired,omitempty"`
+}
+
+func (snapshot *zoneSnapshot) stats() *ZoneStats {
+	stats := &ZoneStats{
+		Serial:     snapshot.store.Serial(),
+		Generation: snapshot.generation,
+		Loaded:     snapshot.loaded,
+		Bogus:      snapshot.bogus,
+		Embedded:   snapshot.embedded,
+		Pinned:     snapshot.pinned,
+	}
+	if snapshot.embedded {
+		stats.Age = time.Since(snapshot.loaded).Truncate(time.Second).String()
+		stats.Expired = snapshot.expired(time.Now())
+	}
+	return stats
+}
+
+// expired reports whether the snapshot is the embedded zone and older than
+// its soa expire interval at now, it must no longer be answered from
+func (snapshot *zoneSnapshot) expired(now time.Time) bool {
+	return snapshot.embedded && now.Sub(snapshot.loaded) > snapshot.store.Expire()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestZoneSnapshotPublish(t *testing.T) {
+	manager := &Manager{stats: NewStats(), syncDuration: time.Minute}
+	if manager.snapshot() != nil {
+		t.Fatal("expect no snapshot before first load")
+	}
+	manager.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), time.Now())
+	first := manager.snapshot()
+	if first == nil || first.generation != 1 {
+		t.Fatalf("expect generation 1 but got %v", first)
+	}
+
+	// queries keep being answered while new snapshots are published
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve := manager.handler("udp", manager.handleRequest)
+			r := new(dns.Msg)
+			r.SetQuestion("com.", dns.TypeNS)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}}
+				serve(w, r)
+				if w.msg == nil || len(w.msg.Ns) != 2 {
+					t.Errorf("expect referral during publish but got %v", w.msg)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		manager.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), time.Now())
+	}
+	close(stop)
+	wg.Wait()
+	if generation := manager.snapshot().generation; generation != 21 {
+		t.Errorf("expect generation 21 but got %d", generation)
+	}
+	if first.generation != 1 || first.store.Serial() != 2020081000 {
+		t.Error("expect published snapshot never changed")
+	}
+}
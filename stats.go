@@ -0,0 +1,261 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransportStats counts the traffic served over one transport
+type TransportStats struct {
+	Queries     uint64 `json:"queries"`
+	Responses   uint64 `json:"responses"`
+	WriteErrors uint64 `json:"write_errors"`
+	BytesOut    uint64 `json:"bytes_out"`
+}
+
+// Stats keeps the per transport counters of the server
+type Stats struct {
+	sync.RWMutex
+	transports map[string]*TransportStats
+	sockets    []*SocketStats
+}
+
+func NewStats() *Stats {
+	return &Stats{transports: make(map[string]*TransportStats)}
+}
+
+func (stats *Stats) transport(name string) *TransportStats {
+	stats.RLock()
+	counter, ok := stats.transports[name]
+	stats.RUnlock()
+	if ok == true {
+		return counter
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	if counter, ok = stats.transports[name]; ok == false {
+		counter = &TransportStats{}
+		stats.transports[name] = counter
+	}
+	return counter
+}
+
+// Snapshot returns a copy of all transport counters
+func (stats *Stats) Snapshot() map[string]TransportStats {
+	stats.RLock()
+	defer stats.RUnlock()
+	result := make(map[string]TransportStats, len(stats.transports))
+	for name, counter := range stats.transports {
+		result[name] = TransportStats{
+			Queries:     atomic.LoadUint64(&counter.Queries),
+			Responses:   atomic.LoadUint64(&counter.Responses),
+			WriteErrors: atomic.LoadUint64(&counter.WriteErrors),
+			BytesOut:    atomic.LoadUint64(&counter.BytesOut),
+		}
+	}
+	return result
+}
+
+func (stats *Stats) addSocket(address string, transport string, index int) *SocketStats {
+	stats.Lock()
+	defer stats.Unlock()
+	socket := &SocketStats{Address: address, Transport: transport, Index: index}
+	stats.sockets = append(stats.sockets, socket)
+	return socket
+}
+
+// Sockets returns a copy of the counters of all listening sockets
+func (stats *Stats) Sockets() []SocketStats {
+	stats.RLock()
+	defer stats.RUnlock()
+	result := make([]SocketStats, 0, len(stats.sockets))
+	for _, socket := range stats.sockets {
+		result = append(result, SocketStats{
+			Address:     socket.Address,
+			Transport:   socket.Transport,
+			Index:       socket.Index,
+			Queries:     atomic.LoadUint64(&socket.Queries),
+			BytesIn:     atomic.LoadUint64(&socket.BytesIn),
+			ReadErrors:  atomic.LoadUint64(&socket.ReadErrors),
+			Batches:     atomic.LoadUint64(&socket.Batches),
+			WriteErrors: atomic.LoadUint64(&socket.WriteErrors),
+		})
+	}
+	return result
+}
+
+// Transports returns the sorted names of transports which have traffic
+func (stats *Stats) Transports() []string {
+	stats.RLock()
+	defer stats.RUnlock()
+	names := make([]string, 0, len(stats.transports))
+	for name := range stats.transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// statsWriter counts the responses written to client
+type statsWriter struct {
+	dns.ResponseWriter
+	counter *TransportStats
+}
+
+func (w *statsWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		atomic.AddUint64(&w.counter.WriteErrors, 1)
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *statsWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	if err != nil {
+		atomic.AddUint64(&w.counter.WriteErrors, 1)
+		return n, err
+	}
+	atomic.AddUint64(&w.counter.Responses, 1)
+	atomic.AddUint64(&w.counter.BytesOut, uint64(n))
+	return n, nil
+}
+
+func (w *statsWriter) WritePacked(m *dns.Msg, data []byte) error {
+	_, err := w.Write(data)
+	return err
+}
+
+// queryEvent describes one served query for telemetry outputs, Query and
+// Response are wire data and Rcode is -1 when no response was sent
+type queryEvent struct {
+	Transport string
+	Client    net.Addr
+	Local     net.Addr
+	Question  dns.Question
+	Rcode     int
+	Query     []byte
+	Response  []byte
+	Start     time.Time
+	End       time.Time
+	// Serial and Generation are of the zone snapshot current when the
+	// query arrived
+	Serial     uint32
+	Generation uint64
+	// Request and Reply are the query and response messages, Reply is nil
+	// when the response was written as wire data and Query is only packed
+	// for dnstap
+	Request *dns.Msg
+	Reply   *dns.Msg
+}
+
+// captureWriter keeps a copy of the response wire data and the response
+// message when it was written as one
+type captureWriter struct {
+	dns.ResponseWriter
+	data []byte
+	msg  *dns.Msg
+}
+
+func (w *captureWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	w.msg = m
+	return err
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	w.data = data
+	w.msg = nil
+	return w.ResponseWriter.Write(data)
+}
+
+// observe sends the query and its response to the telemetry outputs
+func (manager *Manager) observe(transport string, w *captureWriter, r *dns.Msg, start time.Time, snapshot *zoneSnapshot) {
+	event := &queryEvent{
+		Transport: transport,
+		Client:    w.RemoteAddr(),
+		Local:     w.LocalAddr(),
+		Rcode:     -1,
+		Response:  w.data,
+		Start:     start,
+		End:       time.Now(),
+		Request:   r,
+		Reply:     w.msg,
+	}
+	if len(r.Question) > 0 {
+		event.Question = r.Question[0]
+	}
+	if len(w.data) > 3 {
+		event.Rcode = int(w.data[3] & 0xF)
+	}
+	if manager.tap != nil {
+		// only the dnstap query frame needs the wire data, it is skipped
+		// when the query can not be packed
+		if query, err := r.Pack(); err == nil {
+			event.Query = query
+		}
+	}
+	if snapshot != nil {
+		event.Serial = snapshot.store.Serial()
+		event.Generation = snapshot.generation
+	}
+	if manager.tap != nil {
+		manager.tap.Log(event)
+	}
+	if manager.queryLog != nil {
+		manager.queryLog.Log(event)
+	}
+	if manager.analytics != nil {
+		manager.analytics.Record(event)
+	}
+}
+
+// observing reports whether any telemetry output needs query events
+func (manager *Manager) observing() bool {
+	return manager.tap != nil || manager.queryLog != nil || manager.analytics != nil
+}
+
+// handler returns the dns handler of transport which records the traffic
+// into stats and checks acl before serving the query
+func (manager *Manager) handler(transport string, serve dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if manager.observing() {
+			capture := &captureWriter{ResponseWriter: w}
+			defer manager.observe(transport, capture, r, time.Now(), manager.snapshot())
+			w = capture
+		}
+		counter := manager.stats.transport(transport)
+		atomic.AddUint64(&counter.Queries, 1)
+		cookie, cookieOption := manager.cookies.Check(w.RemoteAddr(), r, time.Now())
+		var writer dns.ResponseWriter = &statsWriter{ResponseWriter: w, counter: counter}
+		// a valid server cookie proves the client owns its source address
+		if transport == "udp" && manager.rrl != nil && cookie != CookieValid {
+			writer = &rrlWriter{ResponseWriter: writer, rrl: manager.rrl}
+		}
+		writer = manager.ednsWriter(writer, r, transport)
+		if cookieOption != nil {
+			writer = &cookieWriter{ResponseWriter: writer, option: cookieOption}
+		}
+		if manager.checkACL(writer, r, transport) == false {
+			return
+		}
+		if manager.checkCookie(writer, r, cookie) == false {
+			return
+		}
+		// refused clients and spoofed sources must not fill the client table
+		if manager.trustAnchors != nil {
+			manager.trustAnchors.Observe(w.RemoteAddr(), r)
+		}
+		serve(writer, r)
+	}
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"github.com/miekg/dns"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"time"
 )
 
 //  None of the root services are guaranteed to be available.
@@ -25,14 +31,30 @@ var ZoneDownloadURL = []string{
 	"https://www.internic.net/domain/root.zone",
 }
 
-type ZoneData struct {
-	NS         []dns.RR
-	Additional []dns.RR
-}
+// ZoneStore holds the zone as a tree of labels. Each node interns its owner
+// name once and holds its rrsets sorted by type: the rrsets Lookup answers
+// with (the apex, delegation NS and their glue addresses) are kept decoded,
+// the others (DS, NSEC, RRSIG of delegations) only in packed wire form.
 type ZoneStore struct {
-	data map[string]map[uint16][]dns.RR
-	zone map[string]*ZoneData
-	rrsigs map[string]map[uint16]dns.RR
+	root *zoneNode
+}
+
+// zoneNode is a name of the zone, children are sorted in canonical order
+// and additional holds the glue of a delegation, shared with the glue rrsets
+type zoneNode struct {
+	name       string
+	label      string
+	children   []*zoneNode
+	rrsets     []zoneRRSet
+	additional []dns.RR
+}
+
+// zoneRRSet is an rrset in canonical record order, either decoded or packed
+// as records with the root as owner
+type zoneRRSet struct {
+	rrtype uint16
+	rrs    []dns.RR
+	wire   []byte
 }
 
 func NewZoneStoreFromFile(filename string) (*ZoneStore, error) {
@@ -45,83 +67,409 @@ func NewZoneStoreFromFile(filename string) (*ZoneStore, error) {
 		return nil, err
 	}
 	defer file.Close()
+	return newZoneStoreFromReader(file)
+}
 
-	scanner := bufio.NewScanner(file)
-	rrs := make([]dns.RR, 0)
+// newZoneStoreFromReader builds a zone store from zone file content with
+// one record per line
+func newZoneStoreFromReader(reader io.Reader) (*ZoneStore, error) {
+	scanner := bufio.NewScanner(reader)
+	builder := newZoneBuilder()
 	for scanner.Scan() {
 		rr, err := dns.NewRR(scanner.Text())
-		if err != nil {
+		if err != nil || rr == nil {
 			continue
 		}
-		rrs = append(rrs, rr)
+		builder.add(rr)
 	}
-	zoneStore := NewZoneStoreFromRRSet(rrs)
-	if zoneStore == nil {
-		return nil, errors.New("zone store not create success")
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	return zoneStore, nil
+	return builder.finish()
 }
 
 func NewZoneStoreFromRRSet(data []dns.RR) *ZoneStore {
 	if len(data) == 0 {
 		return nil
 	}
-	results := make(map[string]map[uint16][]dns.RR)
-	rrsigs := make(map[string]map[uint16]dns.RR)
+	builder := newZoneBuilder()
 	for _, rr := range data {
-		domain := rr.Header().Name
-		qType := rr.Header().Rrtype
-		_, ok := results[domain]
-		if ok != true {
-			results[domain] = make(map[uint16][]dns.RR)
-		}
-		_, ok = results[domain][qType]
-		if ok != true {
-			results[domain][qType] = make([]dns.RR, 0)
-		}
-		results[domain][qType] = append(results[domain][qType], rr)
-		if qType == dns.TypeRRSIG{
-			_, ok := rrsigs[domain]
-			if ok == false {
-				rrsigs[domain] = make(map[uint16]dns.RR)
+		builder.add(rr)
+	}
+	store, err := builder.finish()
+	if err != nil {
+		log.Errorf("build zone store fail: %s", err)
+		return nil
+	}
+	return store
+}
+
+// zoneBuilder collects records into the label tree of a zone store
+type zoneBuilder struct {
+	root     *zoneNode
+	children map[*zoneNode]map[string]*zoneNode
+	records  map[*zoneNode]map[uint16][]dns.RR
+	names    map[string]string
+	buf      []byte
+}
+
+func newZoneBuilder() *zoneBuilder {
+	return &zoneBuilder{
+		root:     &zoneNode{name: "."},
+		children: make(map[*zoneNode]map[string]*zoneNode),
+		records:  make(map[*zoneNode]map[uint16][]dns.RR),
+		names:    make(map[string]string),
+		buf:      make([]byte, dns.MaxMsgSize+256),
+	}
+}
+
+// intern returns the shared copy of name
+func (builder *zoneBuilder) intern(name string) string {
+	if interned, ok := builder.names[name]; ok == true {
+		return interned
+	}
+	builder.names[name] = name
+	return name
+}
+
+// node returns the node of name, creating it and its ancestors
+func (builder *zoneBuilder) node(name string) *zoneNode {
+	node := builder.root
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := strings.ToLower(labels[i])
+		children, ok := builder.children[node]
+		if ok == false {
+			children = make(map[string]*zoneNode)
+			builder.children[node] = children
+		}
+		child, ok := children[label]
+		if ok == false {
+			child = &zoneNode{name: builder.intern(strings.Join(labels[i:], ".") + ".")}
+			// the label shares the name string unless its case differs
+			child.label = label
+			if child.name[:len(label)] == label {
+				child.label = child.name[:len(label)]
 			}
-			rrsigs[domain][qType] = rr
+			children[label] = child
 		}
+		node = child
+	}
+	return node
+}
+
+func (builder *zoneBuilder) add(rr dns.RR) {
+	node := builder.node(rr.Header().Name)
+	types, ok := builder.records[node]
+	if ok == false {
+		types = make(map[uint16][]dns.RR)
+		builder.records[node] = types
 	}
-	zone := make(map[string]*ZoneData)
-	for domain, store := range results {
-		nsdata, ok := store[dns.TypeNS]
-		if ok != true {
+	types[rr.Header().Rrtype] = append(types[rr.Header().Rrtype], rr)
+}
+
+// finish sorts the tree, packs the rrsets Lookup does not answer with and
+// links the glue of the delegations
+func (builder *zoneBuilder) finish() (*ZoneStore, error) {
+	glue := make(map[string]bool)
+	delegations := make([]*zoneNode, 0)
+	for node, types := range builder.records {
+		if len(types[dns.TypeNS]) == 0 {
 			continue
 		}
-		zoneItme := ZoneData{
-			NS:         make([]dns.RR, 0),
-			Additional: make([]dns.RR, 0),
+		delegations = append(delegations, node)
+		for _, rr := range types[dns.TypeNS] {
+			if ns, ok := rr.(*dns.NS); ok == true {
+				glue[strings.ToLower(ns.Ns)] = true
+			}
+		}
+	}
+	if len(delegations) == 0 {
+		return nil, errors.New("zone has no NS records")
+	}
+	if err := builder.finishNode(builder.root, glue); err != nil {
+		return nil, err
+	}
+	store := &ZoneStore{root: builder.root}
+	if err := store.link(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (builder *zoneBuilder) finishNode(node *zoneNode, glue map[string]bool) error {
+	types := builder.records[node]
+	qTypes := make([]int, 0, len(types))
+	for qType := range types {
+		qTypes = append(qTypes, int(qType))
+	}
+	sort.Ints(qTypes)
+	node.rrsets = make([]zoneRRSet, 0, len(qTypes))
+	for _, qType := range qTypes {
+		decoded := node == builder.root || qType == int(dns.TypeNS) ||
+			(qType == int(dns.TypeA) || qType == int(dns.TypeAAAA)) && glue[strings.ToLower(node.name)]
+		rrset, err := builder.rrset(node, types[uint16(qType)], decoded)
+		if err != nil {
+			return err
+		}
+		node.rrsets = append(node.rrsets, rrset)
+	}
+	delete(builder.records, node)
+	node.children = make([]*zoneNode, 0, len(builder.children[node]))
+	for _, child := range builder.children[node] {
+		node.children = append(node.children, child)
+	}
+	sort.Slice(node.children, func(i, j int) bool {
+		return node.children[i].label < node.children[j].label
+	})
+	delete(builder.children, node)
+	for _, child := range node.children {
+		if err := builder.finishNode(child, glue); err != nil {
+			return err
 		}
-		zoneItme.NS = append(zoneItme.NS, store[dns.TypeNS]...)
-		for _, rr := range nsdata {
-			casted, ok := rr.(*dns.NS)
+	}
+	return nil
+}
+
+// rrset sorts rrs by their rdata in wire form and drops duplicates, the
+// decoded records share the interned node name
+func (builder *zoneBuilder) rrset(node *zoneNode, rrs []dns.RR, decoded bool) (zoneRRSet, error) {
+	rrset := zoneRRSet{rrtype: rrs[0].Header().Rrtype}
+	records := make([][]byte, len(rrs))
+	for i, rr := range rrs {
+		record, err := packRecord(rr, builder.buf)
+		if err != nil {
+			return rrset, fmt.Errorf("pack %s fail: %s", rr.String(), err)
+		}
+		records[i] = append([]byte{}, record...)
+	}
+	order := make([]int, len(rrs))
+	for i := range order {
+		order[i] = i
+	}
+	// the root owner byte and the fixed header precede the rdata
+	sort.SliceStable(order, func(i, j int) bool {
+		return bytes.Compare(records[order[i]][11:], records[order[j]][11:]) < 0
+	})
+	unique, size := order[:0], 0
+	for i, index := range order {
+		if i > 0 && bytes.Equal(records[index][11:], records[order[i-1]][11:]) {
+			continue
+		}
+		unique = append(unique, index)
+		size += len(records[index])
+	}
+	if decoded == false {
+		rrset.wire = make([]byte, 0, size)
+		for _, index := range unique {
+			rrset.wire = append(rrset.wire, records[index]...)
+		}
+		return rrset, nil
+	}
+	rrset.rrs = make([]dns.RR, 0, len(unique))
+	for _, index := range unique {
+		rr := rrs[index]
+		rr.Header().Name = node.name
+		if ns, ok := rr.(*dns.NS); ok == true {
+			ns.Ns = builder.intern(ns.Ns)
+		}
+		rrset.rrs = append(rrset.rrs, rr)
+	}
+	return rrset, nil
+}
+
+// packRecord packs rr into buf with the root as owner
+func packRecord(rr dns.RR, buf []byte) ([]byte, error) {
+	end, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	owner := 0
+	for buf[owner] != 0 {
+		owner += int(buf[owner]) + 1
+	}
+	return buf[owner:end], nil
+}
+
+// noRRSet is returned for the types a node has no records of
+var noRRSet = &zoneRRSet{}
+
+// link decodes the packed rrsets Lookup answers with, shares the NS target
+// names with the glue nodes and collects the additional glue of delegations
+func (store *ZoneStore) link() error {
+	delegations := make([]*zoneNode, 0)
+	var visit func(node *zoneNode) error
+	visit = func(node *zoneNode) error {
+		if ns := node.rrset(dns.TypeNS); ns != noRRSet {
+			if err := ns.decode(node.name); err != nil {
+				return err
+			}
+			delegations = append(delegations, node)
+		}
+		for _, child := range node.children {
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(store.root); err != nil {
+		return err
+	}
+	for i := range store.root.rrsets {
+		if err := store.root.rrsets[i].decode(store.root.name); err != nil {
+			return err
+		}
+	}
+	for _, node := range delegations {
+		hosts := make([]*zoneNode, 0)
+		size := 0
+		for _, rr := range node.rrset(dns.TypeNS).rrs {
+			ns, ok := rr.(*dns.NS)
 			if ok == false {
 				continue
 			}
-			if z, ok := results[casted.Ns]; ok == true {
-				if aData, ok := z[dns.TypeA]; ok == true {
-					zoneItme.Additional = append(zoneItme.Additional, aData...)
-				}
-				if aaaaData, ok := z[dns.TypeAAAA]; ok == true {
-					zoneItme.Additional = append(zoneItme.Additional, aaaaData...)
+			host := store.find(ns.Ns)
+			if host == nil {
+				continue
+			}
+			ns.Ns = host.name
+			for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if err := host.rrset(qType).decode(host.name); err != nil {
+					return err
 				}
+				size += len(host.rrset(qType).rrs)
 			}
+			hosts = append(hosts, host)
+		}
+		if size == 0 {
+			continue
+		}
+		node.additional = make([]dns.RR, 0, size)
+		for _, host := range hosts {
+			node.additional = append(node.additional, host.rrset(dns.TypeA).rrs...)
+			node.additional = append(node.additional, host.rrset(dns.TypeAAAA).rrs...)
+		}
+	}
+	return nil
+}
+
+// rrset returns the rrset of qType, an empty rrset if the node has none
+func (node *zoneNode) rrset(qType uint16) *zoneRRSet {
+	for i := range node.rrsets {
+		if node.rrsets[i].rrtype == qType {
+			return &node.rrsets[i]
+		}
+	}
+	return noRRSet
+}
+
+// child returns the child with the lower case label
+func (node *zoneNode) child(label string) *zoneNode {
+	index := sort.Search(len(node.children), func(i int) bool {
+		return node.children[i].label >= label
+	})
+	if index < len(node.children) && node.children[index].label == label {
+		return node.children[index]
+	}
+	return nil
+}
+
+// records returns the records of the rrset, packed rrsets are decoded
+func (rrset *zoneRRSet) records(owner string) ([]dns.RR, error) {
+	if rrset.wire == nil {
+		return rrset.rrs, nil
+	}
+	rrs := make([]dns.RR, 0)
+	for offset := 0; offset < len(rrset.wire); {
+		rr, next, err := dns.UnpackRR(rrset.wire, offset)
+		if err != nil {
+			return nil, err
 		}
-		zone[domain] = &zoneItme
+		rr.Header().Name = owner
+		rrs = append(rrs, rr)
+		offset = next
 	}
-	if len(results) == 0 || len(zone) == 0 {
+	return rrs, nil
+}
+
+// decode keeps the records of a packed rrset decoded instead
+func (rrset *zoneRRSet) decode(owner string) error {
+	if rrset.wire == nil {
 		return nil
 	}
-	zoneStore := &ZoneStore{data: results, zone: zone, rrsigs: rrsigs}
-	return zoneStore
+	rrs, err := rrset.records(owner)
+	if err != nil {
+		return err
+	}
+	rrset.rrs = rrs[:len(rrs):len(rrs)]
+	rrset.wire = nil
+	return nil
 }
 
+// find returns the node of name or nil
+func (store *ZoneStore) find(name string) *zoneNode {
+	node := store.root
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0 && node != nil; i-- {
+		node = node.child(strings.ToLower(labels[i]))
+	}
+	return node
+}
+
+// RRSet returns the records of name and qType, decoding them if the store
+// keeps them packed
+func (store *ZoneStore) RRSet(name string, qType uint16) []dns.RR {
+	node := store.find(name)
+	if node == nil {
+		return nil
+	}
+	rrs, err := node.rrset(qType).records(node.name)
+	if err != nil {
+		log.Errorf("decode %s %s fail: %s", name, dns.TypeToString[qType], err)
+	}
+	return rrs
+}
+
+// Walk calls fn with every rrset of the zone in canonical order (RFC 4034
+// section 6), names ordered by their lower case labels from the root and
+// rrsets of a name by type, it stops at the first error of fn. Labels are
+// compared in presentation form, which is the canonical order for names
+// without escapes.
+func (store *ZoneStore) Walk(fn func(rrs []dns.RR) error) error {
+	return store.walk(store.root, fn)
+}
+
+func (store *ZoneStore) walk(node *zoneNode, fn func(rrs []dns.RR) error) error {
+	for i := range node.rrsets {
+		rrs, err := node.rrsets[i].records(node.name)
+		if err != nil {
+			return fmt.Errorf("decode %s %s fail: %s", node.name, dns.TypeToString[node.rrsets[i].rrtype], err)
+		}
+		if err := fn(rrs); err != nil {
+			return err
+		}
+	}
+	for _, child := range node.children {
+		if err := store.walk(child, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// soa returns the zone soa record
+func (store *ZoneStore) soa() *dns.SOA {
+	if rrs := store.root.rrset(dns.TypeSOA).rrs; len(rrs) > 0 {
+		if casted, ok := rrs[0].(*dns.SOA); ok {
+			return casted
+		}
+	}
+	return nil
+}
+
+// ToFile writes the zone with the soa record first and the other rrsets in
+// canonical order
 func (store *ZoneStore) ToFile(filename string) error {
 	err := fileCreateIfNotExists(filename)
 	if err != nil {
@@ -132,45 +480,192 @@ func (store *ZoneStore) ToFile(filename string) error {
 		return err
 	}
 	defer file.Close()
-	for _, typeWithRRs := range store.data {
-		for _, rrs := range typeWithRRs {
-			for _, rr := range rrs {
-				_, err := file.WriteString(rr.String() + "\n")
-				if err != nil {
-					log.Errorf(err.Error())
-				}
+	return store.write(file)
+}
+
+// write writes the zone in zone file format, the soa first
+func (store *ZoneStore) write(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	soa := store.soa()
+	if soa != nil {
+		writer.WriteString(soa.String() + "\n")
+	}
+	err := store.Walk(func(rrs []dns.RR) error {
+		if rrs[0] == dns.RR(soa) {
+			return nil
+		}
+		for _, rr := range rrs {
+			if _, err := writer.WriteString(rr.String() + "\n"); err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// TransferRRs returns all records of zone in axfr order which starts and
+// ends with the zone soa record
+func (store *ZoneStore) TransferRRs() []dns.RR {
+	soa := store.soa()
+	if soa == nil {
+		return nil
+	}
+	rrs := []dns.RR{soa}
+	err := store.Walk(func(rrset []dns.RR) error {
+		if rrset[0] != dns.RR(soa) {
+			rrs = append(rrs, rrset...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("walk zone fail: %s", err)
+		return nil
+	}
+	return append(rrs, soa)
+}
+
+// Lookup paths describe how a query is answered by the zone
+const (
+	LookupApex     = "apex"
+	LookupReferral = "referral"
+	LookupNXDomain = "nxdomain"
+)
+
+// QueryResult is the response data of a query and how it was found
+type QueryResult struct {
+	Answer     []dns.RR
+	Ns         []dns.RR
+	Additional []dns.RR
+	Rcode      int
+	AA         bool
+	Path       string
+}
+
+// Serial returns the serial of the zone soa record
+func (store *ZoneStore) Serial() uint32 {
+	if soa := store.soa(); soa != nil {
+		return soa.Serial
+	}
+	return 0
+}
+
+// TLDs returns the names of the delegated top level domains in canonical
+// order
+func (store *ZoneStore) TLDs() []string {
+	tlds := make([]string, 0, len(store.root.children))
+	for _, child := range store.root.children {
+		if len(child.rrset(dns.TypeNS).rrs) > 0 {
+			tlds = append(tlds, child.name)
+		}
+	}
+	return tlds
+}
+
+// Refresh returns the refresh interval of the zone soa record
+func (store *ZoneStore) Refresh() time.Duration {
+	if soa := store.soa(); soa != nil {
+		return time.Duration(soa.Refresh) * time.Second
+	}
+	return 0
+}
+
+// Expire returns the expire interval of the zone soa record, how long a
+// secondary may serve the zone without reaching its primary
+func (store *ZoneStore) Expire() time.Duration {
+	if soa := store.soa(); soa != nil {
+		return time.Duration(soa.Expire) * time.Second
+	}
+	return 0
+}
+
+// Validate verifies the signatures of the apex soa and dnskey rrsets with
+// the zone keys, an unsigned zone has nothing to validate
+func (store *ZoneStore) Validate(now time.Time) error {
+	keys := store.root.rrset(dns.TypeDNSKEY).rrs
+	if len(keys) == 0 {
+		return nil
+	}
+	for _, qType := range []uint16{dns.TypeSOA, dns.TypeDNSKEY} {
+		rrset := store.root.rrset(qType).rrs
+		if len(rrset) == 0 {
+			return fmt.Errorf("no %s rrset at apex", dns.TypeToString[qType])
+		}
+		if err := store.verifyRRSet(rrset, keys, now); err != nil {
+			return fmt.Errorf("%s rrset: %s", dns.TypeToString[qType], err)
+		}
 	}
 	return nil
 }
+
+func (store *ZoneStore) verifyRRSet(rrset []dns.RR, keys []dns.RR, now time.Time) error {
+	err := errors.New("no signature")
+	for _, rr := range store.root.rrset(dns.TypeRRSIG).rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if ok == false || sig.TypeCovered != rrset[0].Header().Rrtype {
+			continue
+		}
+		if sig.ValidityPeriod(now) == false {
+			err = errors.New("signature is not in validity period")
+			continue
+		}
+		for _, keyRR := range keys {
+			key, ok := keyRR.(*dns.DNSKEY)
+			if ok == false || key.KeyTag() != sig.KeyTag {
+				continue
+			}
+			if err = sig.Verify(key, rrset); err == nil {
+				return nil
+			}
+		}
+	}
+	return err
+}
+
 func (store *ZoneStore) Query(domain string, qType uint16, do bool) (answer []dns.RR, ns []dns.RR, additional []dns.RR, aa bool) {
+	result := store.Lookup(domain, qType, do)
+	return result.Answer, result.Ns, result.Additional, result.AA
+}
+
+// Lookup answers the query from zone data, names below a tld which is not
+// delegated in the zone do not exist
+func (store *ZoneStore) Lookup(domain string, qType uint16, do bool) *QueryResult {
+	result := &QueryResult{Rcode: dns.RcodeSuccess}
 	domain = dns.Fqdn(domain)
 	if domain == "." {
-		if data, ok := store.data[domain]; ok {
-			if typeData, ok := data[qType]; ok {
-				answer = typeData
-				if qType == dns.TypeNS {
-					additional = store.zone[domain].Additional
-				}
-			} else {
-				if soa, ok := data[dns.TypeSOA]; ok {
-					ns = soa
-				}
+		result.Path = LookupApex
+		if answer := store.root.rrset(qType).rrs; len(answer) > 0 {
+			result.Answer = answer
+			if qType == dns.TypeNS {
+				result.Additional = store.root.additional
 			}
+		} else {
+			result.Ns = store.root.rrset(dns.TypeSOA).rrs
 		}
-		aa = true
+		result.AA = true
 	} else {
-		tld := getTLDFromDomain(domain)
-		if data, ok := store.data[tld]; ok {
-			if typeData, ok := data[dns.TypeNS]; ok {
-				ns = typeData
-				additional = store.zone[tld].Additional
+		// the last label of the fully qualified name is the tld
+		end := len(domain) - 1
+		tld := store.root.child(strings.ToLower(domain[strings.LastIndexByte(domain[:end], '.')+1 : end]))
+		result.Path = LookupNXDomain
+		if tld != nil {
+			if ns := tld.rrset(dns.TypeNS).rrs; len(ns) > 0 {
+				result.Path = LookupReferral
+				result.Ns = ns
+				result.Additional = tld.additional
 			}
 		}
+		if result.Path == LookupNXDomain {
+			result.Rcode = dns.RcodeNameError
+			result.AA = true
+			result.Ns = store.root.rrset(dns.TypeSOA).rrs
+		}
 	}
-	if do == true{
+	if do == true {
 		//Todo: append rrsig for each response type
 	}
-	return
+	return result
 }
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
 func TestAxfrSynchronizer(t *testing.T) {
-	synchronizer, err := NewAXFRSynchronizer("file.test", "")
+	synchronizer, err := NewAXFRSynchronizer("file.test", "", nil)
 	if err != nil {
 		t.Errorf("empty server will alway use default and never fail")
 		return
 	}
-	data, err := synchronizer.Download()
+	data, err := synchronizer.Download(context.Background())
 	if err != nil {
 		t.Errorf("download fail : %s", err)
 		return
@@ -19,3 +28,228 @@ func TestAxfrSynchronizer(t *testing.T) {
 
 	fmt.Printf("%v", data)
 }
+
+// testZoneRRs returns a small signed-looking root zone used by offline tests
+func testZoneRRs(t testing.TB) []dns.RR {
+	records := []string{
+		". 86400 IN SOA a.root-servers.net. nstld.verisign-grs.com. 2020081000 1800 900 604800 86400",
+		". 518400 IN NS a.root-servers.net.",
+		". 518400 IN NS b.root-servers.net.",
+		"a.root-servers.net. 518400 IN A 198.41.0.4",
+		"a.root-servers.net. 518400 IN AAAA 2001:503:ba3e::2:30",
+		"b.root-servers.net. 518400 IN A 199.9.14.201",
+		"com. 172800 IN NS a.gtld-servers.net.",
+		"com. 172800 IN NS b.gtld-servers.net.",
+		"com. 86400 IN DS 30909 8 2 E2D3C916F6DEEAC73294E8268FB5885044A833FC5459588F4A9184CFC41A5766",
+		"a.gtld-servers.net. 172800 IN A 192.5.6.30",
+		"b.gtld-servers.net. 172800 IN A 192.33.14.30",
+		"b.gtld-servers.net. 172800 IN AAAA 2001:503:231d::2:30",
+		"net. 172800 IN NS a.gtld-servers.net.",
+	}
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("parse test record %s fail: %s", record, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func TestZoneStoreLookup(t *testing.T) {
+	store := NewZoneStoreFromRRSet(testZoneRRs(t))
+	for _, c := range []struct {
+		domain string
+		qType  uint16
+		path   string
+		rcode  int
+		answer int
+		ns     int
+		extra  int
+	}{
+		{".", dns.TypeNS, LookupApex, dns.RcodeSuccess, 2, 0, 3},
+		{".", dns.TypeMX, LookupApex, dns.RcodeSuccess, 0, 1, 0},
+		{"com.", dns.TypeNS, LookupReferral, dns.RcodeSuccess, 0, 2, 3},
+		{"www.example.com.", dns.TypeA, LookupReferral, dns.RcodeSuccess, 0, 2, 3},
+		{"a.root-servers.net.", dns.TypeA, LookupReferral, dns.RcodeSuccess, 0, 1, 1},
+		{"xyz.", dns.TypeA, LookupNXDomain, dns.RcodeNameError, 0, 1, 0},
+	} {
+		result := store.Lookup(c.domain, c.qType, false)
+		if result.Path != c.path || result.Rcode != c.rcode || len(result.Answer) != c.answer ||
+			len(result.Ns) != c.ns || len(result.Additional) != c.extra {
+			t.Errorf("lookup %s %s: expect %s rcode=%d %d/%d/%d, got %s rcode=%d %d/%d/%d",
+				c.domain, dns.TypeToString[c.qType], c.path, c.rcode, c.answer, c.ns, c.extra,
+				result.Path, result.Rcode, len(result.Answer), len(result.Ns), len(result.Additional))
+		}
+	}
+	if store.Serial() != 2020081000 {
+		t.Errorf("expect serial 2020081000, got %d", store.Serial())
+	}
+}
+
+func TestZoneStoreWalk(t *testing.T) {
+	rrs := testZoneRRs(t)
+	for _, record := range []string{
+		"COM. 86400 IN RRSIG DS 8 1 86400 20200823050000 20200810040000 46594 . AAECAwQFBgcICQ==",
+		"com. 172800 IN NS a.gtld-servers.net.",
+	} {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	store := NewZoneStoreFromRRSet(rrs)
+	walked := make([]string, 0)
+	err := store.Walk(func(rrset []dns.RR) error {
+		walked = append(walked, rrset[0].Header().Name+" "+dns.TypeToString[rrset[0].Header().Rrtype])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		". NS", ". SOA", "com. NS", "com. DS", "com. RRSIG", "net. NS",
+		"a.gtld-servers.net. A", "b.gtld-servers.net. A", "b.gtld-servers.net. AAAA",
+		"a.root-servers.net. A", "a.root-servers.net. AAAA", "b.root-servers.net. A",
+	}
+	if strings.Join(walked, ", ") != strings.Join(expect, ", ") {
+		t.Errorf("expect canonical order %v but got %v", expect, walked)
+	}
+	if ns := store.RRSet("com.", dns.TypeNS); len(ns) != 2 {
+		t.Errorf("expect duplicate NS record dropped but got %v", ns)
+	}
+	// delegation signatures are kept packed and decoded on demand
+	if sigs := store.RRSet("com.", dns.TypeRRSIG); len(sigs) != 1 || sigs[0].Header().Name != "com." || sigs[0].(*dns.RRSIG).KeyTag != 46594 {
+		t.Errorf("expect packed RRSIG of com. decoded but got %v", sigs)
+	}
+	if result := store.Lookup("WWW.Com.", dns.TypeA, false); result.Path != LookupReferral || len(result.Additional) != 3 {
+		t.Errorf("expect case insensitive referral to com. but got %s with %d additional", result.Path, len(result.Additional))
+	}
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "root.zone")
+	if err := store.ToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := NewZoneStoreFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(loaded.TransferRRs()) != fmt.Sprint(store.TransferRRs()) {
+		t.Errorf("expect zone file round trip the same records but got\n%v\n%v", loaded.TransferRRs(), store.TransferRRs())
+	}
+}
+
+// legacyZoneStore builds the nested maps of the zone store before the label
+// tree, to compare their heap use
+func legacyZoneStore(data []dns.RR) interface{} {
+	results := make(map[string]map[uint16][]dns.RR)
+	for _, rr := range data {
+		domain, qType := rr.Header().Name, rr.Header().Rrtype
+		if _, ok := results[domain]; ok == false {
+			results[domain] = make(map[uint16][]dns.RR)
+		}
+		results[domain][qType] = append(results[domain][qType], rr)
+	}
+	additional := make(map[string][]dns.RR)
+	for domain, store := range results {
+		for _, rr := range store[dns.TypeNS] {
+			if z, ok := results[rr.(*dns.NS).Ns]; ok == true {
+				additional[domain] = append(additional[domain], z[dns.TypeA]...)
+				additional[domain] = append(additional[domain], z[dns.TypeAAAA]...)
+			}
+		}
+	}
+	return []interface{}{results, additional}
+}
+
+// benchZoneRecords returns a signed root like zone of tlds delegations,
+// each with two in zone name servers, a DS and a NSEC with signatures
+func benchZoneRecords(tlds int) []string {
+	random := rand.New(rand.NewSource(1))
+	signature := func() string {
+		data := make([]byte, 256)
+		random.Read(data)
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	records := []string{
+		". 86400 IN SOA a.root-servers.net. nstld.verisign-grs.com. 2020081000 1800 900 604800 86400",
+		". 518400 IN NS a.root-servers.net.",
+		"a.root-servers.net. 518400 IN A 198.41.0.4",
+	}
+	for i := 0; i < tlds; i++ {
+		tld, next := fmt.Sprintf("tld%04d.", i), fmt.Sprintf("tld%04d.", (i+1)%tlds)
+		records = append(records,
+			fmt.Sprintf("%s 172800 IN NS ns1.nic.%s", tld, tld),
+			fmt.Sprintf("%s 172800 IN NS ns2.nic.%s", tld, tld),
+			fmt.Sprintf("%s 172800 IN NS a.root-servers.net.", tld),
+			fmt.Sprintf("ns1.nic.%s 172800 IN A 192.0.2.%d", tld, i%250+1),
+			fmt.Sprintf("ns1.nic.%s 172800 IN AAAA 2001:db8::%x", tld, i),
+			fmt.Sprintf("ns2.nic.%s 172800 IN A 198.51.100.%d", tld, i%250+1),
+			fmt.Sprintf("ns2.nic.%s 172800 IN AAAA 2001:db8:1::%x", tld, i),
+			fmt.Sprintf("%s 86400 IN DS %d 8 2 %064X", tld, i, i),
+			fmt.Sprintf("%s 86400 IN NSEC %s NS DS RRSIG NSEC", tld, next),
+			fmt.Sprintf("%s 86400 IN RRSIG DS 8 1 86400 20200823050000 20200810040000 46594 . %s", tld, signature()),
+			fmt.Sprintf("%s 86400 IN RRSIG NSEC 8 1 86400 20200823050000 20200810040000 46594 . %s", tld, signature()),
+		)
+	}
+	return records
+}
+
+func parseBenchZone(b *testing.B, records []string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// BenchmarkZoneStoreHeap reports the heap held by a root sized zone in the
+// nested maps and in the label tree, records included
+func BenchmarkZoneStoreHeap(b *testing.B) {
+	records := benchZoneRecords(1500)
+	for _, c := range []struct {
+		name  string
+		build func([]dns.RR) interface{}
+	}{
+		{"maps", legacyZoneStore},
+		{"tree", func(rrs []dns.RR) interface{} { return NewZoneStoreFromRRSet(rrs) }},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			stats := runtime.MemStats{}
+			heap := int64(0)
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				before := int64(stats.HeapAlloc)
+				store := c.build(parseBenchZone(b, records))
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				heap += int64(stats.HeapAlloc) - before
+				runtime.KeepAlive(store)
+			}
+			b.ReportMetric(float64(heap)/float64(b.N), "heap-B")
+		})
+	}
+}
+
+func BenchmarkZoneStoreLookup(b *testing.B) {
+	store := NewZoneStoreFromRRSet(parseBenchZone(b, benchZoneRecords(1500)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if result := store.Lookup("www.example.tld0042.", dns.TypeA, false); result.Path != LookupReferral {
+			b.Fatalf("expect referral but got %s", result.Path)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// SyncLimits bounds the zone data accepted by a sync against runaway
+// transfers, zero disables a limit
+type SyncLimits struct {
+	MaxRecords int
+	MaxBytes   int64
+}
+
+// DefaultSyncLimits leave the root zone, about 22k records in 2MB, plenty
+// of room to grow
+var DefaultSyncLimits = SyncLimits{MaxRecords: 1000000, MaxBytes: 256 << 20}
+
+// zoneReceiver streams the records of a sync into a zone builder. Axfr
+// transfers are framed, they open with the zone soa and end with the same
+// soa again (RFC 5936 section 2.2).
+type zoneReceiver struct {
+	zone    string
+	framed  bool
+	limits  SyncLimits
+	builder *zoneBuilder
+	soa     *dns.SOA
+	closed  bool
+	records int
+	bytes   int64
+}
+
+func newZoneReceiver(zone string, framed bool, limits SyncLimits) *zoneReceiver {
+	return &zoneReceiver{zone: zone, framed: framed, limits: limits, builder: newZoneBuilder()}
+}
+
+// add takes rr received in size bytes
+func (receiver *zoneReceiver) add(rr dns.RR, size int) error {
+	if receiver.closed {
+		return errors.New("record after closing soa")
+	}
+	receiver.records++
+	receiver.bytes += int64(size)
+	if receiver.limits.MaxRecords > 0 && receiver.records > receiver.limits.MaxRecords {
+		return fmt.Errorf("zone exceeds %d records", receiver.limits.MaxRecords)
+	}
+	if receiver.limits.MaxBytes > 0 && receiver.bytes > receiver.limits.MaxBytes {
+		return fmt.Errorf("zone exceeds %d bytes", receiver.limits.MaxBytes)
+	}
+	soa, ok := rr.(*dns.SOA)
+	if ok == true && strings.EqualFold(soa.Hdr.Name, receiver.zone) == false {
+		return fmt.Errorf("soa of %s out of zone %s", soa.Hdr.Name, receiver.zone)
+	}
+	switch {
+	case receiver.soa == nil && ok == false && receiver.framed:
+		return fmt.Errorf("transfer starts with %s instead of soa", dns.TypeToString[rr.Header().Rrtype])
+	case receiver.soa == nil && ok == true:
+		receiver.soa = soa
+	case ok == true && receiver.framed:
+		if soa.Serial != receiver.soa.Serial {
+			return fmt.Errorf("closing soa serial %d differs from opening serial %d", soa.Serial, receiver.soa.Serial)
+		}
+		receiver.closed = true
+		return nil
+	case ok == true:
+		return errors.New("zone has more than one soa")
+	}
+	receiver.builder.add(rr)
+	return nil
+}
+
+// finish returns the zone store of the received records
+func (receiver *zoneReceiver) finish() (*ZoneStore, error) {
+	if receiver.framed && receiver.closed == false {
+		return nil, errors.New("transfer ended before closing soa")
+	}
+	return receiver.builder.finish()
+}
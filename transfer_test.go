@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestZoneReceiver(t *testing.T) {
+	rrs := testZoneRRs(t)
+	closing, err := dns.NewRR(". 86400 IN SOA a.root-servers.net. nstld.verisign-grs.com. 2020081001 1800 900 604800 86400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name   string
+		framed bool
+		rrs    []dns.RR
+		expect string
+	}{
+		{"transfer", true, append(append([]dns.RR{}, rrs...), rrs[0]), ""},
+		{"zone file", false, rrs, ""},
+		{"no opening soa", true, rrs[1:], "transfer starts with NS instead of soa"},
+		{"no closing soa", true, rrs, "transfer ended before closing soa"},
+		{"serial changed", true, append(append([]dns.RR{}, rrs...), closing), "closing soa serial 2020081001 differs from opening serial 2020081000"},
+		{"after closing soa", true, append(append([]dns.RR{}, rrs...), rrs[0], rrs[1]), "record after closing soa"},
+		{"second soa", false, append(append([]dns.RR{}, rrs...), closing), "zone has more than one soa"},
+	} {
+		receiver := newZoneReceiver(".", c.framed, SyncLimits{})
+		for _, rr := range c.rrs {
+			if err = receiver.add(rr, dns.Len(rr)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			_, err = receiver.finish()
+		}
+		if c.expect == "" && err != nil || c.expect != "" && (err == nil || err.Error() != c.expect) {
+			t.Errorf("%s: expect error %q but got %v", c.name, c.expect, err)
+		}
+	}
+	receiver := newZoneReceiver("example.", true, SyncLimits{})
+	if err := receiver.add(rrs[0], 0); err == nil || err.Error() != "soa of . out of zone example." {
+		t.Errorf("expect soa out of zone fail but got %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EDNS0KeyTag is the edns-key-tag option code (RFC 8145 section 4)
+const EDNS0KeyTag = 14
+
+// trustAnchorMaxClients bounds the number of clients kept in memory
+const trustAnchorMaxClients = 100000
+
+// Trust anchor signaling methods
+const (
+	SignalTAQuery = "ta-query"
+	SignalKeyTag  = "edns-key-tag"
+)
+
+// TrustAnchorClient is the latest key tag set a client signaled
+type TrustAnchorClient struct {
+	KeyTags  []uint16  `json:"key_tags"`
+	Method   string    `json:"method"`
+	LastSeen time.Time `json:"last_seen"`
+	Signals  uint64    `json:"signals"`
+}
+
+// TrustAnchorSignals aggregates the trust anchors resolvers report with
+// _ta-xxxx queries and the edns-key-tag option (RFC 8145)
+type TrustAnchorSignals struct {
+	sync.Mutex
+	clients map[string]*TrustAnchorClient
+	signals map[string]uint64
+	skipped uint64
+}
+
+func NewTrustAnchorSignals() *TrustAnchorSignals {
+	return &TrustAnchorSignals{
+		clients: make(map[string]*TrustAnchorClient),
+		signals: make(map[string]uint64),
+	}
+}
+
+// parseTAQuery returns the key tags of a _ta-xxxx[-xxxx] query name
+func parseTAQuery(qName string) ([]uint16, bool) {
+	labels := dns.SplitDomainName(qName)
+	if len(labels) != 1 || strings.HasPrefix(strings.ToLower(labels[0]), "_ta-") == false {
+		return nil, false
+	}
+	keyTags := make([]uint16, 0)
+	for _, value := range strings.Split(labels[0][4:], "-") {
+		if len(value) != 4 {
+			return nil, false
+		}
+		keyTag, err := strconv.ParseUint(value, 16, 16)
+		if err != nil {
+			return nil, false
+		}
+		keyTags = append(keyTags, uint16(keyTag))
+	}
+	return keyTags, true
+}
+
+// parseKeyTagOption returns the key tags of the edns-key-tag option
+func parseKeyTagOption(r *dns.Msg) ([]uint16, bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, false
+	}
+	for _, option := range opt.Option {
+		local, ok := option.(*dns.EDNS0_LOCAL)
+		if ok == false || local.Code != EDNS0KeyTag || len(local.Data) == 0 || len(local.Data)%2 != 0 {
+			continue
+		}
+		keyTags := make([]uint16, 0, len(local.Data)/2)
+		for i := 0; i < len(local.Data); i += 2 {
+			keyTags = append(keyTags, binary.BigEndian.Uint16(local.Data[i:]))
+		}
+		return keyTags, true
+	}
+	return nil, false
+}
+
+func keyTagSet(keyTags []uint16) string {
+	values := make([]string, 0, len(keyTags))
+	for _, keyTag := range keyTags {
+		values = append(values, strconv.Itoa(int(keyTag)))
+	}
+	return strings.Join(values, ",")
+}
+
+// Observe records the signal of query r from client if it has one
+func (ta *TrustAnchorSignals) Observe(client net.Addr, r *dns.Msg) {
+	method := SignalKeyTag
+	keyTags, ok := parseKeyTagOption(r)
+	if ok == false && len(r.Question) > 0 {
+		method = SignalTAQuery
+		keyTags, ok = parseTAQuery(r.Question[0].Name)
+	}
+	if ok == false {
+		return
+	}
+	sort.Slice(keyTags, func(i, j int) bool { return keyTags[i] < keyTags[j] })
+	ip := addrIP(client).String()
+
+	ta.Lock()
+	defer ta.Unlock()
+	ta.signals[method]++
+	entry, ok := ta.clients[ip]
+	if ok == false {
+		if len(ta.clients) >= trustAnchorMaxClients {
+			ta.skipped++
+			return
+		}
+		entry = &TrustAnchorClient{}
+		ta.clients[ip] = entry
+	}
+	entry.KeyTags = keyTags
+	entry.Method = method
+	entry.LastSeen = time.Now()
+	entry.Signals++
+}
+
+// TrustAnchorReport is the result of the trust anchor api, KeyTagSets
+// counts clients by the key tag set they trust
+type TrustAnchorReport struct {
+	Signals        map[string]uint64            `json:"signals"`
+	KeyTagSets     map[string]int               `json:"key_tag_sets"`
+	Clients        map[string]TrustAnchorClient `json:"clients,omitempty"`
+	SkippedClients uint64                       `json:"skipped_clients"`
+}
+
+// Report returns the aggregated key tag sets, clients are included only
+// when withClients is true
+func (ta *TrustAnchorSignals) Report(withClients bool) *TrustAnchorReport {
+	ta.Lock()
+	defer ta.Unlock()
+	report := &TrustAnchorReport{
+		Signals:        make(map[string]uint64),
+		KeyTagSets:     make(map[string]int),
+		SkippedClients: ta.skipped,
+	}
+	for method, count := range ta.signals {
+		report.Signals[method] = count
+	}
+	if withClients {
+		report.Clients = make(map[string]TrustAnchorClient, len(ta.clients))
+	}
+	for ip, entry := range ta.clients {
+		report.KeyTagSets[keyTagSet(entry.KeyTags)]++
+		if withClients {
+			report.Clients[ip] = *entry
+		}
+	}
+	return report
+}
+
+// handleTrustAnchors serves /trust-anchors?clients=1
+func (manager *Manager) handleTrustAnchors(w http.ResponseWriter, req *http.Request) {
+	withClients := false
+	switch strings.ToLower(req.URL.Query().Get("clients")) {
+	case "1", "true":
+		withClients = true
+	}
+	writeJSON(w, http.StatusOK, manager.trustAnchors.Report(withClients))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func TestParseTAQuery(t *testing.T) {
+	for name, expect := range map[string]string{
+		"_ta-4f66.":      "20326",
+		"_TA-4F66-9728.": "20326,38696",
+		"_ta-4f6.":       "",
+		"_ta-zzzz.":      "",
+		"_ta-4f66.com.":  "",
+		"com.":           "",
+	} {
+		keyTags, ok := parseTAQuery(name)
+		if got := keyTagSet(keyTags); ok != (expect != "") || got != expect {
+			t.Errorf("parseTAQuery(%s) = %s %v, expected %s", name, got, ok, expect)
+		}
+	}
+}
+
+func TestTrustAnchorSignals(t *testing.T) {
+	manager := newTestManager(t)
+	serve := manager.handler("udp", manager.handleRequest)
+
+	taQuery := new(dns.Msg)
+	taQuery.SetQuestion("_ta-9728-4f66.", dns.TypeNULL)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}}
+	serve(w, taQuery)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("expect _ta query answered with nxdomain, got %v", w.msg)
+	}
+
+	keyTagQuery := new(dns.Msg)
+	keyTagQuery.SetQuestion("com.", dns.TypeNS)
+	keyTagQuery.SetEdns0(1232, true)
+	opt := keyTagQuery.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS0KeyTag, Data: []byte{0x4f, 0x66}})
+	serve(&testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.2")}}, keyTagQuery)
+
+	report := manager.trustAnchors.Report(true)
+	if report.KeyTagSets["20326,38696"] != 1 || report.KeyTagSets["20326"] != 1 {
+		t.Errorf("unexpected key tag sets %v", report.KeyTagSets)
+	}
+	if report.Signals[SignalTAQuery] != 1 || report.Signals[SignalKeyTag] != 1 {
+		t.Errorf("unexpected signal counters %v", report.Signals)
+	}
+	if client := report.Clients["192.0.2.2"]; client.Method != SignalKeyTag || len(client.KeyTags) != 1 {
+		t.Errorf("unexpected client signal %+v", client)
+	}
+}
+
+func TestTrustAnchorSignalsRefused(t *testing.T) {
+	filename, cleanup := writeTestACL(t, `{"query": {"rules": [{"prefixes": ["10.0.0.0/8"], "action": "refuse"}]}}`)
+	defer cleanup()
+	manager := newTestManager(t)
+	if err := manager.EnableACL(filename); err != nil {
+		t.Fatal(err)
+	}
+	serve := manager.handler("udp", manager.handleRequest)
+	taQuery := new(dns.Msg)
+	taQuery.SetQuestion("_ta-4f66.", dns.TypeNULL)
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.1.2.3")}}
+	serve(w, taQuery)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("expect query refused by acl, got %v", w.msg)
+	}
+	serve(&testWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}}, taQuery)
+	report := manager.trustAnchors.Report(true)
+	if report.Signals[SignalTAQuery] != 1 || len(report.Clients) != 1 || report.Clients["192.0.2.1"].Method != SignalTAQuery {
+		t.Errorf("expect only the allowed client counted but got %+v", report)
+	}
+}
@@ -0,0 +1,358 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"net"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// batchReadSize is the buffer size of each packet read in a batch, larger
+// than the 512 bytes read by the miekg/dns server so edns queries with
+// options are never cut
+const batchReadSize = 4096
+
+// mmsghdr is struct mmsghdr of recvmmsg and sendmmsg
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// batchPacket is one packet read or written in a batch, name is the raw
+// address of the client and oob the control message of the packet
+type batchPacket struct {
+	data    []byte
+	name    unix.RawSockaddrAny
+	namelen uint32
+	oob     []byte
+}
+
+// batchSocket reads and writes udp packets in batches with recvmmsg and
+// sendmmsg. The system calls are made directly, the batch api of x/net
+// links syscall.recvmsg which newer go linkers refuse, control messages
+// still go through x/net/ipv4 and ipv6 like the miekg/dns server.
+type batchSocket struct {
+	conn    *net.UDPConn
+	raw     syscall.RawConn
+	v6      bool
+	stats   *SocketStats
+	reads   []batchPacket
+	pending []batchPacket
+	headers []mmsghdr
+	iovecs  []unix.Iovec
+}
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+func listenBatchSocket(address string, reusePort bool, size int, stats *SocketStats) (*batchSocket, error) {
+	config := net.ListenConfig{}
+	if reusePort {
+		config.Control = reusePortControl
+	}
+	packetConn, err := config.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	socket := &batchSocket{conn: packetConn.(*net.UDPConn), stats: stats}
+	// the destination of each query becomes the source of its reply, so
+	// sockets bound to a wildcard address answer from the address asked
+	var oobSize int
+	if socket.conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		err = ipv4.NewPacketConn(socket.conn).SetControlMessage(ipv4.FlagDst, true)
+		oobSize = len(ipv4.NewControlMessage(ipv4.FlagDst))
+	} else {
+		socket.v6 = true
+		err = ipv6.NewPacketConn(socket.conn).SetControlMessage(ipv6.FlagDst, true)
+		oobSize = len(ipv6.NewControlMessage(ipv6.FlagDst))
+	}
+	if err == nil {
+		socket.raw, err = socket.conn.SyscallConn()
+	}
+	if err != nil {
+		socket.conn.Close()
+		return nil, err
+	}
+	socket.reads = make([]batchPacket, size)
+	for i := range socket.reads {
+		socket.reads[i].data = make([]byte, batchReadSize)
+		socket.reads[i].oob = make([]byte, oobSize)
+	}
+	socket.pending = make([]batchPacket, 0, size)
+	socket.headers = make([]mmsghdr, size)
+	socket.iovecs = make([]unix.Iovec, size)
+	return socket, nil
+}
+
+// prepare points the message headers at packets for the next system call
+func (socket *batchSocket) prepare(packets []batchPacket, read bool) {
+	for i := range packets {
+		packet := &packets[i]
+		iovec := &socket.iovecs[i]
+		header := &socket.headers[i]
+		*header = mmsghdr{}
+		if read {
+			packet.data = packet.data[:cap(packet.data)]
+			packet.oob = packet.oob[:cap(packet.oob)]
+			packet.namelen = unix.SizeofSockaddrAny
+		}
+		iovec.SetLen(len(packet.data))
+		if len(packet.data) > 0 {
+			iovec.Base = &packet.data[0]
+		}
+		header.hdr.Iov = iovec
+		header.hdr.SetIovlen(1)
+		header.hdr.Name = (*byte)(unsafe.Pointer(&packet.name))
+		header.hdr.Namelen = packet.namelen
+		if len(packet.oob) > 0 {
+			header.hdr.Control = &packet.oob[0]
+			header.hdr.SetControllen(len(packet.oob))
+		}
+	}
+}
+
+// mmsg calls recvmmsg or sendmmsg with the prepared headers of count
+// packets and waits until the socket is ready, failed calls return the
+// syscall.Errno
+func (socket *batchSocket) mmsg(trap uintptr, count int) (int, error) {
+	var n int
+	var errno syscall.Errno
+	call := func(fd uintptr) bool {
+		r, _, e := unix.Syscall6(trap, fd, uintptr(unsafe.Pointer(&socket.headers[0])), uintptr(count), 0, 0, 0)
+		if e == unix.EAGAIN || e == unix.EINTR {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	}
+	var err error
+	if trap == unix.SYS_RECVMMSG {
+		err = socket.raw.Read(call)
+	} else {
+		err = socket.raw.Write(call)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return n, nil
+}
+
+// readBatch reads at least one packet and as many as are queued up to the
+// batch size
+func (socket *batchSocket) readBatch() (int, error) {
+	socket.prepare(socket.reads, true)
+	n, err := socket.mmsg(unix.SYS_RECVMMSG, len(socket.reads))
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		packet := &socket.reads[i]
+		header := &socket.headers[i]
+		packet.data = packet.data[:header.len]
+		packet.oob = packet.oob[:header.hdr.Controllen]
+		packet.namelen = header.hdr.Namelen
+	}
+	return n, nil
+}
+
+// replyControl returns the control message setting the source address of
+// a reply to the destination address of the query like the miekg/dns server
+func (socket *batchSocket) replyControl(oob []byte) []byte {
+	if socket.v6 {
+		cm := new(ipv6.ControlMessage)
+		// ipv4 queries of a dual stack socket are answered by the routing
+		if cm.Parse(oob) != nil || cm.Dst == nil || cm.Dst.To4() != nil {
+			return nil
+		}
+		return (&ipv6.ControlMessage{Src: cm.Dst}).Marshal()
+	}
+	cm := new(ipv4.ControlMessage)
+	if cm.Parse(oob) != nil || cm.Dst == nil {
+		return nil
+	}
+	return (&ipv4.ControlMessage{Src: cm.Dst}).Marshal()
+}
+
+// flush sends the replies queued while serving a batch, sendmmsg may send
+// part of the batch so it is called until all replies are sent
+func (socket *batchSocket) flush() {
+	pending := socket.pending
+	for len(pending) > 0 {
+		socket.prepare(pending, false)
+		n, err := socket.mmsg(unix.SYS_SENDMMSG, len(pending))
+		if err != nil {
+			// the failed reply is dropped and the rest retried
+			atomic.AddUint64(&socket.stats.WriteErrors, 1)
+			log.Debugf("write udp batch fail: %s", err)
+			n = 1
+		}
+		pending = pending[n:]
+	}
+	for i := range socket.pending {
+		socket.pending[i] = batchPacket{}
+	}
+	socket.pending = socket.pending[:0]
+}
+
+// udpAddr converts the raw address of a client
+func udpAddr(name *unix.RawSockaddrAny) *net.UDPAddr {
+	switch name.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(name))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(name))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		addr := &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+		if sa.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa.Scope_id))
+		}
+		return addr
+	}
+	return &net.UDPAddr{}
+}
+
+// batchWriter queues the reply of one query until the batch is flushed,
+// handlers run in the reader goroutine so writes happen before the flush
+type batchWriter struct {
+	socket *batchSocket
+	query  *batchPacket
+	local  net.Addr
+	remote net.Addr
+	oob    []byte
+}
+
+func (w *batchWriter) LocalAddr() net.Addr  { return w.local }
+func (w *batchWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *batchWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *batchWriter) Write(data []byte) (int, error) {
+	w.socket.pending = append(w.socket.pending, batchPacket{
+		data:    data,
+		name:    w.query.name,
+		namelen: w.query.namelen,
+		oob:     w.oob,
+	})
+	return len(data), nil
+}
+
+func (w *batchWriter) Close() error        { return nil }
+func (w *batchWriter) TsigStatus() error   { return nil }
+func (w *batchWriter) TsigTimersOnly(bool) {}
+func (w *batchWriter) Hijack()             {}
+
+// serveBatchPacket answers one query the way the miekg/dns server does:
+// packets with a broken header are dropped and the accept func decides
+// whether the query is served, ignored or rejected with its header only
+func serveBatchPacket(handler dns.HandlerFunc, w dns.ResponseWriter, data []byte) {
+	req := new(dns.Msg)
+	if len(data) < 12 || req.Unpack(data[:12]) != nil {
+		return
+	}
+	header := dns.Header{
+		Id:      binary.BigEndian.Uint16(data[0:]),
+		Bits:    binary.BigEndian.Uint16(data[2:]),
+		Qdcount: binary.BigEndian.Uint16(data[4:]),
+		Ancount: binary.BigEndian.Uint16(data[6:]),
+		Nscount: binary.BigEndian.Uint16(data[8:]),
+		Arcount: binary.BigEndian.Uint16(data[10:]),
+	}
+	switch action := dns.DefaultMsgAcceptFunc(header); action {
+	case dns.MsgAccept:
+		if req.Unpack(data) == nil {
+			handler(w, req)
+			return
+		}
+		fallthrough
+	case dns.MsgReject, dns.MsgRejectNotImplemented:
+		opcode := req.Opcode
+		req.SetRcodeFormatError(req)
+		req.Zero = false
+		if action == dns.MsgRejectNotImplemented {
+			req.Opcode = opcode
+			req.Rcode = dns.RcodeNotImplemented
+		}
+		req.Ns, req.Answer, req.Extra = nil, nil, nil
+		w.WriteMsg(req)
+	}
+}
+
+// serveBatchUDP serves dns at address reading and writing up to size
+// packets per system call. The queries of a batch are served in the reader
+// goroutine one after another and their replies are sent together.
+func (manager *Manager) serveBatchUDP(address string, reusePort bool, pin bool, size int, stats *SocketStats) error {
+	socket, err := listenBatchSocket(address, reusePort, size, stats)
+	if err != nil {
+		return err
+	}
+	defer socket.conn.Close()
+	if pin {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	handler := manager.handler("udp", manager.handleRequest)
+	local := socket.conn.LocalAddr()
+	for {
+		n, err := socket.readBatch()
+		if err != nil {
+			// errors of the system call such as icmp unreachable reports
+			// are counted, errors of the socket end the server
+			if _, ok := err.(syscall.Errno); ok == true {
+				atomic.AddUint64(&stats.ReadErrors, 1)
+				continue
+			}
+			return err
+		}
+		atomic.AddUint64(&stats.Batches, 1)
+		for i := 0; i < n; i++ {
+			query := &socket.reads[i]
+			atomic.AddUint64(&stats.Queries, 1)
+			atomic.AddUint64(&stats.BytesIn, uint64(len(query.data)))
+			w := &batchWriter{
+				socket: socket,
+				query:  query,
+				local:  local,
+				remote: udpAddr(&query.name),
+				oob:    socket.replyControl(query.oob),
+			}
+			serveBatchPacket(handler, w, query.data)
+		}
+		socket.flush()
+	}
+}
@@ -0,0 +1,147 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPListener serves manager over udp at a free loopback address,
+// batch zero uses the miekg/dns server
+func startUDPListener(t testing.TB, manager *Manager, batch int) string {
+	address := freeListenAddress(t)
+	addr, err := ParseListenAddr("udp://" + address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go manager.runListeners(&ListenConfig{Addresses: []*ListenAddr{addr}, Sockets: 1, Batch: batch})
+	waitListener(t, "udp", address)
+	return address
+}
+
+// exchangeRaw sends data to address and returns the response, nil when
+// no response arrives
+func exchangeRaw(t *testing.T, address string, data []byte) []byte {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buffer := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil
+	}
+	return buffer[:n]
+}
+
+func TestServeBatchUDP(t *testing.T) {
+	plain := startUDPListener(t, newTestManager(t), 0)
+	manager := newTestManager(t)
+	batched := startUDPListener(t, manager, 8)
+
+	pack := func(m *dns.Msg) []byte {
+		data, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	query := func(name string, qType uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qType)
+		m.Id = 4242
+		return m
+	}
+	referral := query("com.", dns.TypeNS)
+	referral.SetEdns0(1232, true)
+	status := query(".", dns.TypeSOA)
+	status.Opcode = dns.OpcodeStatus
+	twoQuestions := query(".", dns.TypeSOA)
+	twoQuestions.Question = append(twoQuestions.Question, twoQuestions.Question[0])
+	response := query(".", dns.TypeSOA)
+	response.Response = true
+	broken := pack(query(".", dns.TypeSOA))
+	cases := map[string][]byte{
+		"apex":          pack(query(".", dns.TypeNS)),
+		"referral":      pack(referral),
+		"nxdomain":      pack(query("nonexist.", dns.TypeA)),
+		"notimp":        pack(status),
+		"formerr":       pack(twoQuestions),
+		"response":      pack(response),
+		"broken":        broken[:len(broken)-3],
+		"short header":  broken[:6],
+		"chaos version": pack(&dns.Msg{MsgHdr: dns.MsgHdr{Id: 7}, Question: []dns.Question{{Name: "version.bind.", Qtype: dns.TypeTXT, Qclass: dns.ClassCHAOS}}}),
+	}
+	for name, data := range cases {
+		expect := exchangeRaw(t, plain, data)
+		got := exchangeRaw(t, batched, data)
+		if bytes.Equal(expect, got) == false {
+			t.Errorf("expect batched response of %s query same as miekg/dns server\n%v\nbut got\n%v", name, expect, got)
+		}
+	}
+
+	result, err := runLoad(&LoadConfig{
+		Address: batched,
+		Queries: []*dns.Msg{query("com.", dns.TypeNS), query(".", dns.TypeDNSKEY), referral},
+		Count:   3000,
+		Workers: 4,
+		Window:  32,
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 3000 || result.Received != result.Sent || result.Timeouts != 0 {
+		t.Errorf("expect all 3000 load queries answered but got %+v", result)
+	}
+	sockets := manager.stats.Sockets()
+	if len(sockets) != 1 || sockets[0].Queries < 3000 || sockets[0].Batches == 0 || sockets[0].Batches > sockets[0].Queries {
+		t.Errorf("expect batched socket counted the load queries but got %+v", sockets)
+	}
+	if sockets[0].WriteErrors != 0 || sockets[0].ReadErrors != 0 {
+		t.Errorf("expect no socket errors but got %+v", sockets[0])
+	}
+}
+
+func benchmarkServeUDP(b *testing.B, batch int) {
+	address := startUDPListener(b, newCachedTestManager(b), batch)
+	queries := make([]*dns.Msg, 0)
+	for _, name := range []string{".", "com.", "net.", "org.", "nonexist."} {
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeNS)
+		query.SetEdns0(1232, true)
+		queries = append(queries, query)
+	}
+	b.ResetTimer()
+	result, err := runLoad(&LoadConfig{
+		Address: address,
+		Queries: queries,
+		Count:   b.N,
+		Workers: 8,
+		Window:  32,
+		Timeout: time.Second,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(result.QPS(), "qps")
+	b.ReportMetric(float64(result.Timeouts), "timeouts")
+}
+
+func BenchmarkServeUDP(b *testing.B) {
+	benchmarkServeUDP(b, 0)
+}
+
+func BenchmarkServeBatchUDP(b *testing.B) {
+	benchmarkServeUDP(b, 64)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// serveBatchUDP needs recvmmsg and sendmmsg which only linux provides
+func (manager *Manager) serveBatchUDP(address string, reusePort bool, pin bool, size int, stats *SocketStats) error {
+	return errors.New("batched udp is only supported on linux")
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// XoTALPN is the application protocol used for zone transfer over tls (RFC 9103)
+const XoTALPN = "dot"
+
+// XoTConfig holds the client side settings for zone transfer over tls.
+// Pins map an upstream server (host:port) to the base64 encoded sha256 digest
+// of its certificate or its subject public key info.
+type XoTConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Pins     map[string][]string
+}
+
+// ParseXoTPins parses pin arguments in server=base64(sha256) format
+func ParseXoTPins(values []string) (map[string][]string, error) {
+	pins := make(map[string][]string)
+	for _, value := range values {
+		// base64 padding may end with '=', so split at the first one
+		index := strings.Index(value, "=")
+		if index <= 0 || index == len(value)-1 {
+			return nil, fmt.Errorf("xot pin %s should be in server=pin format", value)
+		}
+		server, pin := value[:index], value[index+1:]
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("xot pin for %s is not a base64 sha256 digest", server)
+		}
+		pins[server] = append(pins[server], pin)
+	}
+	return pins, nil
+}
+
+// TLSConfig builds the client tls config used to transfer zone from server
+func (config *XoTConfig) TLSConfig(server string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		NextProtos: []string{XoTALPN},
+		MinVersion: tls.VersionTLS12,
+	}
+	if host, _, err := net.SplitHostPort(server); err == nil {
+		tlsConfig.ServerName = host
+	}
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	pins := config.Pins[server]
+	if len(pins) > 0 {
+		// pinned upstream without a ca file is authenticated by the pin only
+		if config.CAFile == "" {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPins(rawCerts, pins)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func verifyPins(rawCerts [][]byte, pins []string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("xot server does not present certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	certDigest := sha256.Sum256(cert.Raw)
+	spkiDigest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if pin == base64.StdEncoding.EncodeToString(certDigest[:]) ||
+			pin == base64.StdEncoding.EncodeToString(spkiDigest[:]) {
+			return nil
+		}
+	}
+	return errors.New("xot server certificate does not match any pin")
+}
+
+// NewXoTServerTLSConfig builds the tls config for serving zone transfer,
+// clients must present a certificate signed by clientCAFile if it is set
+func NewXoTServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{XoTALPN},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if pool.AppendCertsFromPEM(data) == false {
+		return nil, fmt.Errorf("no certificate found in %s", filename)
+	}
+	return pool, nil
+}
+
+// handleTransfer serves the full zone for axfr and ixfr queries, ixfr is
+// answered with a full transfer as permitted by RFC 1995
+func (manager *Manager) handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 ||
+		(r.Question[0].Qtype != dns.TypeAXFR && r.Question[0].Qtype != dns.TypeIXFR) {
+		manager.handleRequest(w, r)
+		return
+	}
+	m := new(dns.Msg)
+	m.SetReply(r)
+	if dns.Fqdn(r.Question[0].Name) != "." {
+		m.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(m)
+		return
+	}
+	snapshot := manager.snapshot()
+	if snapshot == nil || snapshot.expired(time.Now()) {
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	rrs := snapshot.store.TransferRRs()
+	ch := make(chan *dns.Envelope)
+	stop := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for start := 0; start < len(rrs); start += transferChunkSize {
+			end := start + transferChunkSize
+			if end > len(rrs) {
+				end = len(rrs)
+			}
+			select {
+			case ch <- &dns.Envelope{RR: rrs[start:end]}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	err := new(dns.Transfer).Out(w, r, ch)
+	close(stop)
+	if err != nil {
+		log.Errorf("zone transfer to %s fail: %s", w.RemoteAddr(), err)
+	}
+}
+
+// transferChunkSize is the number of records put in one transfer message
+const transferChunkSize = 100
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert creates a certificate signed by parent, or a self signed ca
+// when parent is nil, and writes it as pem files into dir
+func newTestCert(t *testing.T, dir string, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	ioutil.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return result
+}
+
+func (c *testCert) spkiPin() string {
+	digest := sha256.Sum256(c.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// newTestManager returns a manager serving the test zone without synchronizer
+func newTestManager(t *testing.T) *Manager {
+	manager := &Manager{
+		stats:        NewStats(),
+		trustAnchors: NewTrustAnchorSignals(),
+	}
+	manager.setZone(NewZoneStoreFromRRSet(testZoneRRs(t)), time.Time{})
+	return manager
+}
+
+// startTestPrimary starts an in-process xot primary serving the test zone
+func startTestPrimary(t *testing.T, config *tls.Config) (string, func()) {
+	manager := newTestManager(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          listener,
+		Handler:           dns.HandlerFunc(manager.handleTransfer),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	return listener.Addr().String(), func() { server.Shutdown() }
+}
+
+func TestXoTTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, dir, "ca", nil)
+	serverCert := newTestCert(t, dir, "server", ca)
+	clientCert := newTestCert(t, dir, "client", ca)
+	other := newTestCert(t, dir, "other", nil)
+
+	serverConfig, err := NewXoTServerTLSConfig(serverCert.certFile, serverCert.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, stop := startTestPrimary(t, serverConfig)
+	defer stop()
+
+	for _, c := range []struct {
+		name    string
+		config  XoTConfig
+		success bool
+	}{
+		{"ca and client cert", XoTConfig{CAFile: ca.certFile, CertFile: clientCert.certFile, KeyFile: clientCert.keyFile}, true},
+		{"spki pin only", XoTConfig{CertFile: clientCert.certFile, KeyFile: clientCert.keyFile,
+			Pins: map[string][]string{primary: {serverCert.spkiPin()}}}, true},
+		{"wrong pin", XoTConfig{CertFile: clientCert.certFile, KeyFile: clientCert.keyFile,
+			Pins: map[string][]string{primary: {other.spkiPin()}}}, false},
+		{"missing client cert", XoTConfig{CAFile: ca.certFile}, false},
+		{"untrusted server", XoTConfig{CAFile: other.certFile, CertFile: clientCert.certFile, KeyFile: clientCert.keyFile}, false},
+	} {
+		config := c.config
+		synchronizer, err := NewAXFRSynchronizer(filepath.Join(dir, "root.zone"), primary, &config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, err := synchronizer.Download(context.Background())
+		if c.success == false {
+			if err == nil {
+				t.Errorf("%s: expect transfer fail but success", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expect transfer success but got err: %s", c.name, err)
+			continue
+		}
+		if got, expect := len(store.TransferRRs()), len(testZoneRRs(t))+1; got != expect {
+			t.Errorf("%s: expect %d transferred records, got %d", c.name, expect, got)
+		}
+	}
+}
+
+func TestParseXoTPins(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	pins, err := ParseXoTPins([]string{"192.0.2.1:853=" + pin, "192.0.2.1:853=" + pin})
+	if err != nil || len(pins["192.0.2.1:853"]) != 2 {
+		t.Errorf("expect two pins for 192.0.2.1:853, got %v %v", pins, err)
+	}
+	for _, value := range []string{"192.0.2.1:853", "=" + pin, "192.0.2.1:853=abcd"} {
+		if _, err := ParseXoTPins([]string{value}); err == nil {
+			t.Errorf("expect parse %s fail", value)
+		}
+	}
+}